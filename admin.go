@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// adminRetryInterval is how often the admin endpoint retries listening on an
+// address in use, such as during an upgrade before the previous process exits
+const adminRetryInterval = time.Second
+
+// adminActionHeader must be set on requests that change state. Browsers only
+// send custom headers cross-origin after a CORS preflight, which the admin
+// endpoint never answers, so another site cannot cancel requests through an
+// operator's browser.
+const adminActionHeader = "X-Flproxy-Admin"
+
+// newAdminHandler serves the admin endpoint:
+//
+//	GET  /                     HTML page of the requests in flight
+//	GET  /requests             requests in flight as JSON
+//	POST /requests/{id}/cancel cancels the request with the request ID
+//	GET  /debug/vars           expvar
+//
+// The endpoint has no authentication and must only listen on a private
+// address. Cancel requests must carry the adminActionHeader.
+func newAdminHandler(requests *inflightRegistry) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := requestsPage.Execute(w, requests.list()); err != nil {
+			log.Printf("failed to render the admin page: %v", err)
+		}
+	})
+	mux.HandleFunc("GET /requests", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(requests.list())
+	})
+	mux.HandleFunc("POST /requests/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(adminActionHeader) == "" {
+			http.Error(w, "missing "+adminActionHeader+" header", http.StatusForbidden)
+			return
+		}
+		id := r.PathValue("id")
+		if !requests.cancel(id) {
+			http.Error(w, "no such request in flight", http.StatusNotFound)
+			return
+		}
+		log.Printf("canceled on the admin endpoint (request_id:%s)", id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	return mux
+}
+
+var requestsPage = template.Must(template.New("requests").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>flow-limit-proxy: requests in flight</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>Requests in flight ({{len .}})</h1>
+<table>
+<tr><th>ID</th><th>State</th><th>Attempt</th><th>Started</th><th>Client</th><th>Route</th><th>Request</th><th></th></tr>
+{{range .}}<tr>
+<td>{{.ID}}</td><td>{{.State}}</td><td>{{.Attempt}}</td><td>{{.Start.Format "15:04:05.000"}}</td><td>{{.Client}}{{with .User}} ({{.}}){{end}}</td><td>{{.Route}}</td><td>{{.Method}} {{.URL}}</td>
+<td><button data-id="{{.ID}}" onclick="cancelRequest(this.dataset.id)">Cancel</button></td>
+</tr>
+{{end}}</table>
+<script>
+function cancelRequest(id) {
+  fetch("requests/" + encodeURIComponent(id) + "/cancel", {method: "POST", headers: {"` + adminActionHeader + `": "1"}}).then(() => location.reload());
+}
+</script>
+</body>
+</html>
+`))
+
+// adminServer serves the admin endpoint on its own address
+type adminServer struct {
+	srv  *http.Server
+	stop chan struct{}
+}
+
+// startAdmin serves handler on addr in the background. While the address is
+// in use, listening is retried, so that a process started by an upgrade takes
+// the endpoint over once the previous one exits.
+func startAdmin(addr string, handler http.Handler) *adminServer {
+	a := &adminServer{srv: &http.Server{Handler: handler}, stop: make(chan struct{})}
+	go func() {
+		logged := false
+		for {
+			ln, err := net.Listen("tcp", addr)
+			if err == nil {
+				log.Printf("admin endpoint on %s", ln.Addr())
+				a.srv.Serve(ln)
+				return
+			}
+			if !logged {
+				log.Printf("admin endpoint unavailable, retrying: %v", err)
+				logged = true
+			}
+			select {
+			case <-a.stop:
+				return
+			case <-time.After(adminRetryInterval):
+			}
+		}
+	}()
+	return a
+}
+
+// shutdown stops the admin endpoint
+func (a *adminServer) shutdown(ctx context.Context) {
+	if a == nil {
+		return
+	}
+	close(a.stop)
+	a.srv.Shutdown(ctx)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getRequests returns the requests in flight listed by the admin endpoint
+func getRequests(t *testing.T, adminURL string) []inflightRequest {
+	t.Helper()
+	res, err := http.Get(adminURL + "/requests")
+	if err != nil {
+		t.Fatalf("Failed to get requests: %v", err)
+	}
+	defer res.Body.Close()
+	var list []inflightRequest
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatalf("Failed to decode requests: %v", err)
+	}
+	return list
+}
+
+// cancelRequest cancels the request with id on the admin endpoint and returns
+// the status
+func cancelRequest(t *testing.T, adminURL, id string) int {
+	t.Helper()
+	req, _ := http.NewRequest("POST", adminURL+"/requests/"+id+"/cancel", nil)
+	req.Header.Set(adminActionHeader, "1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to cancel: %v", err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestAdminRequests(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	proxy, err := newReverseProxy(&Config{ToPort: serverPort(t, slow), MaxConns: 1})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	requests := newInflightRegistry()
+	front := httptest.NewServer(newRequestIDHandler(proxy, false, nil, requests))
+	defer front.Close()
+	admin := httptest.NewServer(newAdminHandler(requests))
+	defer admin.Close()
+
+	send := func(id string, result chan<- int) {
+		req, _ := http.NewRequest("GET", front.URL+"/"+id, nil)
+		req.Header.Set(requestIDHeader, id)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			result <- 0
+			return
+		}
+		res.Body.Close()
+		result <- res.StatusCode
+	}
+	holding := make(chan int, 1)
+	go send("holding", holding)
+	<-started
+	queued := make(chan int, 1)
+	go send("queued", queued)
+
+	// Wait for the second request to queue behind the first
+	var list []inflightRequest
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		list = getRequests(t, admin.URL)
+		if len(list) == 2 && list[1].State == stateQueued {
+			break
+		}
+	}
+	if len(list) != 2 {
+		t.Fatalf("Expected 2 requests in flight, got %+v", list)
+	}
+	if got := list[0]; got.ID != "holding" || got.State != stateUpstream || got.Attempt != 1 || got.Method != "GET" || got.URL != "/holding" || got.Client != "127.0.0.1" {
+		t.Errorf("Expected the first request to hold the slot, got %+v", got)
+	}
+	if got := list[1]; got.ID != "queued" || got.State != stateQueued {
+		t.Errorf("Expected the second request to be queued, got %+v", got)
+	}
+
+	res, err := http.Get(admin.URL + "/")
+	if err != nil {
+		t.Fatalf("Failed to get the page: %v", err)
+	}
+	page, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.Contains(string(page), "Requests in flight (2)") || !strings.Contains(string(page), `data-id="queued"`) || !strings.Contains(string(page), adminActionHeader) {
+		t.Errorf("Expected the page to list the requests, got %s", page)
+	}
+
+	// A simple cross-site form post cannot cancel requests
+	res, err = http.Post(admin.URL+"/requests/queued/cancel", "application/x-www-form-urlencoded", nil)
+	if err != nil {
+		t.Fatalf("Failed to cancel: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403 without the %s header, got %d", adminActionHeader, res.StatusCode)
+	}
+	if list := getRequests(t, admin.URL); len(list) != 2 {
+		t.Errorf("Expected the requests to stay in flight, got %+v", list)
+	}
+
+	// Cancel the queued request
+	if status := cancelRequest(t, admin.URL, "queued"); status != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", status)
+	}
+	select {
+	case status := <-queued:
+		if status != http.StatusServiceUnavailable {
+			t.Errorf("Expected the canceled request to get 503, got %d", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the canceled request to finish")
+	}
+
+	if status := cancelRequest(t, admin.URL, "queued"); status != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a finished request, got %d", status)
+	}
+
+	// Canceling the request holding the slot frees it
+	cancelRequest(t, admin.URL, "holding")
+	select {
+	case <-holding:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the canceled request to finish")
+	}
+	if list := getRequests(t, admin.URL); len(list) != 0 {
+		t.Errorf("Expected no requests in flight, got %+v", list)
+	}
+}
+
+func TestStartAdminRetries(t *testing.T) {
+	// Another process holds the address for a while, as during an upgrade
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := occupied.Addr().String()
+	admin := startAdmin(addr, newAdminHandler(newInflightRegistry()))
+	defer admin.shutdown(t.Context())
+	time.Sleep(100 * time.Millisecond)
+	occupied.Close()
+
+	var res *http.Response
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if res, err = http.Get("http://" + addr + "/requests"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("Expected the admin endpoint to take the address over, got %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authCheckInterval is how often the credential files are checked for changes
+const authCheckInterval = 5 * time.Second
+
+// authRealm is the realm of Basic authentication challenges
+const authRealm = "flow-limit-proxy"
+
+// errUnauthenticated is returned for requests without valid credentials.
+// The error handler maps it to 401 Unauthorized.
+var errUnauthenticated = errors.New("authentication required")
+
+// authFailures counts the requests rejected for missing or invalid credentials
+var authFailures = expvar.NewInt("auth_failures")
+
+// identity is the authenticated identity of a request, the key the client
+// is logged by and per-client limits apply to. It is set further down the
+// handler chain than the access log, which reads it once the request is
+// served, so the context carries a holder rather than the name.
+type identity struct {
+	name string
+}
+
+type identityKey struct{}
+
+// withIdentity returns ctx carrying an empty identity holder
+func withIdentity(ctx context.Context) (context.Context, *identity) {
+	id := &identity{}
+	return context.WithValue(ctx, identityKey{}, id), id
+}
+
+// identityFromContext returns the authenticated identity in ctx, or "" if the
+// request is not authenticated
+func identityFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(identityKey{}).(*identity); ok {
+		return id.name
+	}
+	return ""
+}
+
+// setIdentity records the authenticated identity of req, adding a holder to
+// its context if there is none
+func setIdentity(req *http.Request, name string) *http.Request {
+	id, ok := req.Context().Value(identityKey{}).(*identity)
+	if !ok {
+		var ctx context.Context
+		ctx, id = withIdentity(req.Context())
+		req = req.WithContext(ctx)
+	}
+	id.name = name
+	spanFromContext(req.Context()).setAttr("enduser.id", name)
+	inflightFromContext(req.Context()).setIdentity(name)
+	return req
+}
+
+// authCredentials are the credentials loaded from the configured files
+type authCredentials struct {
+	apiKeys map[string]string // Identities by the hex SHA-256 of their API key
+	users   map[string]string // htpasswd hashes by user name
+	jwt     *jwtVerifier
+}
+
+// loadAPIKeys reads an API key file of "identity:key" lines. A key in
+// format "sha256:<hex>" is the SHA-256 of the key rather than the key.
+func loadAPIKeys(filename string) (map[string]string, error) {
+	keys := map[string]string{}
+	err := readCredentialLines(filename, func(name, key string) error {
+		digest, hashed := strings.CutPrefix(key, "sha256:")
+		if hashed {
+			if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("invalid SHA-256 of the key of %s", name)
+			}
+			digest = strings.ToLower(digest)
+		} else {
+			sum := sha256.Sum256([]byte(key))
+			digest = hex.EncodeToString(sum[:])
+		}
+		if _, ok := keys[digest]; ok {
+			return fmt.Errorf("duplicate key of %s", name)
+		}
+		keys[digest] = name
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid API key file %s: %w", filename, err)
+	}
+	return keys, nil
+}
+
+// loadHtpasswd reads an htpasswd file. Only MD5 ($apr1$) and SHA-1 ({SHA})
+// hashes are supported.
+func loadHtpasswd(filename string) (map[string]string, error) {
+	users := map[string]string{}
+	err := readCredentialLines(filename, func(name, hash string) error {
+		switch {
+		case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "{SHA}"):
+		case strings.HasPrefix(hash, "$2"):
+			return fmt.Errorf("bcrypt hash of %s is not supported, use htpasswd -m", name)
+		default:
+			return fmt.Errorf("unsupported hash of %s, use htpasswd -m", name)
+		}
+		users[name] = hash
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid htpasswd file %s: %w", filename, err)
+	}
+	return users, nil
+}
+
+// readCredentialLines calls fn with the name and value of each "name:value"
+// line of a file, skipping blank lines and comments
+func readCredentialLines(filename string, fn func(name, value string) error) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || name == "" || value == "" {
+			return fmt.Errorf("line %d: expected name:value", n)
+		}
+		if seen[name] {
+			return fmt.Errorf("line %d: duplicate name %s", n, name)
+		}
+		seen[name] = true
+		if err := fn(name, value); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// checkPassword reports whether password matches an htpasswd hash
+func checkPassword(hash, password string) bool {
+	var want string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		want = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		want = apr1(password, salt)
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(want)) == 1
+}
+
+// apr1 returns the Apache MD5 crypt hash of password with salt, as written
+// by htpasswd -m
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	h := md5.New()
+	h.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= md5.Size {
+		h.Write(alt[:min(i, md5.Size)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	// Stretch the hash to slow down guessing
+	for i := range 1000 {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(pw)
+		}
+		sum = h.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	out.WriteString(magic + salt + "$")
+	encode := func(v uint32, n int) {
+		for range n {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(sum[g[0]])<<16|uint32(sum[g[1]])<<8|uint32(sum[g[2]]), 4)
+	}
+	encode(uint32(sum[11]), 2)
+	return out.String()
+}
+
+// authenticator authenticates requests by API key, Basic authentication
+// against an htpasswd file or a bearer JWT validated against a JWKS file,
+// whichever are configured. The files are reloaded when they change, so that
+// credentials can be updated without restarting the proxy.
+type authenticator struct {
+	apiKeysFile  string
+	apiKeyHeader string
+	htpasswdFile string
+	jwksFile     string
+	issuer       string
+	audience     string
+
+	checkInterval time.Duration
+
+	mu        sync.Mutex
+	creds     *authCredentials
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// newAuthenticator returns the authenticator of config, or nil if no
+// credential file is configured
+func newAuthenticator(config *Config) (*authenticator, error) {
+	if config.AuthAPIKeysFile == "" && config.AuthHtpasswdFile == "" && config.AuthJWKSFile == "" {
+		return nil, nil
+	}
+	a := &authenticator{
+		apiKeysFile:   config.AuthAPIKeysFile,
+		apiKeyHeader:  config.AuthAPIKeyHeader,
+		htpasswdFile:  config.AuthHtpasswdFile,
+		jwksFile:      config.AuthJWKSFile,
+		issuer:        config.AuthJWTIssuer,
+		audience:      config.AuthJWTAudience,
+		checkInterval: authCheckInterval,
+	}
+	modTime, err := a.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if a.creds, err = a.load(); err != nil {
+		return nil, err
+	}
+	a.modTime = modTime
+	return a, nil
+}
+
+// current returns the credentials in effect, reloading the files if they
+// changed
+func (a *authenticator) current() *authCredentials {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if time.Since(a.lastCheck) >= a.checkInterval {
+		a.lastCheck = time.Now()
+		// Keep the current credentials if the new files can't be loaded, e.g.
+		// while they are being written.
+		if modTime, err := a.latestModTime(); err != nil {
+			log.Printf("failed to check credential files: %v", err)
+		} else if !modTime.Equal(a.modTime) {
+			if creds, err := a.load(); err != nil {
+				log.Printf("failed to reload credential files: %v", err)
+			} else {
+				a.creds, a.modTime = creds, modTime
+				log.Printf("reloaded credential files")
+			}
+		}
+	}
+	return a.creds
+}
+
+func (a *authenticator) load() (*authCredentials, error) {
+	creds := &authCredentials{}
+	var err error
+	if a.apiKeysFile != "" {
+		if creds.apiKeys, err = loadAPIKeys(a.apiKeysFile); err != nil {
+			return nil, err
+		}
+	}
+	if a.htpasswdFile != "" {
+		if creds.users, err = loadHtpasswd(a.htpasswdFile); err != nil {
+			return nil, err
+		}
+	}
+	if a.jwksFile != "" {
+		keys, err := loadJWKS(a.jwksFile)
+		if err != nil {
+			return nil, err
+		}
+		creds.jwt = &jwtVerifier{keys: keys, issuer: a.issuer, audience: a.audience}
+	}
+	return creds, nil
+}
+
+// latestModTime returns the latest modification time of the files
+func (a *authenticator) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{a.apiKeysFile, a.htpasswdFile, a.jwksFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// authenticate returns the identity of the client of req: the user name of
+// Basic authentication, the subject of a bearer JWT, or the identity of an
+// API key. Credentials of a method not configured are ignored.
+func (a *authenticator) authenticate(req *http.Request) (string, error) {
+	creds := a.current()
+	if user, password, ok := req.BasicAuth(); ok && creds.users != nil {
+		if hash, ok := creds.users[user]; ok && checkPassword(hash, password) {
+			return user, nil
+		}
+		return "", fmt.Errorf("%w: invalid user or password", errUnauthenticated)
+	}
+	if token, ok := bearerToken(req); ok && creds.jwt != nil {
+		name, err := creds.jwt.verify(token, time.Now())
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", errUnauthenticated, err)
+		}
+		return name, nil
+	}
+	if key := req.Header.Get(a.apiKeyHeader); key != "" && creds.apiKeys != nil {
+		sum := sha256.Sum256([]byte(key))
+		if name, ok := creds.apiKeys[hex.EncodeToString(sum[:])]; ok {
+			return name, nil
+		}
+		return "", fmt.Errorf("%w: invalid API key", errUnauthenticated)
+	}
+	return "", fmt.Errorf("%w: no credentials", errUnauthenticated)
+}
+
+// bearerToken returns the token of a bearer Authorization header. The scheme
+// is case-insensitive (RFC 9110).
+func bearerToken(req *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// credentialHeaders returns the request headers that carry credentials for
+// the proxy: Authorization when Basic authentication or JWTs are configured,
+// and the API key header when API keys are
+func (a *authenticator) credentialHeaders() []string {
+	var headers []string
+	if a.htpasswdFile != "" || a.jwksFile != "" {
+		headers = append(headers, "Authorization")
+	}
+	if a.apiKeysFile != "" {
+		headers = append(headers, a.apiKeyHeader)
+	}
+	return headers
+}
+
+// challenge sets the WWW-Authenticate headers of a 401 response
+func (a *authenticator) challenge(h http.Header) {
+	creds := a.current()
+	if creds.users != nil {
+		h.Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", authRealm))
+	}
+	if creds.jwt != nil {
+		h.Add("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", authRealm))
+	}
+}
+
+// authHandler passes the authenticated requests to next, with their identity
+// and without any of the configured credential headers. The upstream never
+// sees credentials meant for the proxy, whichever method the client
+// authenticated with.
+type authHandler struct {
+	next http.Handler
+	auth *authenticator
+}
+
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name, err := h.auth.authenticate(req)
+	if err != nil {
+		authFailures.Add(1)
+		log.Printf("rejected: %s %s from %s: %v (request_id:%s)", req.Method, req.URL, req.RemoteAddr, err, requestIDFromContext(req.Context()))
+		if isGRPC(req) {
+			writeGRPCError(w, err)
+			return
+		}
+		h.auth.challenge(w.Header())
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+	req = setIdentity(req, name)
+	// Copy the request rather than change the headers of the one being served
+	req = req.WithContext(req.Context())
+	req.Header = req.Header.Clone()
+	for _, header := range h.auth.credentialHeaders() {
+		req.Header.Del(header)
+	}
+	h.next.ServeHTTP(w, req)
+}
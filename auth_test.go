@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeCredentials writes a credential file and returns its path
+func writeCredentials(t *testing.T, name, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return filename
+}
+
+func TestCheckPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+	}{
+		// Hashes written by openssl passwd -apr1 and htpasswd -s
+		{name: "MD5", hash: "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", password: "secret", want: true},
+		{name: "MD5 short salt", hash: "$apr1$xy$RJI9o7bivrdM6OywkpwlC0", password: "a-much-longer-password-123", want: true},
+		{name: "MD5 wrong password", hash: "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", password: "Secret", want: false},
+		{name: "SHA-1", hash: "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", password: "secret", want: true},
+		{name: "SHA-1 wrong password", hash: "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", password: "secrets", want: false},
+		{name: "unsupported", hash: "secret", password: "secret", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkPassword(tt.hash, tt.password); got != tt.want {
+				t.Errorf("Expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLoadCredentialFiles(t *testing.T) {
+	digest := sha256.Sum256([]byte("hashed-key"))
+	tests := []struct {
+		name    string
+		load    func(string) (map[string]string, error)
+		content string
+		wantErr bool
+	}{
+		{name: "API keys", load: loadAPIKeys, content: "# batch jobs\nbatch:plain-key\n\nreports:sha256:" + hex.EncodeToString(digest[:]) + "\n"},
+		{name: "API key without identity", load: loadAPIKeys, content: "plain-key\n", wantErr: true},
+		{name: "invalid API key digest", load: loadAPIKeys, content: "batch:sha256:abcd\n", wantErr: true},
+		{name: "duplicate API key", load: loadAPIKeys, content: "batch:key\nreports:key\n", wantErr: true},
+		{name: "htpasswd", load: loadHtpasswd, content: "alice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"},
+		{name: "bcrypt", load: loadHtpasswd, content: "alice:$2y$05$abcdefghijklmnopqrstuv\n", wantErr: true},
+		{name: "plain password", load: loadHtpasswd, content: "alice:secret\n", wantErr: true},
+		{name: "duplicate user", load: loadHtpasswd, content: "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\nalice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.load(writeCredentials(t, "credentials", tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %t, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestAuthHandler(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	digest := sha256.Sum256([]byte("reports-key"))
+	config := &Config{
+		AuthAPIKeysFile:  writeCredentials(t, "api-keys", "batch:batch-key\nreports:sha256:"+hex.EncodeToString(digest[:])+"\n"),
+		AuthAPIKeyHeader: "X-Api-Key",
+		AuthHtpasswdFile: writeCredentials(t, "htpasswd", "alice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n"),
+		AuthJWKSFile:     keys.writeJWKS(t),
+		AuthJWTIssuer:    "https://issuer.example.com",
+	}
+	auth, err := newAuthenticator(config)
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	var seen string
+	handler := &authHandler{
+		next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = identityFromContext(r.Context())
+		}),
+		auth: auth,
+	}
+	token := keys.sign(t, "ES256", "ec", map[string]any{"sub": "svc-1", "iss": "https://issuer.example.com", "exp": time.Now().Add(time.Hour).Unix()})
+
+	tests := []struct {
+		name       string
+		header     map[string]string
+		basic      []string
+		wantStatus int
+		wantUser   string
+	}{
+		{name: "API key", header: map[string]string{"X-Api-Key": "batch-key"}, wantStatus: http.StatusOK, wantUser: "batch"},
+		{name: "hashed API key", header: map[string]string{"X-Api-Key": "reports-key"}, wantStatus: http.StatusOK, wantUser: "reports"},
+		{name: "Basic", basic: []string{"alice", "secret"}, wantStatus: http.StatusOK, wantUser: "alice"},
+		{name: "bearer JWT", header: map[string]string{"Authorization": "Bearer " + token}, wantStatus: http.StatusOK, wantUser: "svc-1"},
+		{name: "bearer JWT lower case", header: map[string]string{"Authorization": "bearer " + token}, wantStatus: http.StatusOK, wantUser: "svc-1"},
+		{name: "wrong API key", header: map[string]string{"X-Api-Key": "guess"}, wantStatus: http.StatusUnauthorized},
+		{name: "wrong password", basic: []string{"alice", "guess"}, wantStatus: http.StatusUnauthorized},
+		{name: "unknown user", basic: []string{"mallory", "secret"}, wantStatus: http.StatusUnauthorized},
+		{name: "invalid JWT", header: map[string]string{"Authorization": "Bearer " + token + "x"}, wantStatus: http.StatusUnauthorized},
+		{name: "no credentials", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen = ""
+			req := httptest.NewRequest("GET", "/", nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			if tt.basic != nil {
+				req.SetBasicAuth(tt.basic[0], tt.basic[1])
+			}
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+			if res.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, res.Code)
+			}
+			if seen != tt.wantUser {
+				t.Errorf("Expected identity %q, got %q", tt.wantUser, seen)
+			}
+			if tt.wantStatus == http.StatusUnauthorized {
+				challenges := strings.Join(res.Header().Values("WWW-Authenticate"), ", ")
+				if !strings.Contains(challenges, `Basic realm="flow-limit-proxy"`) || !strings.Contains(challenges, "Bearer") {
+					t.Errorf("Expected Basic and Bearer challenges, got %q", challenges)
+				}
+			}
+		})
+	}
+
+	// gRPC calls get a gRPC status
+	req := httptest.NewRequest("POST", "/pkg.Service/Get", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if got := res.Header().Get("Grpc-Status"); got != "16" {
+		t.Errorf("Expected grpc-status 16 (UNAUTHENTICATED), got %q", got)
+	}
+}
+
+func TestAuthStripsCredentials(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	var mu sync.Mutex
+	var upstream http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		upstream = r.Header
+	}))
+	defer backend.Close()
+
+	config := &Config{
+		ToPort:           serverPort(t, backend),
+		MaxConns:         1,
+		AuthAPIKeysFile:  writeCredentials(t, "api-keys", "batch:batch-key\n"),
+		AuthAPIKeyHeader: "X-Api-Key",
+		AuthHtpasswdFile: writeCredentials(t, "htpasswd", "alice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n"),
+		AuthJWKSFile:     keys.writeJWKS(t),
+	}
+	proxy, err := newReverseProxy(config)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	auth, err := newAuthenticator(config)
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	handler := &authHandler{next: proxy, auth: auth}
+	token := keys.sign(t, "ES256", "ec", map[string]any{"sub": "svc-1", "exp": time.Now().Add(time.Hour).Unix()})
+
+	// The client sends both credential headers, only one of which is used
+	tests := []struct {
+		name   string
+		header map[string]string
+		basic  []string
+	}{
+		{name: "API key", header: map[string]string{"X-Api-Key": "batch-key", "Authorization": "Token for-the-proxy"}},
+		{name: "Basic", header: map[string]string{"X-Api-Key": "for-the-proxy"}, basic: []string{"alice", "secret"}},
+		{name: "bearer JWT", header: map[string]string{"Authorization": "Bearer " + token, "X-Api-Key": "for-the-proxy"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Other", "kept")
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			if tt.basic != nil {
+				req.SetBasicAuth(tt.basic[0], tt.basic[1])
+			}
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+			if res.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", res.Code)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, header := range []string{"Authorization", "X-Api-Key"} {
+				if got := upstream.Get(header); got != "" {
+					t.Errorf("Expected the upstream not to get the %s header, got %q", header, got)
+				}
+				if req.Header.Get(header) == "" {
+					t.Errorf("Expected the client's request to keep its %s header", header)
+				}
+			}
+			if got := upstream.Get("X-Other"); got != "kept" {
+				t.Errorf("Expected the other headers to reach the upstream, got %q", got)
+			}
+		})
+	}
+}
+
+func TestAuthReload(t *testing.T) {
+	config := &Config{
+		AuthAPIKeysFile:  writeCredentials(t, "api-keys", "batch:old-key\n"),
+		AuthAPIKeyHeader: "X-Api-Key",
+	}
+	auth, err := newAuthenticator(config)
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	auth.checkInterval = 0
+	authenticate := func(key string) error {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Api-Key", key)
+		_, err := auth.authenticate(req)
+		return err
+	}
+
+	os.WriteFile(config.AuthAPIKeysFile, []byte("batch:new-key\n"), 0o644)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(config.AuthAPIKeysFile, later, later)
+	if err := authenticate("new-key"); err != nil {
+		t.Errorf("Expected the new key to be accepted, got %v", err)
+	}
+	if err := authenticate("old-key"); err == nil {
+		t.Error("Expected the old key to be rejected")
+	}
+
+	// A broken file keeps the credentials in effect
+	os.WriteFile(config.AuthAPIKeysFile, []byte("new-key\n"), 0o644)
+	later = later.Add(time.Second)
+	os.Chtimes(config.AuthAPIKeysFile, later, later)
+	if err := authenticate("new-key"); err != nil {
+		t.Errorf("Expected the previous credentials to stay in effect, got %v", err)
+	}
+
+	// No credential files disables authentication
+	if a, err := newAuthenticator(&Config{}); a != nil || err != nil {
+		t.Errorf("Expected no authenticator, got %v %v", a, err)
+	}
+}
+
+func TestAuthAccessLog(t *testing.T) {
+	logs := captureLog(t)
+	config := &Config{
+		AuthHtpasswdFile: writeCredentials(t, "htpasswd", "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"),
+		AuthAPIKeyHeader: "X-Api-Key",
+	}
+	auth, err := newAuthenticator(config)
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	var upstream http.Header
+	rules := &HeaderRules{Set: map[string]string{"X-Authenticated-User": "{identity}"}}
+	if err := rules.init(); err != nil {
+		t.Fatalf("Failed to init header rules: %v", err)
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rules.apply(r.Header, headerVars(r, ""))
+		upstream = r.Header
+	})
+	handler := newRequestIDHandler(&authHandler{next: next, auth: auth}, true, nil, nil)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("alice", "secret")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got := upstream.Get("X-Authenticated-User"); got != "alice" {
+		t.Errorf("Expected the identity in the header template, got %q", got)
+	}
+	if line := logs.String(); !strings.Contains(line, `access: 192.0.2.1 alice "GET`) {
+		t.Errorf("Expected the identity in the access log, got %q", line)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync/atomic"
+)
+
+// Load balancing strategies
+const (
+	lbRoundRobin       = "round-robin"
+	lbLeastInFlight    = "least-in-flight"
+	lbRandomTwoChoices = "random-two-choices"
+	lbConsistentHash   = "consistent-hash"
+)
+
+// hashRingReplicas is the number of points each upstream has on the hash ring.
+const hashRingReplicas = 100
+
+// validateLBStrategy validates the load balancing strategy name
+func validateLBStrategy(strategy string) error {
+	switch strategy {
+	case "", lbRoundRobin, lbLeastInFlight, lbRandomTwoChoices, lbConsistentHash:
+		return nil
+	}
+	return fmt.Errorf("unknown load balancing strategy %q", strategy)
+}
+
+// upstream is a single upstream instance requests are balanced across.
+type upstream struct {
+	target    Target
+	host      string
+	scheme    string
+	transport http.RoundTripper
+	inflight  atomic.Int64
+	health    upstreamHealth
+}
+
+// newUpstream creates an upstream for target. Requests are sent through base,
+// or through a copy of it connecting to the target's unix domain socket or
+// using its TLS configuration.
+func newUpstream(target Target, base *http.Transport) (*upstream, error) {
+	u := &upstream{
+		target:    target,
+		host:      fmt.Sprintf("localhost:%d", target.Port),
+		scheme:    "http",
+		transport: base,
+	}
+	if target.Socket != "" {
+		// The host only names the upstream in the request; connections go to the socket
+		u.host = "localhost"
+		base = newUnixTransport(base, target.Socket)
+		u.transport = base
+	}
+	if target.TLS != nil {
+		tlsConfig, err := target.TLS.clientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", target, err)
+		}
+		if tlsConfig.InsecureSkipVerify {
+			log.Printf("WARNING: skipping certificate verification of upstream %s", target)
+		}
+		transport := base.Clone()
+		transport.TLSClientConfig = tlsConfig
+		u.scheme = "https"
+		u.transport = transport
+	}
+	return u, nil
+}
+
+// url returns reqURL pointed at this upstream instance
+func (u *upstream) url(reqURL *url.URL) *url.URL {
+	out := *reqURL
+	out.Scheme = u.scheme
+	out.Host = u.host
+	return &out
+}
+
+// balancer picks the upstream instance for each attempt with one of the load
+// balancing strategies, skipping instances ejected by the health checks.
+type balancer struct {
+	strategy   string
+	hashHeader string
+	upstreams  []*upstream
+	next       atomic.Uint64
+	ring       []ringPoint
+}
+
+type ringPoint struct {
+	hash     uint32
+	upstream *upstream
+}
+
+func newBalancer(config *Config, base *http.Transport) (*balancer, error) {
+	b := &balancer{
+		strategy:   config.LBStrategy,
+		hashHeader: config.LBHashHeader,
+	}
+	for _, target := range config.targets() {
+		u, err := newUpstream(target, base)
+		if err != nil {
+			return nil, err
+		}
+		b.upstreams = append(b.upstreams, u)
+	}
+	if b.strategy == lbConsistentHash {
+		for _, u := range b.upstreams {
+			for i := 0; i < hashRingReplicas; i++ {
+				b.ring = append(b.ring, ringPoint{hash: hashKey(u.target.String() + "#" + strconv.Itoa(i)), upstream: u})
+			}
+		}
+		slices.SortFunc(b.ring, func(x, y ringPoint) int { return cmp.Compare(x.hash, y.hash) })
+	}
+	return b, nil
+}
+
+// pick chooses the upstream for the next attempt of req. When retrying, exclude
+// is the upstream that just failed, and a different one is preferred.
+// req is nil for TCP connections. It returns nil when every upstream is ejected.
+func (b *balancer) pick(req *http.Request, exclude *upstream) *upstream {
+	candidates := b.candidates(exclude)
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+
+	switch b.strategy {
+	case lbLeastInFlight:
+		return b.leastInFlight(candidates)
+	case lbRandomTwoChoices:
+		return b.randomTwoChoices(candidates)
+	case lbConsistentHash:
+		if req == nil {
+			break
+		}
+		if key := req.Header.Get(b.hashHeader); key != "" {
+			return b.hashed(key, candidates)
+		}
+	}
+	return b.roundRobin(candidates)
+}
+
+// available reports whether any upstream is in rotation
+func (b *balancer) available() bool {
+	for _, u := range b.upstreams {
+		if u.health.available() {
+			return true
+		}
+	}
+	return false
+}
+
+// candidates returns the upstreams in rotation that are eligible for the next
+// attempt. exclude is only returned when it is the last one in rotation.
+func (b *balancer) candidates(exclude *upstream) []*upstream {
+	candidates := make([]*upstream, 0, len(b.upstreams))
+	for _, u := range b.upstreams {
+		if u != exclude && u.health.available() {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 && exclude != nil && exclude.health.available() {
+		candidates = append(candidates, exclude)
+	}
+	return candidates
+}
+
+func (b *balancer) roundRobin(candidates []*upstream) *upstream {
+	n := b.next.Add(1) - 1
+	return candidates[n%uint64(len(candidates))]
+}
+
+func (b *balancer) leastInFlight(candidates []*upstream) *upstream {
+	// Start from a rotating offset so that ties are spread across upstreams
+	offset := int(b.next.Add(1) - 1)
+	best := candidates[offset%len(candidates)]
+	for i := 1; i < len(candidates); i++ {
+		u := candidates[(offset+i)%len(candidates)]
+		if u.inflight.Load() < best.inflight.Load() {
+			best = u
+		}
+	}
+	return best
+}
+
+func (b *balancer) randomTwoChoices(candidates []*upstream) *upstream {
+	i := rand.IntN(len(candidates))
+	j := rand.IntN(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	if candidates[j].inflight.Load() < candidates[i].inflight.Load() {
+		return candidates[j]
+	}
+	return candidates[i]
+}
+
+// hashed walks the ring clockwise from the key's hash and returns the first
+// candidate, so a key keeps going to the same upstream while it is available.
+func (b *balancer) hashed(key string, candidates []*upstream) *upstream {
+	h := hashKey(key)
+	start, _ := slices.BinarySearchFunc(b.ring, h, func(p ringPoint, h uint32) int { return cmp.Compare(p.hash, h) })
+	for i := 0; i < len(b.ring); i++ {
+		p := b.ring[(start+i)%len(b.ring)]
+		if slices.Contains(candidates, p.upstream) {
+			return p.upstream
+		}
+	}
+	return candidates[0]
+}
+
+func hashKey(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestBalancer(t *testing.T, strategy string, ports ...uint) *balancer {
+	t.Helper()
+	config := &Config{LBStrategy: strategy, LBHashHeader: "X-User-ID"}
+	for _, port := range ports {
+		config.Targets = append(config.Targets, Target{Port: port})
+	}
+	b, err := newBalancer(config, newBaseTransport(config))
+	if err != nil {
+		t.Fatalf("Failed to create balancer: %v", err)
+	}
+	return b
+}
+
+func newTestRequest(t *testing.T, header http.Header) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest("GET", "http://localhost", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	for k, values := range header {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	return req
+}
+
+func TestValidateLBStrategy(t *testing.T) {
+	for _, strategy := range []string{"", lbRoundRobin, lbLeastInFlight, lbRandomTwoChoices, lbConsistentHash} {
+		if err := validateLBStrategy(strategy); err != nil {
+			t.Errorf("Unexpected error for strategy %q: %v", strategy, err)
+		}
+	}
+	if err := validateLBStrategy("fastest"); err == nil {
+		t.Error("Expected error for unknown strategy")
+	}
+}
+
+func TestBalancerSingleTarget(t *testing.T) {
+	b, err := newBalancer(&Config{ToPort: 9090}, newBaseTransport(&Config{}))
+	if err != nil {
+		t.Fatalf("Failed to create balancer: %v", err)
+	}
+
+	u := b.pick(newTestRequest(t, nil), nil)
+	if u.host != "localhost:9090" {
+		t.Errorf("Expected host localhost:9090, got %s", u.host)
+	}
+
+	// With a single target, retries go to the same instance
+	if got := b.pick(newTestRequest(t, nil), u); got != u {
+		t.Errorf("Expected the only upstream on retry, got %s", got.host)
+	}
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b := newTestBalancer(t, lbRoundRobin, 9090, 9091, 9092)
+
+	counts := map[string]int{}
+	for i := 0; i < 9; i++ {
+		counts[b.pick(newTestRequest(t, nil), nil).host]++
+	}
+
+	for _, u := range b.upstreams {
+		if counts[u.host] != 3 {
+			t.Errorf("Expected 3 picks for %s, got %d", u.host, counts[u.host])
+		}
+	}
+}
+
+func TestBalancerLeastInFlight(t *testing.T) {
+	b := newTestBalancer(t, lbLeastInFlight, 9090, 9091, 9092)
+	b.upstreams[0].inflight.Store(3)
+	b.upstreams[1].inflight.Store(1)
+	b.upstreams[2].inflight.Store(2)
+
+	for i := 0; i < 3; i++ {
+		if got := b.pick(newTestRequest(t, nil), nil); got != b.upstreams[1] {
+			t.Errorf("Expected least loaded upstream %s, got %s", b.upstreams[1].host, got.host)
+		}
+	}
+}
+
+func TestBalancerRandomTwoChoices(t *testing.T) {
+	b := newTestBalancer(t, lbRandomTwoChoices, 9090, 9091)
+	b.upstreams[0].inflight.Store(5)
+
+	// With two upstreams both are always compared
+	for i := 0; i < 10; i++ {
+		if got := b.pick(newTestRequest(t, nil), nil); got != b.upstreams[1] {
+			t.Errorf("Expected less loaded upstream %s, got %s", b.upstreams[1].host, got.host)
+		}
+	}
+}
+
+func TestBalancerConsistentHash(t *testing.T) {
+	b := newTestBalancer(t, lbConsistentHash, 9090, 9091, 9092)
+
+	req := newTestRequest(t, http.Header{"X-User-ID": {"alice"}})
+	first := b.pick(req, nil)
+	for i := 0; i < 10; i++ {
+		if got := b.pick(req, nil); got != first {
+			t.Fatalf("Expected the same upstream %s for the same key, got %s", first.host, got.host)
+		}
+	}
+
+	// Keys are spread across upstreams
+	seen := map[*upstream]bool{}
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+		seen[b.pick(newTestRequest(t, http.Header{"X-User-ID": {key}}), nil)] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("Expected keys to be spread across upstreams, got %d", len(seen))
+	}
+
+	// Without the header, requests are still balanced
+	if got := b.pick(newTestRequest(t, nil), nil); got == nil {
+		t.Error("Expected an upstream without the hash header")
+	}
+}
+
+func TestBalancerRetryPrefersDifferentInstance(t *testing.T) {
+	for _, strategy := range []string{lbRoundRobin, lbLeastInFlight, lbRandomTwoChoices, lbConsistentHash} {
+		t.Run(strategy, func(t *testing.T) {
+			b := newTestBalancer(t, strategy, 9090, 9091, 9092)
+			req := newTestRequest(t, http.Header{"X-User-ID": {"alice"}})
+
+			for i := 0; i < 10; i++ {
+				failed := b.pick(req, nil)
+				if got := b.pick(req, failed); got == failed {
+					t.Fatalf("Expected retry to avoid %s", failed.host)
+				}
+			}
+		})
+	}
+}
+
+func TestCustomTransportLoadBalancing(t *testing.T) {
+	var counts [3]atomic.Int32
+	var targets []Target
+	for i := range counts {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			counts[i].Add(1)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+		targets = append(targets, Target{Port: serverPort(t, server)})
+	}
+
+	transport := newTestTransport(t, &Config{MaxConns: 3, Targets: targets, LBStrategy: lbRoundRobin})
+
+	for i := 0; i < 6; i++ {
+		req, err := http.NewRequest("GET", "http://localhost/", nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	for i := range counts {
+		if got := counts[i].Load(); got != 2 {
+			t.Errorf("Expected 2 calls to upstream %d, got %d", i, got)
+		}
+	}
+}
+
+func TestCustomTransportRetryUsesAnotherInstance(t *testing.T) {
+	var badCalls, goodCalls atomic.Int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badCalls.Add(1)
+		// Simulate connection error by closing connection
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			t.Fatal("webserver doesn't support hijacking")
+		}
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		goodCalls.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer good.Close()
+
+	transport := newTestTransport(t, &Config{
+		MaxConns:   1,
+		Targets:    []Target{{Port: serverPort(t, bad)}, {Port: serverPort(t, good)}},
+		LBStrategy: lbRoundRobin,
+	})
+
+	req, err := http.NewRequest("GET", "http://localhost/", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if got := badCalls.Load(); got != 1 {
+		t.Errorf("Expected 1 call to the failing upstream, got %d", got)
+	}
+	if got := goodCalls.Load(); got != 1 {
+		t.Errorf("Expected the retry to go to the healthy upstream once, got %d", got)
+	}
+}
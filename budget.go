@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// retryBudgetWindow is how long deposits and withdrawals count toward the budget.
+	retryBudgetWindow = 10 * time.Second
+	// retryBudgetBuckets is the number of slots the window is divided into.
+	retryBudgetBuckets = 10
+)
+
+// retryBudget limits retries to a percentage of recent successful requests,
+// plus a minimum number of retries per second so that low-traffic proxies can
+// still retry. Once the budget is spent, failures are returned immediately
+// instead of being retried, which keeps retries from multiplying the load on
+// an upstream that is already struggling.
+//
+// A nil *retryBudget allows every retry.
+type retryBudget struct {
+	ratio        float64 // retries allowed per successful request
+	minPerSecond float64 // retries always allowed per second
+	now          func() time.Time
+
+	mu          sync.Mutex
+	deposits    [retryBudgetBuckets]int
+	withdrawals [retryBudgetBuckets]int
+	epochs      [retryBudgetBuckets]int64
+}
+
+// newRetryBudget creates a retryBudget. percent is the share of successful
+// requests (0-100) that may be retried. It returns nil, meaning unlimited,
+// when both percent and minPerSecond are zero.
+func newRetryBudget(percent, minPerSecond float64) *retryBudget {
+	if percent <= 0 && minPerSecond <= 0 {
+		return nil
+	}
+	return &retryBudget{
+		ratio:        percent / 100,
+		minPerSecond: minPerSecond,
+		now:          time.Now,
+	}
+}
+
+// deposit records a successful request.
+func (b *retryBudget) deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deposits[b.bucket()]++
+}
+
+// withdraw reports whether a retry is allowed and, if so, charges it to the budget.
+func (b *retryBudget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := b.bucket()
+	var deposits, withdrawals int
+	for j := range b.epochs {
+		if b.live(j) {
+			deposits += b.deposits[j]
+			withdrawals += b.withdrawals[j]
+		}
+	}
+	allowed := b.ratio*float64(deposits) + b.minPerSecond*retryBudgetWindow.Seconds()
+	if float64(withdrawals+1) > allowed {
+		return false
+	}
+	b.withdrawals[i]++
+	return true
+}
+
+// bucket returns the slot for the current time, clearing it if it belongs to
+// an earlier epoch. Callers must hold b.mu.
+func (b *retryBudget) bucket() int {
+	epoch := b.epoch()
+	i := int(epoch % retryBudgetBuckets)
+	if b.epochs[i] != epoch {
+		b.epochs[i] = epoch
+		b.deposits[i] = 0
+		b.withdrawals[i] = 0
+	}
+	return i
+}
+
+// live reports whether slot i still falls inside the window. Callers must hold b.mu.
+func (b *retryBudget) live(i int) bool {
+	return b.epoch()-b.epochs[i] < retryBudgetBuckets
+}
+
+func (b *retryBudget) epoch() int64 {
+	return b.now().UnixNano() / int64(retryBudgetWindow/retryBudgetBuckets)
+}
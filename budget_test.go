@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewRetryBudgetDisabled(t *testing.T) {
+	budget := newRetryBudget(0, 0)
+	if budget != nil {
+		t.Fatal("Expected nil budget when percent and minimum are zero")
+	}
+
+	// A nil budget allows every retry
+	for i := 0; i < 100; i++ {
+		if !budget.withdraw() {
+			t.Fatalf("Expected nil budget to allow retry %d", i)
+		}
+	}
+	budget.deposit()
+}
+
+func TestRetryBudgetMinPerSecond(t *testing.T) {
+	now := time.Unix(1000, 0)
+	budget := newRetryBudget(0, 1)
+	budget.now = func() time.Time { return now }
+
+	// 1 retry per second over a 10 second window
+	for i := 0; i < 10; i++ {
+		if !budget.withdraw() {
+			t.Fatalf("Expected retry %d to be allowed", i)
+		}
+	}
+	if budget.withdraw() {
+		t.Error("Expected retry to be rejected once the minimum is spent")
+	}
+
+	// Withdrawals expire after the window
+	now = now.Add(retryBudgetWindow)
+	if !budget.withdraw() {
+		t.Error("Expected retry to be allowed after the window passed")
+	}
+}
+
+func TestRetryBudgetPercent(t *testing.T) {
+	now := time.Unix(1000, 0)
+	budget := newRetryBudget(20, 0)
+	budget.now = func() time.Time { return now }
+
+	if budget.withdraw() {
+		t.Error("Expected retry to be rejected without any successful requests")
+	}
+
+	for i := 0; i < 10; i++ {
+		budget.deposit()
+	}
+
+	// 20% of 10 successful requests
+	for i := 0; i < 2; i++ {
+		if !budget.withdraw() {
+			t.Fatalf("Expected retry %d to be allowed", i)
+		}
+	}
+	if budget.withdraw() {
+		t.Error("Expected retry to be rejected once 20% is spent")
+	}
+
+	// Deposits expire after the window too
+	now = now.Add(retryBudgetWindow)
+	if budget.withdraw() {
+		t.Error("Expected retry to be rejected after deposits expired")
+	}
+}
+
+func TestCustomTransportRetryBudgetExhausted(t *testing.T) {
+	var callCount atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount.Add(1)
+		// Simulate connection error by closing connection
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			t.Fatal("webserver doesn't support hijacking")
+		}
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}))
+	defer server.Close()
+
+	transport := newTestTransport(t, &Config{ToPort: serverPort(t, server), MaxConns: 1, RetryBudgetMinPerSec: 0.1})
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+
+	// The budget allows a single retry, so the request should fail fast
+	// instead of retrying for the whole backoff period
+	start := time.Now()
+	_, err = transport.RoundTrip(req)
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("Expected error once the retry budget is exhausted")
+	}
+
+	if got := callCount.Load(); got != 2 {
+		t.Errorf("Expected 2 calls (1 attempt + 1 retry), got %d", got)
+	}
+
+	if elapsed > 5*time.Second {
+		t.Errorf("Expected request to fail fast, took %v", elapsed)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// errClientLimitExceeded is returned when a client already has as many
+// requests in flight as it may. The error handler maps it to 429 Too Many
+// Requests.
+var errClientLimitExceeded = errors.New("client concurrency limit exceeded")
+
+// clientLimitRejections counts the requests rejected for the client limit
+var clientLimitRejections = expvar.NewInt("client_limit_rejections")
+
+// clientKey returns the key the client of req is limited by: its
+// authenticated identity, or its IP address when it is not authenticated.
+// The prefixes keep an identity from sharing the count of an address.
+func clientKey(req *http.Request) string {
+	if name := identityFromContext(req.Context()); name != "" {
+		return "identity:" + name
+	}
+	if addr := clientAddr(req); addr.IsValid() {
+		return "ip:" + addr.String()
+	}
+	return "ip:" + req.RemoteAddr
+}
+
+// clientLimiter limits the requests each client has in flight, so that a
+// single client cannot take every slot of the concurrency limit. Unlike that
+// limit, a request over the client limit is rejected rather than queued.
+// Counts are dropped once a client has nothing in flight, so that the number
+// of clients seen does not grow memory.
+//
+// A nil *clientLimiter applies no limit.
+type clientLimiter struct {
+	mu      sync.Mutex
+	limit   int64
+	clients map[string]int64
+}
+
+// newClientLimiter creates a clientLimiter. It returns nil, meaning no
+// limit, when limit is zero.
+func newClientLimiter(limit int64) *clientLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &clientLimiter{limit: limit, clients: map[string]int64{}}
+}
+
+// acquire takes a slot for client. It fails with errClientLimitExceeded
+// rather than waiting when the client is at its limit. The returned function
+// releases the slot.
+func (l *clientLimiter) acquire(client string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients[client] >= l.limit {
+		return nil, errClientLimitExceeded
+	}
+	l.clients[client]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.clients[client]--
+			if l.clients[client] == 0 {
+				delete(l.clients, client)
+			}
+		})
+	}, nil
+}
+
+// size returns the number of clients currently tracked
+func (l *clientLimiter) size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.clients)
+}
+
+// clientLimitHandler passes requests to next while their client is within
+// its limit. It runs after authentication, so that authenticated clients are
+// limited by identity.
+type clientLimitHandler struct {
+	next   http.Handler
+	limits *clientLimiter
+}
+
+func (h *clientLimitHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	client := clientKey(req)
+	release, err := h.limits.acquire(client)
+	if err != nil {
+		clientLimitRejections.Add(1)
+		log.Printf("rejected: %s %s from %s: %v (request_id:%s)", req.Method, req.URL, client, err, requestIDFromContext(req.Context()))
+		if isGRPC(req) {
+			writeGRPCError(w, err)
+			return
+		}
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+	defer release()
+	h.next.ServeHTTP(w, req)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestClientLimiter(t *testing.T) {
+	limiter := newClientLimiter(2)
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, err := limiter.acquire("ip:192.0.2.1")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		releases = append(releases, release)
+	}
+	if _, err := limiter.acquire("ip:192.0.2.1"); !errors.Is(err, errClientLimitExceeded) {
+		t.Errorf("Expected error %v for a client at its limit, got %v", errClientLimitExceeded, err)
+	}
+
+	// Other clients have their own limit
+	release, err := limiter.acquire("identity:batch")
+	if err != nil {
+		t.Fatalf("Unexpected error for another client: %v", err)
+	}
+	release()
+	if limiter.size() != 1 {
+		t.Errorf("Expected 1 client, got %d", limiter.size())
+	}
+
+	releases[0]()
+	releases[0]()
+	if _, err := limiter.acquire("ip:192.0.2.1"); err != nil {
+		t.Errorf("Expected a slot after release, got %v", err)
+	}
+
+	// A nil limiter applies no limit
+	if l := newClientLimiter(0); l != nil {
+		t.Error("Expected nil limiter for limit 0")
+	}
+	var none *clientLimiter
+	release, err = none.acquire("ip:192.0.2.1")
+	if err != nil {
+		t.Errorf("Unexpected error from a nil limiter: %v", err)
+	}
+	release()
+}
+
+func TestClientLimitHandler(t *testing.T) {
+	config := &Config{
+		AuthAPIKeysFile:  writeCredentials(t, "api-keys", "batch:batch-key\nreports:reports-key\n"),
+		AuthAPIKeyHeader: "X-Api-Key",
+	}
+	auth, err := newAuthenticator(config)
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hold" {
+			started <- struct{}{}
+			<-release
+		}
+	})
+	limited := &clientLimitHandler{next: next, limits: newClientLimiter(1)}
+	authenticated := &authHandler{next: limited, auth: auth}
+
+	serve := func(handler http.Handler, path, remoteAddr, key string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		if key != "" {
+			req.Header.Set("X-Api-Key", key)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code
+	}
+	// hold keeps a request of the client in flight until the test ends
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(release)
+	hold := func(handler http.Handler, remoteAddr, key string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(handler, "/hold", remoteAddr, key)
+		}()
+		<-started
+	}
+
+	// Authenticated clients are limited by identity, whatever their address
+	hold(authenticated, "192.0.2.1:1000", "batch-key")
+	if got := serve(authenticated, "/", "192.0.2.2:1000", "batch-key"); got != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429 for an identity at its limit, got %d", got)
+	}
+	if got := serve(authenticated, "/", "192.0.2.1:1001", "reports-key"); got != http.StatusOK {
+		t.Errorf("Expected status 200 for another identity from the same address, got %d", got)
+	}
+
+	// Other clients are limited by IP address
+	hold(limited, "198.51.100.1:1000", "")
+	if got := serve(limited, "/", "198.51.100.1:1001", ""); got != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429 for an address at its limit, got %d", got)
+	}
+	if got := serve(limited, "/", "198.51.100.2:1000", ""); got != http.StatusOK {
+		t.Errorf("Expected status 200 for another address, got %d", got)
+	}
+
+	// gRPC calls get a gRPC status
+	req := httptest.NewRequest("POST", "/pkg.Service/Get", nil)
+	req.RemoteAddr = "198.51.100.1:1002"
+	req.Header.Set("Content-Type", "application/grpc")
+	res := httptest.NewRecorder()
+	limited.ServeHTTP(res, req)
+	if got := res.Header().Get("Grpc-Status"); got != "8" {
+		t.Errorf("Expected grpc-status 8 (RESOURCE_EXHAUSTED), got %q", got)
+	}
+}
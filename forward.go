@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// modeForward makes flproxy an HTTP forward proxy, for use as HTTP_PROXY
+const modeForward = "forward"
+
+// errDestinationNotAllowed is returned for destinations not on the allow list
+var errDestinationNotAllowed = errors.New("destination not allowed")
+
+// NewForwardConfig creates a configuration for the forward proxy mode. There
+// are no upstreams; limit applies to each destination host:port.
+func NewForwardConfig(from Endpoint, limit int64) (*Config, error) {
+	if err := from.validate(); err != nil {
+		return nil, fmt.Errorf("invalid fromPort: %w", err)
+	}
+	return &Config{
+		FromPort:     uint(from.Port),
+		MaxConns:     limit,
+		Mode:         modeForward,
+		ListenHost:   from.Host,
+		ListenSocket: from.Socket,
+	}, nil
+}
+
+// parseForwardAllow parses a comma separated allow list of destinations in
+// format "host[:port]". The host may be "*" for any host or start with "*."
+// for any subdomain, and the port may be "*" or omitted for any port.
+func parseForwardAllow(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var patterns []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		host, port := splitDestPattern(item)
+		wildcard := strings.TrimPrefix(host, "*.")
+		if host == "" || host != "*" && (wildcard == "" || strings.Contains(wildcard, "*")) {
+			return nil, fmt.Errorf("invalid destination %q, expected host[:port] with an optional leading *.", item)
+		}
+		if port != "" && port != "*" {
+			if n, err := strconv.Atoi(port); err != nil || validatePort(n) != nil {
+				return nil, fmt.Errorf("invalid port in destination %q", item)
+			}
+		}
+		patterns = append(patterns, item)
+	}
+	return patterns, nil
+}
+
+// splitDestPattern splits an allow list entry into its host and port. The
+// port is empty when omitted.
+func splitDestPattern(pattern string) (string, string) {
+	if strings.HasPrefix(pattern, "[") || strings.Count(pattern, ":") == 1 {
+		if host, port, err := net.SplitHostPort(pattern); err == nil {
+			return host, port
+		}
+	}
+	// A bare host, or an IPv6 address without brackets
+	return strings.Trim(pattern, "[]"), ""
+}
+
+// matchDestination reports whether the destination host and port match an
+// allow list entry
+func matchDestination(pattern, host, port string) bool {
+	phost, pport := splitDestPattern(pattern)
+	if pport != "" && pport != "*" && pport != port {
+		return false
+	}
+	switch {
+	case phost == "*":
+		return true
+	case strings.HasPrefix(phost, "*."):
+		return strings.HasSuffix(host, phost[1:])
+	}
+	return phost == host
+}
+
+// forwardProxy is an HTTP forward proxy. It forwards absolute-form requests
+// and tunnels CONNECT requests to destinations on the allow list, limiting
+// concurrent requests and tunnels per destination host:port.
+type forwardProxy struct {
+	allow          []string
+	limits         *destLimiter
+	requestTimeout time.Duration
+	dialer         *net.Dialer
+	proxy          *httputil.ReverseProxy
+}
+
+func newForwardProxy(config *Config) *forwardProxy {
+	p := &forwardProxy{
+		allow:          config.ForwardAllow,
+		limits:         newDestLimiter(config.MaxConns),
+		requestTimeout: config.RequestTimeout,
+		dialer:         &net.Dialer{Timeout: config.DialTimeout, KeepAlive: 30 * time.Second},
+	}
+	transport := newBaseTransport(config)
+	// Never chain to the proxy in the environment, which may well be us
+	transport.Proxy = nil
+	p.proxy = &httputil.ReverseProxy{
+		// The request URL is already absolute and is forwarded as is
+		Rewrite:   func(*httputil.ProxyRequest) {},
+		Transport: &forwardTransport{base: transport, limits: p.limits, requestTimeout: config.RequestTimeout, maxBodyBytes: config.MaxBodyBytes},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("fail request: %s %s: %v (request_id:%s)", r.Method, r.URL, err, requestIDFromContext(r.Context()))
+			w.WriteHeader(errorStatus(err))
+		},
+	}
+	return p
+}
+
+func (p *forwardProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var dest string
+	switch {
+	case req.Method == http.MethodConnect:
+		dest = req.Host
+	case req.URL.IsAbs() && req.URL.Scheme == "http":
+		dest = req.URL.Host
+		if req.URL.Port() == "" {
+			dest = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+	default:
+		http.Error(w, "only absolute-form http requests and CONNECT are proxied", http.StatusBadRequest)
+		return
+	}
+
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid destination %q", dest), http.StatusBadRequest)
+		return
+	}
+	dest = net.JoinHostPort(strings.ToLower(host), port)
+	if !p.allowed(strings.ToLower(host), port) {
+		log.Printf("deny request: %s %s: %v (request_id:%s)", req.Method, dest, errDestinationNotAllowed, requestIDFromContext(req.Context()))
+		http.Error(w, errDestinationNotAllowed.Error(), http.StatusForbidden)
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		p.connect(w, req, dest)
+		return
+	}
+	p.proxy.ServeHTTP(w, req.WithContext(withDestination(req.Context(), dest)))
+}
+
+func (p *forwardProxy) allowed(host, port string) bool {
+	for _, pattern := range p.allow {
+		if matchDestination(pattern, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// connect tunnels the client connection to dest. The destination slot is held
+// until the tunnel is closed. Errors are logged, and the client only gets the
+// status text so that dial errors don't reveal the proxy's network.
+func (p *forwardProxy) connect(w http.ResponseWriter, req *http.Request, dest string) {
+	if req.ProtoMajor != 1 {
+		http.Error(w, "CONNECT is only supported over HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	ctx, cancel := newRequestContext(req.Context(), p.requestTimeout)
+	release, err := p.limits.acquire(ctx, dest)
+	if err != nil {
+		cancel()
+		log.Printf("fail request: CONNECT %s: %v (request_id:%s)", dest, err, requestIDFromContext(req.Context()))
+		status := errorStatus(err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	defer release()
+	upstream, err := p.dialer.DialContext(ctx, "tcp", dest)
+	cancel()
+	if err != nil {
+		log.Printf("fail request: CONNECT %s: %v (request_id:%s)", dest, err, requestIDFromContext(req.Context()))
+		status := errorStatus(err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	defer upstream.Close()
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Printf("fail request: CONNECT %s: %v (request_id:%s)", dest, err, requestIDFromContext(req.Context()))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	inflightFromContext(req.Context()).setState(stateResponding)
+	brw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		return
+	}
+	// The client may have sent data right after the request
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered, _ := brw.Reader.Peek(n)
+		if _, err := upstream.Write(buffered); err != nil {
+			return
+		}
+	}
+	pipe(conn, upstream)
+}
+
+// forwardTransport holds a destination slot from sending a request until its
+// response body is closed
+type forwardTransport struct {
+	base           http.RoundTripper
+	limits         *destLimiter
+	requestTimeout time.Duration
+	maxBodyBytes   int64
+}
+
+func (t *forwardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := limitBody(req, t.maxBodyBytes); err != nil {
+		return nil, err
+	}
+	dest := destinationFromContext(req.Context())
+	ctx, cancel := newRequestContext(req.Context(), t.requestTimeout)
+	release, err := t.limits.acquire(ctx, dest)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		release()
+		cancel()
+		return nil, err
+	}
+	onBodyClose(res, func() {
+		release()
+		cancel()
+	})
+	return res, nil
+}
+
+type destinationKey struct{}
+
+func withDestination(ctx context.Context, dest string) context.Context {
+	return context.WithValue(ctx, destinationKey{}, dest)
+}
+
+func destinationFromContext(ctx context.Context) string {
+	dest, _ := ctx.Value(destinationKey{}).(string)
+	return dest
+}
+
+// destLimiter limits concurrency per destination. Semaphores are created on
+// first use and dropped once nobody holds or waits for them, so that the
+// number of destinations seen does not grow memory.
+type destLimiter struct {
+	mu    sync.Mutex
+	limit int64
+	dests map[string]*destSemaphore
+}
+
+type destSemaphore struct {
+	sem  *semaphore.Weighted
+	refs int
+}
+
+func newDestLimiter(limit int64) *destLimiter {
+	return &destLimiter{limit: limit, dests: map[string]*destSemaphore{}}
+}
+
+// acquire waits for a slot of dest until ctx is done. The returned function
+// releases the slot.
+func (l *destLimiter) acquire(ctx context.Context, dest string) (func(), error) {
+	l.mu.Lock()
+	d, ok := l.dests[dest]
+	if !ok {
+		d = &destSemaphore{sem: semaphore.NewWeighted(l.limit)}
+		l.dests[dest] = d
+	}
+	d.refs++
+	l.mu.Unlock()
+
+	if err := d.sem.Acquire(ctx, 1); err != nil {
+		l.unref(dest, d)
+		if cause := timeoutCause(ctx, err); cause != err {
+			return nil, cause
+		}
+		return nil, fmt.Errorf("failed to acquire semaphore for %s: %w", dest, err)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			d.sem.Release(1)
+			l.unref(dest, d)
+		})
+	}, nil
+}
+
+func (l *destLimiter) unref(dest string, d *destSemaphore) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d.refs--
+	if d.refs == 0 {
+		delete(l.dests, dest)
+	}
+}
+
+// size returns the number of destinations currently tracked
+func (l *destLimiter) size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.dests)
+}
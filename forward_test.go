@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+// startForwardProxy serves a forwardProxy for config and returns a client using it
+func startForwardProxy(t *testing.T, config *Config) (*httptest.Server, *http.Client) {
+	t.Helper()
+	proxy := httptest.NewServer(newForwardProxy(config))
+	t.Cleanup(proxy.Close)
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	return proxy, client
+}
+
+func TestParseForwardAllow(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{input: "", want: nil},
+		{input: "api.example.com:443", want: []string{"api.example.com:443"}},
+		{input: "API.example.com, *.internal:*", want: []string{"api.example.com", "*.internal:*"}},
+		{input: "*,[::1]:8080,10.0.0.1", want: []string{"*", "[::1]:8080", "10.0.0.1"}},
+		{input: "api.*.com", wantErr: true},
+		{input: "*.", wantErr: true},
+		{input: ":443", wantErr: true},
+		{input: "example.com:http", wantErr: true},
+		{input: "example.com:70000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseForwardAllow(tt.input)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Expected error for %q, got %v", tt.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", tt.input, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Expected %v for %q, got %v", tt.want, tt.input, got)
+		}
+	}
+}
+
+func TestMatchDestination(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		port    string
+		want    bool
+	}{
+		{pattern: "*", host: "example.com", port: "443", want: true},
+		{pattern: "example.com", host: "example.com", port: "80", want: true},
+		{pattern: "example.com:443", host: "example.com", port: "443", want: true},
+		{pattern: "example.com:443", host: "example.com", port: "80", want: false},
+		{pattern: "example.com", host: "api.example.com", port: "443", want: false},
+		{pattern: "*.example.com", host: "api.example.com", port: "443", want: true},
+		{pattern: "*.example.com", host: "example.com", port: "443", want: false},
+		{pattern: "*.example.com", host: "badexample.com", port: "443", want: false},
+		{pattern: "*:8080", host: "10.0.0.1", port: "8080", want: true},
+		{pattern: "[::1]:8080", host: "::1", port: "8080", want: true},
+		{pattern: "::1", host: "::1", port: "9090", want: true},
+	}
+
+	for _, tt := range tests {
+		if got := matchDestination(tt.pattern, tt.host, tt.port); got != tt.want {
+			t.Errorf("Expected %t for %s against %s:%s, got %t", tt.want, tt.pattern, tt.host, tt.port, got)
+		}
+	}
+}
+
+func TestForwardProxyHTTP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" {
+			t.Errorf("Expected Proxy-Connection to be removed, got %q", r.Header.Get("Proxy-Connection"))
+		}
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer backend.Close()
+	denied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected denied destination not to be reached")
+	}))
+	defer denied.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	proxy, client := startForwardProxy(t, &Config{MaxConns: 1, ForwardAllow: []string{backendURL.Host}})
+
+	req, _ := http.NewRequest(http.MethodGet, backend.URL+"/path", nil)
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "hello /path" {
+		t.Errorf("Expected 200 hello /path, got %d %q", res.StatusCode, body)
+	}
+
+	res, err = client.Get(denied.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a denied destination, got %d", res.StatusCode)
+	}
+
+	// Requests not meant for a proxy are rejected
+	res, err = http.Get(proxy.URL + "/path")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an origin-form request, got %d", res.StatusCode)
+	}
+}
+
+func TestForwardProxyConnect(t *testing.T) {
+	port := newTCPEchoServer(t)
+	dest := fmt.Sprintf("127.0.0.1:%d", port)
+	proxy, _ := startForwardProxy(t, &Config{MaxConns: 1, ForwardAllow: []string{"127.0.0.1"}})
+
+	connect := func(dest string) (net.Conn, *bufio.Reader, *http.Response) {
+		t.Helper()
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		// Data right after the request must reach the destination too
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nping", dest, dest)
+		br := bufio.NewReader(conn)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		return conn, br, res
+	}
+
+	conn, br, res := connect(dest)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", res.StatusCode)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(br)
+	if err != nil || string(got) != "pingbye" {
+		t.Errorf("Expected pingbye through the tunnel, got %q (%v)", got, err)
+	}
+
+	_, _, res = connect("localhost:22")
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a denied destination, got %d", res.StatusCode)
+	}
+
+	// Dial errors are reported without their details
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+	_, _, res = connect(closed)
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusBadGateway || string(body) != "Bad Gateway\n" {
+		t.Errorf("Expected status 502 with body %q, got %d %q", "Bad Gateway\n", res.StatusCode, body)
+	}
+}
+
+func TestForwardProxyLimitPerDestination(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+
+	_, client := startForwardProxy(t, &Config{MaxConns: 1, RequestTimeout: 200 * time.Millisecond, ForwardAllow: []string{"*"}})
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, slow.URL, nil)
+		if res, err := client.Do(req); err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-started
+
+	// The slow destination is at its limit, so the next request times out waiting
+	res, err := client.Get(slow.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Expected status 504 at the destination limit, got %d", res.StatusCode)
+	}
+
+	// Other destinations have their own limit
+	res, err = client.Get(fast.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 for another destination, got %d", res.StatusCode)
+	}
+}
+
+func TestDestLimiterDropsUnusedDestinations(t *testing.T) {
+	limiter := newDestLimiter(1)
+	release, err := limiter.acquire(context.Background(), "example.com:443")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if limiter.size() != 1 {
+		t.Errorf("Expected 1 destination, got %d", limiter.size())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.acquire(ctx, "example.com:443"); err == nil {
+		t.Error("Expected error for a destination at its limit")
+	}
+
+	release()
+	release()
+	if limiter.size() != 0 {
+		t.Errorf("Expected no destinations after release, got %d", limiter.size())
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// gRPC status codes used by the proxy
+const (
+	grpcCanceled          = 1
+	grpcDeadlineExceeded  = 4
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// grpcCodes maps gRPC status code names to codes
+var grpcCodes = map[string]int{
+	"OK":                  0,
+	"CANCELLED":           grpcCanceled,
+	"UNKNOWN":             2,
+	"INVALID_ARGUMENT":    3,
+	"DEADLINE_EXCEEDED":   grpcDeadlineExceeded,
+	"NOT_FOUND":           5,
+	"ALREADY_EXISTS":      6,
+	"PERMISSION_DENIED":   grpcPermissionDenied,
+	"RESOURCE_EXHAUSTED":  grpcResourceExhausted,
+	"FAILED_PRECONDITION": 9,
+	"ABORTED":             10,
+	"OUT_OF_RANGE":        11,
+	"UNIMPLEMENTED":       12,
+	"INTERNAL":            13,
+	"UNAVAILABLE":         grpcUnavailable,
+	"DATA_LOSS":           15,
+	"UNAUTHENTICATED":     grpcUnauthenticated,
+}
+
+// grpcRetryBufferSize is how much of a gRPC request body is kept to send it
+// again on a retry. Larger requests are not retried once sent.
+const grpcRetryBufferSize = 64 << 10
+
+// errMethodLimitExceeded is returned when a gRPC method has reached its
+// concurrency limit. It is reported as RESOURCE_EXHAUSTED.
+var errMethodLimitExceeded = errors.New("method concurrency limit exceeded")
+
+// errBodyNotReplayable is returned when a request body is too large to be sent again.
+var errBodyNotReplayable = errors.New("request body is too large to retry")
+
+// grpcStatusError is a retryable gRPC status returned by the upstream. When
+// retries are exhausted, it is passed on to the client as is.
+type grpcStatusError struct {
+	code    int
+	message string
+}
+
+func (e *grpcStatusError) Error() string {
+	return fmt.Sprintf("upstream returned grpc-status %d: %s", e.code, e.message)
+}
+
+// isGRPC reports whether req is a gRPC call
+func isGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// parseGRPCMethodLimits parses a comma separated list of limits in format
+// "/pkg.Service/Method=N"
+func parseGRPCMethodLimits(s string) (map[string]int64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	limits := map[string]int64{}
+	for _, item := range strings.Split(s, ",") {
+		method, limitStr, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || !strings.HasPrefix(method, "/") || strings.Count(method, "/") != 2 {
+			return nil, fmt.Errorf("invalid method limit %q, expected /pkg.Service/Method=N", item)
+		}
+		limit, err := strconv.ParseInt(limitStr, 10, 64)
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("invalid limit for %s: %q", method, limitStr)
+		}
+		limits[method] = limit
+	}
+	return limits, nil
+}
+
+// parseGRPCCodes parses a comma separated list of gRPC status code names, such
+// as "UNAVAILABLE", or numbers
+func parseGRPCCodes(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var codes []int
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		code, ok := grpcCodes[name]
+		if !ok {
+			n, err := strconv.Atoi(name)
+			if err != nil || n < 0 || n > 16 {
+				return nil, fmt.Errorf("unknown gRPC status code %q", name)
+			}
+			code = n
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// grpcPolicy limits concurrent calls per gRPC method and retries calls the
+// upstream answered with a retryable status.
+//
+// A nil *grpcPolicy applies no limits and retries no status.
+type grpcPolicy struct {
+	limits     map[string]*semaphore.Weighted
+	retryCodes map[int]bool
+}
+
+// newGRPCPolicy creates a grpcPolicy. It returns nil when there are neither
+// method limits nor retryable codes.
+func newGRPCPolicy(config *Config) *grpcPolicy {
+	if len(config.GRPCMethodLimits) == 0 && len(config.GRPCRetryCodes) == 0 {
+		return nil
+	}
+	p := &grpcPolicy{
+		limits:     map[string]*semaphore.Weighted{},
+		retryCodes: map[int]bool{},
+	}
+	for method, limit := range config.GRPCMethodLimits {
+		p.limits[method] = semaphore.NewWeighted(limit)
+	}
+	for _, code := range config.GRPCRetryCodes {
+		p.retryCodes[code] = true
+	}
+	return p
+}
+
+// acquire takes a slot of the method limit of req. It fails immediately
+// rather than queueing when the method is at its limit. The returned function
+// releases the slot.
+func (p *grpcPolicy) acquire(req *http.Request) (func(), error) {
+	if p == nil || !isGRPC(req) {
+		return func() {}, nil
+	}
+	sem, ok := p.limits[req.URL.Path]
+	if !ok {
+		return func() {}, nil
+	}
+	if !sem.TryAcquire(1) {
+		return nil, fmt.Errorf("%w: %s", errMethodLimitExceeded, req.URL.Path)
+	}
+	return func() { sem.Release(1) }, nil
+}
+
+// replayableBody returns a body for req that can be sent again on retries,
+// or nil when gRPC statuses are not retried.
+func (p *grpcPolicy) replayableBody(req *http.Request) *replayBody {
+	if p == nil || len(p.retryCodes) == 0 || !isGRPC(req) || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	return &replayBody{src: req.Body, limit: grpcRetryBufferSize}
+}
+
+// checkStatus returns a grpcStatusError when res is a trailers-only response
+// with a retryable status, closing res. gRPC servers report an error before
+// any message this way; statuses in trailers after a message are not retried.
+func (p *grpcPolicy) checkStatus(req *http.Request, res *http.Response) error {
+	if p == nil || !isGRPC(req) {
+		return nil
+	}
+	code, err := strconv.Atoi(res.Header.Get("Grpc-Status"))
+	if err != nil || !p.retryCodes[code] {
+		return nil
+	}
+	res.Body.Close()
+	message, err := url.PathUnescape(res.Header.Get("Grpc-Message"))
+	if err != nil {
+		message = res.Header.Get("Grpc-Message")
+	}
+	return &grpcStatusError{code: code, message: message}
+}
+
+// grpcStatus returns the gRPC status reported to the client for err
+func grpcStatus(err error) (int, string) {
+	var statusErr *grpcStatusError
+	switch {
+	case errors.As(err, &statusErr):
+		return statusErr.code, statusErr.message
+	case errors.Is(err, errMethodLimitExceeded), errors.Is(err, errClientLimitExceeded), errors.Is(err, errBodyTooLarge):
+		return grpcResourceExhausted, err.Error()
+	case errors.Is(err, errIPDenied):
+		return grpcPermissionDenied, err.Error()
+	case errors.Is(err, errUnauthenticated):
+		return grpcUnauthenticated, err.Error()
+	case isTimeout(err):
+		return grpcDeadlineExceeded, err.Error()
+	case errors.Is(err, context.Canceled):
+		return grpcCanceled, err.Error()
+	}
+	return grpcUnavailable, err.Error()
+}
+
+// writeGRPCError writes err as a trailers-only gRPC response
+func writeGRPCError(w http.ResponseWriter, err error) {
+	code, message := grpcStatus(err)
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(code))
+	h.Set("Grpc-Message", encodeGRPCMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// encodeGRPCMessage percent-encodes a grpc-message value
+func encodeGRPCMessage(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// replayBody records a request body as it is sent, so that each attempt can
+// read it from the start. Up to limit bytes are kept; beyond that the body can
+// only be read once.
+type replayBody struct {
+	mu     sync.Mutex
+	src    io.ReadCloser
+	srcMu  sync.Mutex // Serializes reads of src, which may block on the client
+	buf    []byte     // Everything read from src, as long as it fits in limit
+	read   int        // bytes read from src
+	limit  int
+	srcErr error
+}
+
+// canReplay reports whether the body can still be sent from the start
+func (b *replayBody) canReplay() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.read <= b.limit
+}
+
+// newReader returns a reader of the body from the start
+func (b *replayBody) newReader() io.ReadCloser {
+	return &replayReader{body: b}
+}
+
+func (b *replayBody) readAt(p []byte, pos int) (int, error) {
+	if n, ok, err := b.readBuffered(p, pos); ok {
+		return n, err
+	}
+
+	// mu is not held while reading src, so that canReplay and the other
+	// attempts are not blocked while the client is slow to send the body
+	b.srcMu.Lock()
+	defer b.srcMu.Unlock()
+	// Another attempt may have read from src while this one waited
+	if n, ok, err := b.readBuffered(p, pos); ok {
+		return n, err
+	}
+	n, err := b.src.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.read += n
+	// Once a read goes over the limit the buffer stops growing for good, so
+	// that it never skips part of the body
+	if b.read <= b.limit {
+		b.buf = append(b.buf, p[:n]...)
+	}
+	b.srcErr = err
+	return n, err
+}
+
+// readBuffered reads the body at pos from what was already read from src.
+// ok is false when pos is at the end of it and src must be read.
+func (b *replayBody) readBuffered(p []byte, pos int) (n int, ok bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if pos < len(b.buf) {
+		return copy(p, b.buf[pos:]), true, nil
+	}
+	if pos < b.read {
+		// Another attempt read past the buffer
+		return 0, true, errBodyNotReplayable
+	}
+	if b.srcErr != nil {
+		return 0, true, b.srcErr
+	}
+	return 0, false, nil
+}
+
+// replayReader is the body of a single attempt. Closing it leaves the
+// original body open for later attempts.
+type replayReader struct {
+	body   *replayBody
+	pos    int
+	closed atomic.Bool
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	if r.closed.Load() {
+		return 0, http.ErrBodyReadAfterClose
+	}
+	n, err := r.body.readAt(p, r.pos)
+	r.pos += n
+	return n, err
+}
+
+func (r *replayReader) Close() error {
+	r.closed.Store(true)
+	return nil
+}
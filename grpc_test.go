@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newGRPCServer serves handler over cleartext HTTP/2 like a gRPC server
+func newGRPCServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// writeGRPCStatus answers a gRPC call with a trailers-only response
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", fmt.Sprint(code))
+	w.Header().Set("Grpc-Message", message)
+	w.WriteHeader(http.StatusOK)
+}
+
+func newGRPCRequest(t *testing.T, url, body string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	return req
+}
+
+func TestParseGRPCMethodLimits(t *testing.T) {
+	limits, err := parseGRPCMethodLimits("/pkg.Service/Get=5, /pkg.Service/List=1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if limits["/pkg.Service/Get"] != 5 || limits["/pkg.Service/List"] != 1 {
+		t.Errorf("Expected limits 5 and 1, got %v", limits)
+	}
+
+	for _, s := range []string{"/pkg.Service/Get", "pkg.Service/Get=1", "/pkg.Service=1", "/pkg.Service/Get=0"} {
+		if _, err := parseGRPCMethodLimits(s); err == nil {
+			t.Errorf("Expected error for %q", s)
+		}
+	}
+}
+
+func TestParseGRPCCodes(t *testing.T) {
+	codes, err := parseGRPCCodes("UNAVAILABLE, resource_exhausted,10")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := []int{14, 8, 10}; len(codes) != 3 || codes[0] != want[0] || codes[1] != want[1] || codes[2] != want[2] {
+		t.Errorf("Expected %v, got %v", want, codes)
+	}
+
+	for _, s := range []string{"UNAVAILABLE,BROKEN", "17"} {
+		if _, err := parseGRPCCodes(s); err == nil {
+			t.Errorf("Expected error for %q", s)
+		}
+	}
+}
+
+func TestGRPCStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "method limit", err: fmt.Errorf("%w: /pkg.Service/Get", errMethodLimitExceeded), want: grpcResourceExhausted},
+		{name: "IP denied", err: errIPDenied, want: grpcPermissionDenied},
+		{name: "unauthenticated", err: fmt.Errorf("%w: invalid API key", errUnauthenticated), want: grpcUnauthenticated},
+		{name: "timeout", err: errRequestTimeout, want: grpcDeadlineExceeded},
+		{name: "canceled", err: context.Canceled, want: grpcCanceled},
+		{name: "no healthy upstream", err: errNoHealthyUpstream, want: grpcUnavailable},
+		{name: "connection error", err: errors.New("connection refused"), want: grpcUnavailable},
+		{name: "upstream status", err: &grpcStatusError{code: 10, message: "aborted"}, want: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := grpcStatus(tt.err); got != tt.want {
+				t.Errorf("Expected code %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestEncodeGRPCMessage(t *testing.T) {
+	if got := encodeGRPCMessage("100% down\n"); got != "100%25 down%0A" {
+		t.Errorf("Expected %q, got %q", "100%25 down%0A", got)
+	}
+}
+
+func TestReplayBody(t *testing.T) {
+	body := &replayBody{src: io.NopCloser(strings.NewReader("hello")), limit: 8}
+
+	for i := 0; i < 2; i++ {
+		r := body.newReader()
+		got, err := io.ReadAll(r)
+		if err != nil || string(got) != "hello" {
+			t.Errorf("Expected %q on read %d, got %q (%v)", "hello", i, got, err)
+		}
+		r.Close()
+	}
+
+	// A partly sent body is completed from the original on the next attempt
+	body = &replayBody{src: io.NopCloser(strings.NewReader("hello")), limit: 8}
+	r := body.newReader()
+	r.Read(make([]byte, 2))
+	r.Close()
+	if got, _ := io.ReadAll(body.newReader()); string(got) != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", got)
+	}
+
+	// Bodies over the limit are not replayed
+	body = &replayBody{src: io.NopCloser(bytes.NewReader(make([]byte, 16))), limit: 8}
+	io.ReadAll(body.newReader())
+	if body.canReplay() {
+		t.Error("Expected a body over the limit not to be replayable")
+	}
+	if _, err := io.ReadAll(body.newReader()); !errors.Is(err, errBodyNotReplayable) {
+		t.Errorf("Expected error %v, got %v", errBodyNotReplayable, err)
+	}
+}
+
+func TestReplayBodyOverflow(t *testing.T) {
+	// The second read goes over the limit; the third would fit again but
+	// must not be buffered after the gap
+	body := &replayBody{src: io.NopCloser(io.MultiReader(strings.NewReader("hello"), strings.NewReader("world!"), strings.NewReader("ok"))), limit: 8}
+	if got, err := io.ReadAll(body.newReader()); err != nil || string(got) != "helloworld!ok" {
+		t.Fatalf("Expected the whole body on the first read, got %q (%v)", got, err)
+	}
+	if string(body.buf) != "hello" {
+		t.Errorf("Expected only the body before the overflow to be buffered, got %q", body.buf)
+	}
+	got, err := io.ReadAll(body.newReader())
+	if string(got) != "hello" || !errors.Is(err, errBodyNotReplayable) {
+		t.Errorf("Expected %q and error %v, got %q (%v)", "hello", errBodyNotReplayable, got, err)
+	}
+}
+
+func TestReplayBodySlowClient(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	body := &replayBody{src: pr, limit: 8}
+
+	// The first attempt sends the start of the body, then waits for the client
+	first := body.newReader()
+	go pw.Write([]byte("he"))
+	if n, _ := first.Read(make([]byte, 8)); n != 2 {
+		t.Fatalf("Expected 2 bytes, got %d", n)
+	}
+	go first.Read(make([]byte, 8))
+	time.Sleep(50 * time.Millisecond)
+	first.Close()
+
+	// A retry is decided and replays what was sent while the read is blocked
+	replayed := make(chan string, 1)
+	go func() {
+		if !body.canReplay() {
+			replayed <- "not replayable"
+			return
+		}
+		p := make([]byte, 8)
+		n, _ := body.newReader().Read(p)
+		replayed <- string(p[:n])
+	}()
+	select {
+	case got := <-replayed:
+		if got != "he" {
+			t.Errorf("Expected %q to be replayed, got %q", "he", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the retry not to wait for the client to send more of the body")
+	}
+}
+
+func TestGRPCRetryOnStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		wantCalls int32
+		wantCode  string
+	}{
+		{name: "UNAVAILABLE is retried", status: grpcUnavailable, wantCalls: 2, wantCode: "0"},
+		{name: "INVALID_ARGUMENT is not retried", status: 3, wantCalls: 1, wantCode: "3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := newGRPCServer(t, func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if calls.Add(1) == 1 {
+					writeGRPCStatus(w, tt.status, "first call fails")
+					return
+				}
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Header().Set("Trailer", "Grpc-Status")
+				w.Write(body)
+				w.Header().Set("Grpc-Status", "0")
+			})
+
+			transport := newTestTransport(t, &Config{
+				ToPort:         serverPort(t, server),
+				MaxConns:       1,
+				UpstreamHTTP2:  true,
+				GRPCRetryCodes: []int{grpcUnavailable},
+			})
+
+			resp, err := transport.RoundTrip(newGRPCRequest(t, server.URL+"/pkg.Service/Get", "request message"))
+			if err != nil {
+				t.Fatalf("RoundTrip failed: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("Expected %d calls, got %d", tt.wantCalls, got)
+			}
+			code := resp.Header.Get("Grpc-Status") + resp.Trailer.Get("Grpc-Status")
+			if code != tt.wantCode {
+				t.Errorf("Expected grpc-status %s, got %s", tt.wantCode, code)
+			}
+			// The retry sends the whole request body again
+			if tt.wantCode == "0" && string(body) != "request message" {
+				t.Errorf("Expected the request body to be replayed, got %q", body)
+			}
+		})
+	}
+}
+
+func TestGRPCMethodLimit(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := newGRPCServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pkg.Service/Slow" {
+			started <- struct{}{}
+			<-release
+		}
+		writeGRPCStatus(w, 0, "")
+	})
+	addr := serveProxy(t, &Config{
+		ToPort:           serverPort(t, server),
+		MaxConns:         10,
+		H2C:              true,
+		UpstreamHTTP2:    true,
+		GRPCMethodLimits: map[string]int64{"/pkg.Service/Slow": 1},
+	}, func(h http.Handler) http.Handler { return h })
+	client := newH2CClient()
+
+	// The first call holds the only slot of the method
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := client.Do(newGRPCRequest(t, "http://"+addr+"/pkg.Service/Slow", ""))
+		if err != nil {
+			t.Errorf("First call failed: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+	<-started
+
+	resp, err := client.Do(newGRPCRequest(t, "http://"+addr+"/pkg.Service/Slow", ""))
+	if err != nil {
+		t.Fatalf("Second call failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected HTTP status 200 for a gRPC error, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Grpc-Status"); got != fmt.Sprint(grpcResourceExhausted) {
+		t.Errorf("Expected grpc-status %d, got %q", grpcResourceExhausted, got)
+	}
+
+	// Other methods are not limited
+	resp, err = client.Do(newGRPCRequest(t, "http://"+addr+"/pkg.Service/Fast", ""))
+	if err != nil {
+		t.Fatalf("Call to another method failed: %v", err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Expected grpc-status 0 for another method, got %q", got)
+	}
+
+	close(release)
+	<-done
+}
+
+func TestGRPCRetriesExhausted(t *testing.T) {
+	var calls atomic.Int32
+	server := newGRPCServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		writeGRPCStatus(w, grpcUnavailable, "down for maintenance")
+	})
+	// Allow a single retry
+	addr := serveProxy(t, &Config{
+		ToPort:               serverPort(t, server),
+		MaxConns:             1,
+		H2C:                  true,
+		UpstreamHTTP2:        true,
+		GRPCRetryCodes:       []int{grpcUnavailable},
+		RetryBudgetMinPerSec: 0.1,
+	}, func(h http.Handler) http.Handler { return h })
+
+	resp, err := newH2CClient().Do(newGRPCRequest(t, "http://"+addr+"/pkg.Service/Get", "request message"))
+	if err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if got := calls.Load(); got != 2 {
+		t.Errorf("Expected 2 calls, got %d", got)
+	}
+	// The upstream's status is passed on once retries are exhausted
+	if got := resp.Header.Get("Grpc-Status"); got != fmt.Sprint(grpcUnavailable) {
+		t.Errorf("Expected grpc-status %d, got %q", grpcUnavailable, got)
+	}
+	if got := resp.Header.Get("Grpc-Message"); got != "down for maintenance" {
+		t.Errorf("Expected grpc-message %q, got %q", "down for maintenance", got)
+	}
+}
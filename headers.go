@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// requestIDHeader carries the ID of a request
+const requestIDHeader = "X-Request-Id"
+
+// headerTemplate matches the placeholders of header rule values, such as
+// "{client_ip}"
+var headerTemplate = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// headerTemplateVars are the placeholders header rule values may use
+var headerTemplateVars = []string{"client_ip", "request_id", "route", "identity"}
+
+// HeaderRules rewrite the headers of a request or response. They are applied
+// in the order remove, rename, set, add. Values may contain the placeholders
+// {client_ip}, {request_id}, {route} and {identity}, the authenticated client.
+type HeaderRules struct {
+	Set    map[string]string `json:"set"`    // Headers replaced with the value
+	Add    map[string]string `json:"add"`    // Headers the value is appended to
+	Remove []string          `json:"remove"` // Headers removed
+	Rename map[string]string `json:"rename"` // Headers moved to another name, replacing it
+}
+
+// init validates the rules and canonicalizes the header names
+func (h *HeaderRules) init() error {
+	if h == nil {
+		return nil
+	}
+	for i, name := range h.Remove {
+		if err := validateHeaderName(name); err != nil {
+			return err
+		}
+		h.Remove[i] = http.CanonicalHeaderKey(name)
+	}
+	var err error
+	if h.Rename, err = canonicalHeaderMap(h.Rename, validateHeaderName); err != nil {
+		return err
+	}
+	for k, v := range h.Rename {
+		h.Rename[k] = http.CanonicalHeaderKey(v)
+	}
+	if h.Set, err = canonicalHeaderMap(h.Set, validateHeaderTemplate); err != nil {
+		return err
+	}
+	if h.Add, err = canonicalHeaderMap(h.Add, validateHeaderTemplate); err != nil {
+		return err
+	}
+	return nil
+}
+
+// canonicalHeaderMap returns m keyed by canonical header names, validating
+// the names and, with validate, the values
+func canonicalHeaderMap(m map[string]string, validate func(string) error) (map[string]string, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]string, len(m))
+	for name, value := range m {
+		if err := validateHeaderName(name); err != nil {
+			return nil, err
+		}
+		key := http.CanonicalHeaderKey(name)
+		if _, ok := out[key]; ok {
+			return nil, fmt.Errorf("header %s is given more than once", key)
+		}
+		if err := validate(value); err != nil {
+			return nil, err
+		}
+		out[key] = value
+	}
+	return out, nil
+}
+
+// validateHeaderName rejects names that cannot be sent as a header. Host is
+// not a header of http.Request, so rules cannot rewrite it.
+func validateHeaderName(name string) error {
+	if name == "" || strings.ContainsAny(name, ": \t\r\n") {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	if strings.EqualFold(name, "Host") {
+		return fmt.Errorf("the Host header cannot be rewritten")
+	}
+	return nil
+}
+
+// validateHeaderTemplate rejects unknown placeholders in a header value
+func validateHeaderTemplate(value string) error {
+	for _, m := range headerTemplate.FindAllStringSubmatch(value, -1) {
+		if !slices.Contains(headerTemplateVars, m[1]) {
+			return fmt.Errorf("unknown placeholder %s in %q", m[0], value)
+		}
+	}
+	return nil
+}
+
+// apply rewrites header. vars returns the values of the placeholders and is
+// only called when a value uses them.
+func (h *HeaderRules) apply(header http.Header, vars func() map[string]string) {
+	if h == nil {
+		return
+	}
+	for _, name := range h.Remove {
+		header.Del(name)
+	}
+	// Renames are applied together, so that the order of the map does not matter
+	moved := map[string][]string{}
+	for from, to := range h.Rename {
+		if values, ok := header[from]; ok {
+			moved[to] = values
+			delete(header, from)
+		}
+	}
+	for to, values := range moved {
+		header[to] = values
+	}
+
+	var v map[string]string
+	expand := func(s string) string {
+		if !strings.Contains(s, "{") {
+			return s
+		}
+		if v == nil {
+			v = vars()
+		}
+		return headerTemplate.ReplaceAllStringFunc(s, func(m string) string {
+			return v[m[1:len(m)-1]]
+		})
+	}
+	for name, value := range h.Set {
+		header.Set(name, expand(value))
+	}
+	for name, value := range h.Add {
+		header.Add(name, expand(value))
+	}
+}
+
+// headerVars returns the placeholder values of header rules for req
+func headerVars(req *http.Request, route string) func() map[string]string {
+	return func() map[string]string {
+		ip, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			ip = req.RemoteAddr
+		}
+		return map[string]string{
+			"client_ip":  ip,
+			"request_id": requestIDFromContext(req.Context()),
+			"route":      route,
+			"identity":   identityFromContext(req.Context()),
+		}
+	}
+}
+
+// setForwardedHeaders sets X-Forwarded-Host and X-Forwarded-Proto from the
+// request the client sent. X-Forwarded-For is appended by the reverse proxy.
+func setForwardedHeaders(req *http.Request) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Host", req.Host)
+	req.Header.Set("X-Forwarded-Proto", proto)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderRulesInit(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   HeaderRules
+		wantErr bool
+	}{
+		{name: "empty", rules: HeaderRules{}},
+		{name: "valid", rules: HeaderRules{Set: map[string]string{"x-client": "{client_ip} {route}"}, Remove: []string{"x-internal"}, Rename: map[string]string{"x-a": "x-b"}}},
+		{name: "literal braces", rules: HeaderRules{Set: map[string]string{"X-Json": `{"a": 1}`}}},
+		{name: "unknown placeholder", rules: HeaderRules{Add: map[string]string{"X-A": "{user}"}}, wantErr: true},
+		{name: "invalid name", rules: HeaderRules{Set: map[string]string{"X A": "1"}}, wantErr: true},
+		{name: "empty name", rules: HeaderRules{Remove: []string{""}}, wantErr: true},
+		{name: "host", rules: HeaderRules{Set: map[string]string{"host": "example.com"}}, wantErr: true},
+		{name: "invalid rename target", rules: HeaderRules{Rename: map[string]string{"X-A": "X:B"}}, wantErr: true},
+		{name: "duplicate name", rules: HeaderRules{Set: map[string]string{"x-a": "1", "X-A": "2"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rules.init()
+			if tt.wantErr && err == nil {
+				t.Error("Expected error, got nil")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+
+	var nilRules *HeaderRules
+	if err := nilRules.init(); err != nil {
+		t.Errorf("Expected nil rules to be valid, got %v", err)
+	}
+}
+
+func TestHeaderRulesApply(t *testing.T) {
+	vars := func() map[string]string {
+		return map[string]string{"client_ip": "192.0.2.1", "request_id": "abc", "route": "api"}
+	}
+	tests := []struct {
+		name   string
+		rules  string
+		header http.Header
+		want   http.Header
+	}{
+		{
+			name:   "set",
+			rules:  `{"set": {"authorization": "Bearer token"}}`,
+			header: http.Header{"Authorization": {"Basic x"}},
+			want:   http.Header{"Authorization": {"Bearer token"}},
+		},
+		{
+			name:   "add",
+			rules:  `{"add": {"Via": "flproxy"}}`,
+			header: http.Header{"Via": {"1.1 lb"}},
+			want:   http.Header{"Via": {"1.1 lb", "flproxy"}},
+		},
+		{
+			name:   "remove",
+			rules:  `{"remove": ["x-internal", "x-missing"]}`,
+			header: http.Header{"X-Internal": {"1"}, "X-Other": {"2"}},
+			want:   http.Header{"X-Other": {"2"}},
+		},
+		{
+			name:   "rename",
+			rules:  `{"rename": {"x-a": "x-b", "x-b": "x-c"}}`,
+			header: http.Header{"X-A": {"1"}, "X-B": {"2", "3"}},
+			want:   http.Header{"X-B": {"1"}, "X-C": {"2", "3"}},
+		},
+		{
+			name:   "templates",
+			rules:  `{"set": {"X-Client": "{client_ip}", "X-Trace": "{route}/{request_id}"}}`,
+			header: http.Header{},
+			want:   http.Header{"X-Client": {"192.0.2.1"}, "X-Trace": {"api/abc"}},
+		},
+		{
+			name:   "order",
+			rules:  `{"remove": ["X-A"], "rename": {"X-B": "X-A"}, "set": {"X-B": "new"}, "add": {"X-A": "added"}}`,
+			header: http.Header{"X-A": {"old"}, "X-B": {"moved"}},
+			want:   http.Header{"X-A": {"moved", "added"}, "X-B": {"new"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rules HeaderRules
+			if err := json.Unmarshal([]byte(tt.rules), &rules); err != nil {
+				t.Fatalf("Failed to parse rules: %v", err)
+			}
+			if err := rules.init(); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			rules.apply(tt.header, vars)
+			if !reflect.DeepEqual(tt.header, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, tt.header)
+			}
+		})
+	}
+}
+
+func TestReverseProxyHeaders(t *testing.T) {
+	var got http.Header
+	var gotHost string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, gotHost = r.Header.Clone(), r.Host
+		w.Header().Set("X-Internal", "secret")
+		w.Header().Set("X-Backend", "b1")
+	}))
+	defer server.Close()
+
+	config := &Config{
+		ToPort:    serverPort(t, server),
+		MaxConns:  1,
+		RouteName: "api",
+		RequestHeaders: &HeaderRules{
+			Set:    map[string]string{"Authorization": "Bearer upstream", "X-Client": "{client_ip}", "X-Route": "{route}", "X-Trace": "{request_id}"},
+			Remove: []string{"Cookie"},
+		},
+		ResponseHeaders: &HeaderRules{
+			Remove: []string{"X-Internal"},
+			Rename: map[string]string{"X-Backend": "X-Served-By"},
+			Add:    map[string]string{"X-Route": "{route}"},
+		},
+	}
+	proxy, err := newReverseProxy(config)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.TLS = &tls.ConnectionState{}
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-Forwarded-Host", "spoofed.example.com")
+	req = req.WithContext(withRequestID(req.Context(), "abc"))
+	res := httptest.NewRecorder()
+	proxy.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", res.Code)
+	}
+	for name, want := range map[string]string{
+		"Authorization":     "Bearer upstream",
+		"X-Client":          "192.0.2.1",
+		"X-Route":           "api",
+		"X-Trace":           "abc",
+		"Cookie":            "",
+		"X-Forwarded-For":   "192.0.2.1",
+		"X-Forwarded-Host":  "example.com",
+		"X-Forwarded-Proto": "https",
+	} {
+		if got.Get(name) != want {
+			t.Errorf("Expected upstream header %s %q, got %q", name, want, got.Get(name))
+		}
+	}
+	if gotHost != "example.com" {
+		t.Errorf("Expected the client's Host to be kept, got %q", gotHost)
+	}
+	for name, want := range map[string]string{"X-Internal": "", "X-Backend": "", "X-Served-By": "b1", "X-Route": "api"} {
+		if res.Header().Get(name) != want {
+			t.Errorf("Expected response header %s %q, got %q", name, want, res.Header().Get(name))
+		}
+	}
+
+	// Removing X-Forwarded-For keeps it from the upstream
+	config.RequestHeaders = &HeaderRules{Remove: []string{"X-Forwarded-For"}}
+	proxy, err = newReverseProxy(config)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+	if _, ok := got["X-Forwarded-For"]; ok {
+		t.Errorf("Expected no X-Forwarded-For, got %q", got.Get("X-Forwarded-For"))
+	}
+}
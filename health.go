@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultHealthCheckInterval is used when no health check interval is configured.
+const defaultHealthCheckInterval = 10 * time.Second
+
+// errNoHealthyUpstream is returned when every upstream instance is ejected.
+// The error handler maps it to 503 Service Unavailable.
+var errNoHealthyUpstream = errors.New("no healthy upstream")
+
+// upstreamHealth tracks whether an upstream instance is in rotation.
+// The zero value is a healthy instance.
+type upstreamHealth struct {
+	ejected atomic.Bool
+
+	mu          sync.Mutex
+	successes   int       // consecutive successful health checks
+	failures    int       // consecutive failed health checks
+	errors      int       // consecutive failed requests
+	reinstateAt time.Time // when a passively ejected instance returns without health checks
+}
+
+// available reports whether the instance may receive requests
+func (h *upstreamHealth) available() bool {
+	if !h.ejected.Load() {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.reinstateAt.IsZero() && !time.Now().Before(h.reinstateAt) {
+		h.reinstateAt = time.Time{}
+		h.errors = 0
+		h.ejected.Store(false)
+		return true
+	}
+	return false
+}
+
+// healthChecker ejects unhealthy upstream instances from rotation, based on
+// periodic health probes and on errors returned by requests (outlier
+// detection), and reinstates them once they pass consecutive health checks.
+//
+// A nil *healthChecker keeps every instance in rotation.
+type healthChecker struct {
+	path               string
+	interval           time.Duration
+	expectedStatus     int
+	healthyThreshold   int
+	unhealthyThreshold int
+	outlierErrors      int
+	ejectionTime       time.Duration
+
+	timeout time.Duration
+	stop    context.CancelFunc
+}
+
+// newHealthChecker creates a healthChecker. It returns nil when both active
+// health checks and outlier detection are disabled.
+func newHealthChecker(config *Config) *healthChecker {
+	if config.HealthCheckPath == "" && config.OutlierErrors <= 0 {
+		return nil
+	}
+	interval := config.HealthCheckInterval
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	expectedStatus := config.HealthCheckStatus
+	if expectedStatus == 0 {
+		expectedStatus = http.StatusOK
+	}
+	return &healthChecker{
+		path:               config.HealthCheckPath,
+		interval:           interval,
+		expectedStatus:     expectedStatus,
+		healthyThreshold:   max(config.HealthyThreshold, 1),
+		unhealthyThreshold: max(config.UnhealthyThreshold, 1),
+		outlierErrors:      config.OutlierErrors,
+		ejectionTime:       config.OutlierEjectionTime,
+		timeout:            config.HealthCheckTimeout,
+		stop:               func() {},
+	}
+}
+
+// start probes every upstream once per interval until close is called.
+// It does nothing when active health checks are disabled.
+func (c *healthChecker) start(upstreams []*upstream) {
+	if c == nil || c.path == "" {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stop = cancel
+	for _, u := range upstreams {
+		go func() {
+			ticker := time.NewTicker(c.interval)
+			defer ticker.Stop()
+			for {
+				c.check(ctx, u)
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// close stops the health checks
+func (c *healthChecker) close() {
+	if c != nil {
+		c.stop()
+	}
+}
+
+// check probes u once and updates its health
+func (c *healthChecker) check(ctx context.Context, u *upstream) {
+	ok := c.probe(ctx, u)
+	if ctx.Err() != nil {
+		return
+	}
+
+	h := &u.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ok {
+		h.successes++
+		h.failures = 0
+		if h.ejected.Load() && h.successes >= c.healthyThreshold {
+			h.errors = 0
+			h.reinstateAt = time.Time{}
+			h.ejected.Store(false)
+			log.Printf("upstream %s is healthy, reinstated", u.target)
+		}
+		return
+	}
+	h.failures++
+	h.successes = 0
+	if !h.ejected.Load() && h.failures >= c.unhealthyThreshold {
+		h.ejected.Store(true)
+		log.Printf("upstream %s failed %d health checks, ejected", u.target, h.failures)
+	}
+}
+
+// probe sends a health check through the upstream's own transport, so that it
+// uses the same TLS settings as requests. Redirects are not followed.
+func (c *healthChecker) probe(ctx context.Context, u *upstream) bool {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.url(&url.URL{Path: c.path}).String(), nil)
+	if err != nil {
+		return false
+	}
+	res, err := u.transport.RoundTrip(req)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode == c.expectedStatus
+}
+
+// observe records the outcome of a request to u for outlier detection
+func (c *healthChecker) observe(u *upstream, err error) {
+	if c == nil || c.outlierErrors <= 0 {
+		return
+	}
+
+	h := &u.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		h.errors = 0
+		return
+	}
+	h.errors++
+	if !h.ejected.Load() && h.errors >= c.outlierErrors {
+		h.ejected.Store(true)
+		h.successes = 0
+		// Without health checks, nothing would reinstate the instance, so it
+		// returns to rotation after the ejection time.
+		if c.path == "" {
+			h.reinstateAt = time.Now().Add(c.ejectionTime)
+		}
+		log.Printf("upstream %s failed %d requests in a row, ejected", u.target, h.errors)
+	}
+}
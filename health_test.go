@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestNewHealthCheckerDisabled(t *testing.T) {
+	if c := newHealthChecker(&Config{}); c != nil {
+		t.Error("Expected nil health checker without health checks and outlier detection")
+	}
+
+	// A nil checker is safe to use
+	var c *healthChecker
+	c.start(nil)
+	c.observe(&upstream{target: Target{Port: 9090}}, errors.New("connection refused"))
+	c.close()
+}
+
+func TestBalancerSkipsEjectedUpstreams(t *testing.T) {
+	b := newTestBalancer(t, lbRoundRobin, 9090, 9091, 9092)
+	b.upstreams[1].health.ejected.Store(true)
+
+	for i := 0; i < 10; i++ {
+		if got := b.pick(newTestRequest(t, nil), nil); got == b.upstreams[1] {
+			t.Fatalf("Expected ejected upstream %s to be skipped", got.host)
+		}
+	}
+
+	// The failed instance is still used when it is the only one left
+	b.upstreams[0].health.ejected.Store(true)
+	if got := b.pick(newTestRequest(t, nil), b.upstreams[2]); got != b.upstreams[2] {
+		t.Errorf("Expected the last upstream in rotation, got %v", got)
+	}
+
+	b.upstreams[2].health.ejected.Store(true)
+	if b.available() {
+		t.Error("Expected no upstream to be available")
+	}
+	if got := b.pick(newTestRequest(t, nil), nil); got != nil {
+		t.Errorf("Expected nil when every upstream is ejected, got %s", got.host)
+	}
+}
+
+func TestHealthCheckEjectsAndReinstates(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	transport := newTestTransport(t, &Config{
+		ToPort:              serverPort(t, server),
+		MaxConns:            1,
+		HealthCheckPath:     "/healthz",
+		HealthCheckInterval: 20 * time.Millisecond,
+		HealthCheckTimeout:  time.Second,
+		HealthyThreshold:    2,
+		UnhealthyThreshold:  2,
+	})
+	customT := transport.(*customTransport)
+	defer customT.health.close()
+	u := customT.balancer.upstreams[0]
+
+	healthy.Store(false)
+	if !waitFor(t, 2*time.Second, func() bool { return !u.health.available() }) {
+		t.Fatal("Expected unhealthy upstream to be ejected")
+	}
+
+	// With a single target, the proxy fails fast instead of retrying
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	start := time.Now()
+	_, err = transport.RoundTrip(req)
+	if !errors.Is(err, errNoHealthyUpstream) {
+		t.Errorf("Expected error %v, got %v", errNoHealthyUpstream, err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected request to fail fast, took %v", elapsed)
+	}
+
+	healthy.Store(true)
+	if !waitFor(t, 2*time.Second, u.health.available) {
+		t.Fatal("Expected healthy upstream to be reinstated")
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed after reinstatement: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestHealthCheckUnexpectedStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	transport := newTestTransport(t, &Config{
+		ToPort:              serverPort(t, server),
+		MaxConns:            1,
+		HealthCheckPath:     "/healthz",
+		HealthCheckInterval: 20 * time.Millisecond,
+		HealthCheckTimeout:  time.Second,
+		HealthCheckStatus:   http.StatusNoContent,
+		UnhealthyThreshold:  1,
+	})
+	customT := transport.(*customTransport)
+	defer customT.health.close()
+
+	if !waitFor(t, 2*time.Second, func() bool { return !customT.balancer.available() }) {
+		t.Error("Expected upstream answering an unexpected status to be ejected")
+	}
+}
+
+func TestOutlierDetection(t *testing.T) {
+	var callCount atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount.Add(1)
+		// Simulate connection error by closing connection
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			t.Fatal("webserver doesn't support hijacking")
+		}
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}))
+	defer server.Close()
+
+	transport := newTestTransport(t, &Config{
+		ToPort:              serverPort(t, server),
+		MaxConns:            1,
+		OutlierErrors:       2,
+		OutlierEjectionTime: 2 * time.Second,
+	})
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+
+	// Retrying stops as soon as the only upstream is ejected
+	_, err = transport.RoundTrip(req)
+	if !errors.Is(err, errNoHealthyUpstream) {
+		t.Errorf("Expected error %v, got %v", errNoHealthyUpstream, err)
+	}
+	if got := callCount.Load(); got != 2 {
+		t.Errorf("Expected 2 calls before ejection, got %d", got)
+	}
+
+	_, err = transport.RoundTrip(req)
+	if !errors.Is(err, errNoHealthyUpstream) {
+		t.Errorf("Expected error %v while ejected, got %v", errNoHealthyUpstream, err)
+	}
+	if got := callCount.Load(); got != 2 {
+		t.Errorf("Expected no calls while ejected, got %d", got)
+	}
+
+	// Without health checks, the upstream returns after the ejection time
+	customT := transport.(*customTransport)
+	if !waitFor(t, 4*time.Second, customT.balancer.available) {
+		t.Error("Expected upstream to return to rotation after the ejection time")
+	}
+}
+
+func TestReverseProxyNoHealthyUpstream(t *testing.T) {
+	proxy, err := newReverseProxy(&Config{ToPort: 9090, MaxConns: 1})
+	if err != nil {
+		t.Fatalf("Failed to create reverse proxy: %v", err)
+	}
+	proxy.Transport.(*customTransport).balancer.upstreams[0].health.ejected.Store(true)
+
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	resp, err := http.Get(proxyServer.URL)
+	if err != nil {
+		t.Fatalf("Failed to make request through proxy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", resp.StatusCode)
+	}
+}
+
+func TestListenProxyStopsHealthChecks(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []Route
+	}{
+		{name: "reverse proxy"},
+		{name: "routes", routes: []Route{{Name: "api", PathPrefix: "/api"}, {Name: "web", PathPrefix: "/"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var probes atomic.Int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/healthz" {
+					probes.Add(1)
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- ListenProxy(&Config{
+					ToPort:              serverPort(t, server),
+					MaxConns:            1,
+					Routes:              tt.routes,
+					HealthCheckPath:     "/healthz",
+					HealthCheckInterval: 10 * time.Millisecond,
+					HealthCheckTimeout:  time.Second,
+				})
+			}()
+			if !waitFor(t, 2*time.Second, func() bool { return probes.Load() >= 3 }) {
+				t.Fatal("Expected the upstream to be probed")
+			}
+
+			p, _ := os.FindProcess(os.Getpid())
+			p.Signal(os.Interrupt)
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("ListenProxy failed: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Expected ListenProxy to return after the signal")
+			}
+
+			// A probe already in flight may still land
+			time.Sleep(20 * time.Millisecond)
+			count := probes.Load()
+			time.Sleep(100 * time.Millisecond)
+			if got := probes.Load(); got != count {
+				t.Errorf("Expected no health checks after shutdown, got %d more", got-count)
+			}
+		})
+	}
+}
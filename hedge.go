@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// hedgeSamples is the number of recent latencies the hedge delay is computed from.
+	hedgeSamples = 1000
+	// hedgeMinSamples is the number of latencies needed before hedging starts.
+	hedgeMinSamples = 20
+)
+
+// hedger decides when to send a second attempt for a slow idempotent request.
+// The hedge is sent once the first attempt has taken longer than the
+// configured percentile of recent latencies, and hedges are capped to a
+// fraction of eligible requests.
+//
+// A nil *hedger disables hedging.
+type hedger struct {
+	percentile float64
+	budget     *retryBudget
+
+	mu      sync.Mutex
+	samples [hedgeSamples]time.Duration
+	count   int
+}
+
+// newHedger creates a hedger. It returns nil, meaning no hedging, when
+// percentile or maxPercent is zero.
+func newHedger(percentile, maxPercent float64) *hedger {
+	if percentile <= 0 || maxPercent <= 0 {
+		return nil
+	}
+	return &hedger{
+		percentile: percentile,
+		budget:     newRetryBudget(maxPercent, 0),
+	}
+}
+
+// observe records the latency of an attempt. Every attempt that gets a
+// response is recorded, and so is an attempt canceled because another one won,
+// with the time it ran for. Leaving the losers out would compute the delay
+// from the fast responses only, and hedge more and more of the requests.
+// Failed attempts are not recorded, as how fast a connection is refused says
+// nothing about how long responses take.
+func (h *hedger) observe(latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples[h.count%hedgeSamples] = latency
+	h.count++
+}
+
+// delay returns how long to wait before hedging. ok is false until enough
+// latencies have been observed.
+func (h *hedger) delay() (d time.Duration, ok bool) {
+	h.mu.Lock()
+	n := min(h.count, hedgeSamples)
+	if n < hedgeMinSamples {
+		h.mu.Unlock()
+		return 0, false
+	}
+	samples := slices.Clone(h.samples[:n])
+	h.mu.Unlock()
+
+	slices.Sort(samples)
+	i := int(math.Ceil(h.percentile/100*float64(n))) - 1
+	return samples[max(0, min(i, n-1))], true
+}
+
+// isHedgeable reports whether req may be sent twice: only idempotent GET and
+// HEAD requests without a body or protocol upgrade are hedged.
+func isHedgeable(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	return req.Header.Get("Upgrade") == ""
+}
+
+type hedgeResult struct {
+	index   int
+	res     *http.Response
+	err     error
+	latency time.Duration
+}
+
+// hedgedAttempt sends req to u like attempt, but sends a second attempt,
+// preferably to another upstream instance, if the first one has not answered
+// within the hedge delay. Whichever response arrives first is used and the
+// other attempt is canceled. The hedge holds its own semaphore slot and is
+// skipped when none is free.
+func (t *customTransport) hedgedAttempt(req *http.Request, u *upstream) (*http.Response, error) {
+	if t.hedge == nil || !isHedgeable(req) {
+		return t.attempt(req, u)
+	}
+	t.hedge.budget.deposit()
+
+	delay, ok := t.hedge.delay()
+	if !ok {
+		start := time.Now()
+		res, err := t.attempt(req, u)
+		if err == nil {
+			t.hedge.observe(time.Since(start))
+		}
+		return res, err
+	}
+
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	var starts []time.Time
+	done := make([]bool, 0, 2)
+	launch := func(u *upstream, release func()) {
+		ctx, cancel := context.WithCancel(req.Context())
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		start := time.Now()
+		starts = append(starts, start)
+		done = append(done, false)
+		go func() {
+			if release != nil {
+				defer release()
+			}
+			res, err := t.attempt(req.WithContext(ctx), u)
+			results <- hedgeResult{index: index, res: res, err: err, latency: time.Since(start)}
+		}()
+	}
+
+	launch(u, nil)
+	pending := 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			// Every instance may have been ejected since the first attempt
+			// started, in which case there is nowhere to hedge to
+			hedgeTo := t.balancer.pick(req, u)
+			if hedgeTo != nil && t.hedge.budget.withdraw() && t.sem.TryAcquire(1) {
+				log.Printf("hedge: %s %s (request_id:%s)", req.Method, req.URL, requestIDFromContext(req.Context()))
+				launch(hedgeTo, func() { t.sem.Release(1) })
+				pending++
+			}
+		case r := <-results:
+			pending--
+			done[r.index] = true
+			if r.err == nil {
+				t.hedge.observe(r.latency)
+				// 遅れた方の試行はキャンセルし、レスポンスが返ってきたら捨てる。
+				// 遅れた試行は少なくともここまでの時間がかかっている
+				for i, cancel := range cancels {
+					if i != r.index {
+						if !done[i] {
+							t.hedge.observe(time.Since(starts[i]))
+						}
+						cancel()
+					}
+				}
+				go discardResults(results, pending)
+				onBodyClose(r.res, cancels[r.index])
+				return r.res, nil
+			}
+			cancels[r.index]()
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// discardResults closes the responses of the n attempts that lost the race.
+func discardResults(results <-chan hedgeResult, n int) {
+	for range n {
+		if r := <-results; r.err == nil {
+			r.res.Body.Close()
+		}
+	}
+}
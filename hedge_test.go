@@ -0,0 +1,261 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewHedgerDisabled(t *testing.T) {
+	if h := newHedger(0, 5); h != nil {
+		t.Error("Expected nil hedger when percentile is zero")
+	}
+	if h := newHedger(95, 0); h != nil {
+		t.Error("Expected nil hedger when max percent is zero")
+	}
+}
+
+func TestHedgerDelay(t *testing.T) {
+	h := newHedger(90, 5)
+
+	for i := 1; i < hedgeMinSamples; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	if _, ok := h.delay(); ok {
+		t.Errorf("Expected no hedge delay before %d samples", hedgeMinSamples)
+	}
+
+	for i := hedgeMinSamples; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	d, ok := h.delay()
+	if !ok {
+		t.Fatal("Expected hedge delay once enough samples were observed")
+	}
+	if d != 90*time.Millisecond {
+		t.Errorf("Expected p90 delay 90ms, got %v", d)
+	}
+}
+
+func TestIsHedgeable(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		body   io.Reader
+		header http.Header
+		want   bool
+	}{
+		{name: "GET", method: "GET", want: true},
+		{name: "HEAD", method: "HEAD", want: true},
+		{name: "POST", method: "POST", want: false},
+		{name: "GET with body", method: "GET", body: strings.NewReader("body"), want: false},
+		{name: "upgrade", method: "GET", header: http.Header{"Upgrade": {"websocket"}}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, "http://localhost", tt.body)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			if got := isHedgeable(req); got != tt.want {
+				t.Errorf("Expected isHedgeable %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+// newHedgeTestServer returns a server whose first call hangs until canceled
+// and whose other calls answer immediately
+func newHedgeTestServer() (*httptest.Server, *atomic.Int32, chan struct{}) {
+	var callCount atomic.Int32
+	canceled := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if callCount.Add(1) == 1 {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+				canceled <- struct{}{}
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hedged"))
+	}))
+	return server, &callCount, canceled
+}
+
+// warmUp teaches the hedger a 10ms latency so that hedging kicks in
+func warmUp(h *hedger) {
+	for i := 0; i < hedgeMinSamples; i++ {
+		h.observe(10 * time.Millisecond)
+	}
+}
+
+func TestCustomTransportHedge(t *testing.T) {
+	server, callCount, canceled := newHedgeTestServer()
+	defer server.Close()
+
+	transport := newTestTransport(t, &Config{ToPort: serverPort(t, server), MaxConns: 2, HedgePercentile: 95, HedgeMaxPercent: 100})
+	warmUp(transport.(*customTransport).hedge)
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+
+	start := time.Now()
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	defer resp.Body.Close()
+	elapsed := time.Since(start)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read body: %v", err)
+	}
+	if string(body) != "hedged" {
+		t.Errorf("Expected body %q, got %q", "hedged", body)
+	}
+
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the hedge to answer quickly, took %v", elapsed)
+	}
+
+	if got := callCount.Load(); got != 2 {
+		t.Errorf("Expected 2 calls (original + hedge), got %d", got)
+	}
+
+	// The slow original attempt should be canceled
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("Expected the losing attempt to be canceled")
+	}
+}
+
+func TestCustomTransportHedgeObservesLoser(t *testing.T) {
+	server, _, _ := newHedgeTestServer()
+	defer server.Close()
+
+	transport := newTestTransport(t, &Config{ToPort: serverPort(t, server), MaxConns: 2, HedgePercentile: 95, HedgeMaxPercent: 100})
+	h := transport.(*customTransport).hedge
+	warmUp(h)
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	resp.Body.Close()
+
+	// Both the hedge that won and the slow attempt it beat are recorded, the
+	// latter with at least the hedge delay
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count != hedgeMinSamples+2 {
+		t.Fatalf("Expected 2 new latencies, got %d", h.count-hedgeMinSamples)
+	}
+	if loser := h.samples[hedgeMinSamples+1]; loser < 10*time.Millisecond {
+		t.Errorf("Expected the canceled attempt to be recorded with at least 10ms, got %v", loser)
+	}
+}
+
+func TestCustomTransportHedgeNeedsPermit(t *testing.T) {
+	server, callCount, _ := newHedgeTestServer()
+	defer server.Close()
+
+	// The original request holds the only slot, so no hedge can be sent
+	transport := newTestTransport(t, &Config{ToPort: serverPort(t, server), MaxConns: 1, HedgePercentile: 95, HedgeMaxPercent: 100})
+	warmUp(transport.(*customTransport).hedge)
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if got := callCount.Load(); got != 1 {
+		t.Errorf("Expected 1 call without a free permit, got %d", got)
+	}
+}
+
+func TestCustomTransportHedgeCapped(t *testing.T) {
+	server, callCount, _ := newHedgeTestServer()
+	defer server.Close()
+
+	// 1% of a single request does not allow a hedge
+	transport := newTestTransport(t, &Config{ToPort: serverPort(t, server), MaxConns: 2, HedgePercentile: 95, HedgeMaxPercent: 1})
+	warmUp(transport.(*customTransport).hedge)
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if got := callCount.Load(); got != 1 {
+		t.Errorf("Expected 1 call once the hedge cap is reached, got %d", got)
+	}
+}
+
+func TestCustomTransportHedgeAllEjected(t *testing.T) {
+	var transport *customTransport
+	var callCount atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The only upstream is ejected while the first attempt is in flight
+		if callCount.Add(1) == 1 {
+			transport.balancer.upstreams[0].health.ejected.Store(true)
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.Write([]byte("original"))
+	}))
+	defer server.Close()
+
+	transport = newTestTransport(t, &Config{ToPort: serverPort(t, server), MaxConns: 2, HedgePercentile: 95, HedgeMaxPercent: 100}).(*customTransport)
+	warmUp(transport.hedge)
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read body: %v", err)
+	}
+	if string(body) != "original" {
+		t.Errorf("Expected body %q, got %q", "original", body)
+	}
+	if got := callCount.Load(); got != 1 {
+		t.Errorf("Expected no hedge without an upstream in rotation, got %d calls", got)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "net/http"
+
+// newServerProtocols returns the protocols served by the listener. HTTP/2 is
+// negotiated over TLS; cleartext HTTP/2 (h2c) with prior knowledge is only
+// accepted when enabled.
+func newServerProtocols(config *Config) *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(config.H2C)
+	return protocols
+}
+
+// newUpstreamProtocols returns the protocols spoken to the upstreams. By
+// default HTTP/1.1 is used over plain HTTP and HTTP/2 is negotiated over TLS.
+// With UpstreamHTTP2, only HTTP/2 is used: h2c with prior knowledge over plain
+// HTTP, and HTTP/2 over TLS.
+func newUpstreamProtocols(config *Config) *http.Protocols {
+	if !config.UpstreamHTTP2 {
+		return nil
+	}
+	protocols := new(http.Protocols)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return protocols
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newH2CClient returns a client speaking only cleartext HTTP/2 with prior knowledge
+func newH2CClient() *http.Client {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: protocols}}
+}
+
+// serveProxy serves a reverse proxy for config on a local port and returns its address
+func serveProxy(t *testing.T, config *Config, wrap func(http.Handler) http.Handler) string {
+	t.Helper()
+	proxy, err := newReverseProxy(config)
+	if err != nil {
+		t.Fatalf("Failed to create reverse proxy: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := newServer(config, wrap(proxy), nil)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+func TestNewServerProtocols(t *testing.T) {
+	if p := newServerProtocols(&Config{}); !p.HTTP1() || !p.HTTP2() || p.UnencryptedHTTP2() {
+		t.Errorf("Expected HTTP/1 and HTTP/2 over TLS only, got %v", p)
+	}
+	if p := newServerProtocols(&Config{H2C: true}); !p.UnencryptedHTTP2() {
+		t.Errorf("Expected h2c to be accepted, got %v", p)
+	}
+
+	if p := newUpstreamProtocols(&Config{}); p != nil {
+		t.Errorf("Expected default upstream protocols, got %v", p)
+	}
+	if p := newUpstreamProtocols(&Config{UpstreamHTTP2: true}); p.HTTP1() || !p.HTTP2() || !p.UnencryptedHTTP2() {
+		t.Errorf("Expected only HTTP/2 to the upstream, got %v", p)
+	}
+}
+
+func TestH2CMultiplexedStreamsShareLimit(t *testing.T) {
+	var current, maxSeen atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := current.Add(1)
+		defer current.Add(-1)
+		for {
+			m := maxSeen.Load()
+			if n <= m || maxSeen.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	var mu sync.Mutex
+	remoteAddrs := map[string]bool{}
+	var http1Requests atomic.Int32
+	addr := serveProxy(t, &Config{ToPort: serverPort(t, upstream), MaxConns: 2, H2C: true}, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ProtoMajor != 2 {
+				http1Requests.Add(1)
+			}
+			mu.Lock()
+			remoteAddrs[r.RemoteAddr] = true
+			mu.Unlock()
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	client := newH2CClient()
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get("http://" + addr + "/")
+			if err != nil {
+				t.Errorf("Request failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("Expected status 200, got %d", resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := http1Requests.Load(); got != 0 {
+		t.Errorf("Expected every request over HTTP/2, got %d HTTP/1 requests", got)
+	}
+	if len(remoteAddrs) != 1 {
+		t.Errorf("Expected streams multiplexed over 1 connection, got %d", len(remoteAddrs))
+	}
+	// Streams on the same connection are limited individually
+	if got := maxSeen.Load(); got != 2 {
+		t.Errorf("Expected at most 2 concurrent upstream requests, got %d", got)
+	}
+}
+
+func TestUpstreamH2C(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetHTTP1(true)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+
+	tests := []struct {
+		name          string
+		upstreamHTTP2 bool
+		want          string
+	}{
+		{name: "default", upstreamHTTP2: false, want: "HTTP/1.1"},
+		{name: "upstream HTTP/2", upstreamHTTP2: true, want: "HTTP/2.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := newTestTransport(t, &Config{ToPort: serverPort(t, upstream), MaxConns: 1, UpstreamHTTP2: tt.upstreamHTTP2})
+
+			req, err := http.NewRequest("GET", upstream.URL, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tt.want {
+				t.Errorf("Expected upstream protocol %s, got %s", tt.want, body)
+			}
+		})
+	}
+}
+
+func TestHTTP2OverTLS(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, x509.ExtKeyUsageServerAuth)
+	config := &Config{
+		ToPort:      serverPort(t, upstream),
+		MaxConns:    1,
+		TLSCertFile: writeFile(t, dir, "cert.pem", certPEM),
+		TLSKeyFile:  writeFile(t, dir, "key.pem", keyPEM),
+	}
+	tlsConfig, err := newServerTLSConfig(config)
+	if err != nil {
+		t.Fatalf("Failed to create TLS config: %v", err)
+	}
+	proxy, err := newReverseProxy(config)
+	if err != nil {
+		t.Fatalf("Failed to create reverse proxy: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := newServer(config, proxy, tlsConfig)
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: true}}
+	resp, err := client.Get("https://" + ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to make HTTPS request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2 over TLS, got %s", resp.Proto)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// errCanceledByAdmin is the cause of requests canceled on the admin endpoint.
+// The error handler maps it to 503 Service Unavailable.
+var errCanceledByAdmin = errors.New("request canceled on the admin endpoint")
+
+// States of an in-flight request
+const (
+	stateReceived   = "received"   // Not yet handed to the upstream transport
+	stateQueued     = "queued"     // Waiting for a concurrency slot
+	stateUpstream   = "upstream"   // Holding a slot, awaiting the upstream's response headers
+	stateRetrying   = "retrying"   // Holding a slot, backing off before the next attempt
+	stateResponding = "responding" // Streaming the response body or an upgraded connection
+)
+
+// inflightRequest is a request being served, as shown on the admin endpoint
+type inflightRequest struct {
+	ID      string    `json:"id"`
+	Method  string    `json:"method"`
+	URL     string    `json:"url"`
+	Client  string    `json:"client"`
+	User    string    `json:"user,omitempty"`
+	Route   string    `json:"route,omitempty"`
+	Start   time.Time `json:"start"`
+	Attempt int       `json:"attempt"`
+	State   string    `json:"state"`
+
+	cancel context.CancelCauseFunc
+}
+
+// inflightRegistry tracks the requests being served, so that they can be
+// inspected and canceled on the admin endpoint.
+//
+// A nil *inflightRegistry tracks nothing.
+type inflightRegistry struct {
+	mu       sync.Mutex
+	requests map[string]*inflightRequest
+}
+
+func newInflightRegistry() *inflightRegistry {
+	return &inflightRegistry{requests: map[string]*inflightRequest{}}
+}
+
+// add registers a request and returns its context, canceled when the request
+// is canceled on the admin endpoint, and a function removing the request once
+// it is served. A request reusing the ID of one still in flight, which
+// clients can send in X-Request-Id, is given a fresh ID, so that it is listed
+// and cancelling never hits the wrong request.
+func (r *inflightRegistry) add(ctx context.Context, req *inflightRequest) (context.Context, func()) {
+	if r == nil {
+		return ctx, func() {}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		if _, ok := r.requests[req.ID]; !ok {
+			break
+		}
+		req.ID = newRequestID()
+	}
+	ctx, req.cancel = context.WithCancelCause(ctx)
+	req.State = stateReceived
+	r.requests[req.ID] = req
+	ctx = withInflight(ctx, &inflightEntry{registry: r, req: req})
+	return ctx, func() {
+		r.mu.Lock()
+		delete(r.requests, req.ID)
+		r.mu.Unlock()
+		req.cancel(nil)
+	}
+}
+
+// list returns a snapshot of the requests in flight, oldest first
+func (r *inflightRegistry) list() []inflightRequest {
+	r.mu.Lock()
+	out := make([]inflightRequest, 0, len(r.requests))
+	for _, req := range r.requests {
+		out = append(out, *req)
+	}
+	r.mu.Unlock()
+	slices.SortFunc(out, func(a, b inflightRequest) int {
+		return cmp.Or(a.Start.Compare(b.Start), cmp.Compare(a.ID, b.ID))
+	})
+	return out
+}
+
+// cancel cancels the request with id. It reports whether there was one.
+func (r *inflightRegistry) cancel(id string) bool {
+	r.mu.Lock()
+	req, ok := r.requests[id]
+	r.mu.Unlock()
+	if ok {
+		req.cancel(errCanceledByAdmin)
+	}
+	return ok
+}
+
+// inflightEntry updates the registered request from the code serving it.
+//
+// A nil *inflightEntry does nothing, so that requests can be updated whether
+// they are tracked or not.
+type inflightEntry struct {
+	registry *inflightRegistry
+	req      *inflightRequest
+}
+
+type inflightKey struct{}
+
+func withInflight(ctx context.Context, e *inflightEntry) context.Context {
+	return context.WithValue(ctx, inflightKey{}, e)
+}
+
+// inflightFromContext returns the tracked request of ctx, or nil
+func inflightFromContext(ctx context.Context) *inflightEntry {
+	e, _ := ctx.Value(inflightKey{}).(*inflightEntry)
+	return e
+}
+
+// setState sets the state of the request
+func (e *inflightEntry) setState(state string) {
+	if e == nil {
+		return
+	}
+	e.registry.mu.Lock()
+	defer e.registry.mu.Unlock()
+	e.req.State = state
+}
+
+// setAttempt sets the current attempt of the request, counted from 1, and
+// marks it as awaiting the upstream
+func (e *inflightEntry) setAttempt(n int) {
+	if e == nil {
+		return
+	}
+	e.registry.mu.Lock()
+	defer e.registry.mu.Unlock()
+	e.req.Attempt = n
+	e.req.State = stateUpstream
+}
+
+// setIdentity sets the authenticated identity of the request
+func (e *inflightEntry) setIdentity(name string) {
+	if e == nil {
+		return
+	}
+	e.registry.mu.Lock()
+	defer e.registry.mu.Unlock()
+	e.req.User = name
+}
+
+// setRoute sets the name of the route serving the request
+func (e *inflightEntry) setRoute(name string) {
+	if e == nil {
+		return
+	}
+	e.registry.mu.Lock()
+	defer e.registry.mu.Unlock()
+	e.req.Route = name
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInflightRegistry(t *testing.T) {
+	r := newInflightRegistry()
+	start := time.Now()
+	ctx1, done1 := r.add(context.Background(), &inflightRequest{ID: "b", Start: start})
+	_, done2 := r.add(context.Background(), &inflightRequest{ID: "a", Start: start.Add(time.Second)})
+	defer done2()
+
+	// A duplicate ID is tracked under a fresh ID
+	dup := &inflightRequest{ID: "b", Start: start}
+	ctx3, done3 := r.add(context.Background(), dup)
+	if dup.ID == "b" || !validRequestID(dup.ID) || inflightFromContext(ctx3) == nil {
+		t.Errorf("Expected a duplicate ID to be tracked under a fresh ID, got %q", dup.ID)
+	}
+	if list := r.list(); len(list) != 3 {
+		t.Errorf("Expected 3 requests in flight, got %+v", list)
+	}
+	done3()
+	if ctx1.Err() != nil {
+		t.Error("Expected the duplicate not to affect the first request")
+	}
+
+	e := inflightFromContext(ctx1)
+	e.setRoute("api")
+	e.setState(stateQueued)
+	e.setAttempt(2)
+
+	list := r.list()
+	if len(list) != 2 || list[0].ID != "b" || list[1].ID != "a" {
+		t.Fatalf("Expected requests oldest first, got %+v", list)
+	}
+	if got := list[0]; got.State != stateUpstream || got.Attempt != 2 || got.Route != "api" {
+		t.Errorf("Expected the updates to show, got %+v", got)
+	}
+	if list[1].State != stateReceived {
+		t.Errorf("Expected a new request to be %s, got %s", stateReceived, list[1].State)
+	}
+
+	if r.cancel("missing") {
+		t.Error("Expected no request to cancel")
+	}
+	if !r.cancel("b") {
+		t.Fatal("Expected the request to be canceled")
+	}
+	if cause := context.Cause(ctx1); !errors.Is(cause, errCanceledByAdmin) {
+		t.Errorf("Expected the context to be canceled by the admin, got %v", cause)
+	}
+
+	done1()
+	if list := r.list(); len(list) != 1 || list[0].ID != "a" {
+		t.Errorf("Expected the served request to be removed, got %+v", list)
+	}
+
+	// A nil registry tracks nothing
+	var none *inflightRegistry
+	ctx, done := none.add(context.Background(), &inflightRequest{ID: "c"})
+	inflightFromContext(ctx).setState(stateQueued)
+	done()
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ipFilterCheckInterval is how often the IP access file is checked for changes
+const ipFilterCheckInterval = 5 * time.Second
+
+// ipFilterGlobal is the scope denied requests are counted under when the
+// global lists deny them
+const ipFilterGlobal = "global"
+
+// errIPDenied is returned for clients denied by the IP access lists.
+// The error handler maps it to 403 Forbidden.
+var errIPDenied = errors.New("client address denied")
+
+// ipDenied counts the requests denied by the IP access lists, by scope: the
+// global lists or the name of the route
+var ipDenied = expvar.NewMap("ip_filter_denied")
+
+// ipRules are allow and deny lists of CIDRs. A client matching the deny list
+// is denied; otherwise it is allowed if the allow list is empty or matches it.
+type ipRules struct {
+	Allow []string `json:"allow"` // CIDRs or IP addresses allowed (empty allows every client not denied)
+	Deny  []string `json:"deny"`  // CIDRs or IP addresses denied, even if allowed
+
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func (r *ipRules) init() error {
+	if r == nil {
+		return nil
+	}
+	var err error
+	if r.allow, err = parseCIDRList(r.Allow); err != nil {
+		return err
+	}
+	r.deny, err = parseCIDRList(r.Deny)
+	return err
+}
+
+// parseCIDRList parses a list of CIDRs or IP addresses
+func parseCIDRList(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		prefix, err := parseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// allows reports whether the rules let a client with addr through. A client
+// whose address is unknown, such as on a unix domain socket, only passes
+// rules without an allow list.
+func (r *ipRules) allows(addr netip.Addr) bool {
+	if r == nil {
+		return true
+	}
+	contains := func(prefix netip.Prefix) bool { return addr.IsValid() && prefix.Contains(addr) }
+	if slices.ContainsFunc(r.deny, contains) {
+		return false
+	}
+	return len(r.allow) == 0 || slices.ContainsFunc(r.allow, contains)
+}
+
+// ipAccessFile is the format of the -ip-access-file
+type ipAccessFile struct {
+	ipRules
+	Routes map[string]*ipRules `json:"routes"` // Lists applied to the requests of each route, by route name
+}
+
+// loadIPAccessFile reads and validates the IP access file. Routes names the
+// routes its lists may apply to.
+func loadIPAccessFile(filename string, routes []string) (*ipAccessFile, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file ipAccessFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid IP access file %s: %w", filename, err)
+	}
+	if err := file.init(); err != nil {
+		return nil, fmt.Errorf("invalid IP access file %s: %w", filename, err)
+	}
+	for name, r := range file.Routes {
+		if !slices.Contains(routes, name) {
+			return nil, fmt.Errorf("invalid IP access file %s: unknown route %q", filename, name)
+		}
+		if err := r.init(); err != nil {
+			return nil, fmt.Errorf("invalid IP access file %s: route %s: %w", filename, name, err)
+		}
+	}
+	return &file, nil
+}
+
+// ipFilter denies clients by the allow and deny lists of the IP access file,
+// which is reloaded when it changes, so that the lists can be updated without
+// restarting the proxy. The global lists apply to every request before it is
+// routed, and the lists of a route to the requests it serves. Both are
+// evaluated before a request takes a concurrency slot.
+//
+// A nil *ipFilter allows every client.
+type ipFilter struct {
+	filename      string
+	routes        []string
+	checkInterval time.Duration
+
+	mu        sync.Mutex
+	file      *ipAccessFile
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newIPFilter(filename string, routes []string) (*ipFilter, error) {
+	f := &ipFilter{
+		filename:      filename,
+		routes:        routes,
+		checkInterval: ipFilterCheckInterval,
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if f.file, err = loadIPAccessFile(filename, routes); err != nil {
+		return nil, err
+	}
+	f.modTime = info.ModTime()
+	return f, nil
+}
+
+// current returns the lists in effect, reloading the file if it changed
+func (f *ipFilter) current() *ipAccessFile {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Since(f.lastCheck) >= f.checkInterval {
+		f.lastCheck = time.Now()
+		// Keep the current lists if the new file can't be loaded, e.g. while
+		// it is being written.
+		if info, err := os.Stat(f.filename); err != nil {
+			log.Printf("failed to check IP access file: %v", err)
+		} else if !info.ModTime().Equal(f.modTime) {
+			if file, err := loadIPAccessFile(f.filename, f.routes); err != nil {
+				log.Printf("failed to reload IP access file: %v", err)
+			} else {
+				f.file, f.modTime = file, info.ModTime()
+				log.Printf("reloaded IP access file %s", f.filename)
+			}
+		}
+	}
+	return f.file
+}
+
+// allows reports whether the client of req passes the global lists, or the
+// lists of route if it is given
+func (f *ipFilter) allows(req *http.Request, route string) bool {
+	if f == nil {
+		return true
+	}
+	file := f.current()
+	rules := &file.ipRules
+	if route != "" {
+		rules = file.Routes[route]
+	}
+	return rules.allows(clientAddr(req))
+}
+
+// deny answers a request denied by the lists of scope, and counts it
+func (f *ipFilter) deny(w http.ResponseWriter, req *http.Request, scope string) {
+	ipDenied.Add(scope, 1)
+	log.Printf("denied by IP access lists (%s): %s %s from %s (request_id:%s)", scope, req.Method, req.URL, req.RemoteAddr, requestIDFromContext(req.Context()))
+	if isGRPC(req) {
+		writeGRPCError(w, errIPDenied)
+		return
+	}
+	w.WriteHeader(errorStatus(errIPDenied))
+}
+
+// clientAddr returns the IP address of the client of req, with IPv4-mapped
+// IPv6 addresses unmapped, or the zero Addr if it is unknown
+func clientAddr(req *http.Request) netip.Addr {
+	ap, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
+
+// ipFilterHandler passes the requests allowed by the global lists to next
+type ipFilterHandler struct {
+	next   http.Handler
+	filter *ipFilter
+}
+
+func (h *ipFilterHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !h.filter.allows(req, "") {
+		h.filter.deny(w, req, ipFilterGlobal)
+		return
+	}
+	h.next.ServeHTTP(w, req)
+}
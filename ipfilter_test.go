@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeIPAccessFile writes an IP access file and returns its path
+func writeIPAccessFile(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "ip-access.json")
+	if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write IP access file: %v", err)
+	}
+	return filename
+}
+
+// deniedCount returns the number of requests denied in scope
+func deniedCount(scope string) int64 {
+	if v, ok := ipDenied.Get(scope).(interface{ Value() int64 }); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestIPRulesAllows(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules *ipRules
+		addr  string
+		want  bool
+	}{
+		{name: "no rules", rules: nil, addr: "192.0.2.1", want: true},
+		{name: "empty lists", rules: &ipRules{}, addr: "192.0.2.1", want: true},
+		{name: "allowed", rules: &ipRules{Allow: []string{"10.0.0.0/8"}}, addr: "10.1.2.3", want: true},
+		{name: "not allowed", rules: &ipRules{Allow: []string{"10.0.0.0/8"}}, addr: "192.0.2.1", want: false},
+		{name: "denied", rules: &ipRules{Deny: []string{"192.0.2.1"}}, addr: "192.0.2.1", want: false},
+		{name: "not denied", rules: &ipRules{Deny: []string{"192.0.2.1"}}, addr: "192.0.2.2", want: true},
+		{name: "deny over allow", rules: &ipRules{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.5.0/24"}}, addr: "10.0.5.1", want: false},
+		{name: "IPv6", rules: &ipRules{Allow: []string{"2001:db8::/32"}}, addr: "2001:db8::1", want: true},
+		{name: "unknown address with allow list", rules: &ipRules{Allow: []string{"10.0.0.0/8"}}, addr: "", want: false},
+		{name: "unknown address with deny list", rules: &ipRules{Deny: []string{"10.0.0.0/8"}}, addr: "", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rules.init(); err != nil {
+				t.Fatalf("Failed to init rules: %v", err)
+			}
+			var addr netip.Addr
+			if tt.addr != "" {
+				addr = netip.MustParseAddr(tt.addr)
+			}
+			if got := tt.rules.allows(addr); got != tt.want {
+				t.Errorf("Expected %t for %q, got %t", tt.want, tt.addr, got)
+			}
+		})
+	}
+}
+
+func TestLoadIPAccessFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "global lists", content: `{"allow": ["10.0.0.0/8", "192.0.2.1"], "deny": ["10.0.5.0/24"]}`},
+		{name: "route lists", content: `{"routes": {"api": {"deny": ["192.0.2.0/24"]}}}`},
+		{name: "empty", content: `{}`},
+		{name: "invalid CIDR", content: `{"allow": ["10.0.0.0/33"]}`, wantErr: true},
+		{name: "invalid route CIDR", content: `{"routes": {"api": {"allow": ["example.com"]}}}`, wantErr: true},
+		{name: "unknown route", content: `{"routes": {"web": {"allow": ["10.0.0.0/8"]}}}`, wantErr: true},
+		{name: "unknown field", content: `{"allowed": ["10.0.0.0/8"]}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadIPAccessFile(writeIPAccessFile(t, tt.content), []string{"api"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %t, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestIPFilterHandler(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer slow.Close()
+
+	filter, err := newIPFilter(writeIPAccessFile(t, `{"allow": ["127.0.0.1"]}`), nil)
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+	filter.checkInterval = 0
+	proxy, err := newReverseProxy(&Config{ToPort: serverPort(t, slow), MaxConns: 1})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	front := httptest.NewServer(&ipFilterHandler{next: proxy, filter: filter})
+	defer front.Close()
+	defer close(release)
+
+	// An allowed client takes the only slot
+	go http.Get(front.URL + "/")
+	<-started
+
+	// A denied client is answered without waiting for the slot
+	if err := os.WriteFile(filter.filename, []byte(`{"deny": ["127.0.0.0/8"]}`), 0o644); err != nil {
+		t.Fatalf("Failed to rewrite IP access file: %v", err)
+	}
+	later := time.Now().Add(time.Second)
+	os.Chtimes(filter.filename, later, later)
+	before := deniedCount(ipFilterGlobal)
+	client := &http.Client{Timeout: 2 * time.Second}
+	res, err := client.Get(front.URL + "/")
+	if err != nil {
+		t.Fatalf("Expected the denied request to be answered without queueing, got %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d", res.StatusCode)
+	}
+	if got := deniedCount(ipFilterGlobal) - before; got != 1 {
+		t.Errorf("Expected 1 denied request to be counted, got %d", got)
+	}
+
+	// A broken file keeps the lists in effect
+	os.WriteFile(filter.filename, []byte(`{"deny": ["nope"]}`), 0o644)
+	later = later.Add(time.Second)
+	os.Chtimes(filter.filename, later, later)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	if filter.allows(req, "") {
+		t.Error("Expected the previous lists to stay in effect")
+	}
+}
+
+func TestRouterIPFilter(t *testing.T) {
+	api := newNamedServer(t, "api")
+	admin := newNamedServer(t, "admin")
+
+	routes, _, err := loadRoutes(writeRoutes(t, fmt.Sprintf(`{
+		"routes": [
+			{"name": "admin", "path_prefix": "/admin/", "upstreams": ["%d"]},
+			{"name": "api", "upstreams": ["%d"]}
+		]
+	}`, admin, api)))
+	if err != nil {
+		t.Fatalf("Failed to load routes: %v", err)
+	}
+	config := &Config{MaxConns: 1, Routes: routes}
+	filter, err := newIPFilter(writeIPAccessFile(t, `{"routes": {"admin": {"allow": ["10.0.0.0/8"]}}}`), config.routeNames())
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+	rt, err := newRouter(config)
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+	rt.filter = filter
+
+	tests := []struct {
+		path   string
+		remote string
+		status int
+	}{
+		{path: "/users", remote: "192.0.2.1:1234", status: http.StatusOK},
+		{path: "/admin/users", remote: "10.1.2.3:1234", status: http.StatusOK},
+		{path: "/admin/users", remote: "192.0.2.1:1234", status: http.StatusForbidden},
+	}
+	before := deniedCount("admin")
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://example.com"+tt.path, nil)
+		req.RemoteAddr = tt.remote
+		res := httptest.NewRecorder()
+		rt.ServeHTTP(res, req)
+		if res.Code != tt.status {
+			t.Errorf("Expected status %d for %s from %s, got %d", tt.status, tt.path, tt.remote, res.Code)
+		}
+	}
+	if got := deniedCount("admin") - before; got != 1 {
+		t.Errorf("Expected 1 denied request to be counted for the route, got %d", got)
+	}
+}
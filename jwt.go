@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// jwtLeeway is the clock skew tolerated when checking exp and nbf
+const jwtLeeway = 30 * time.Second
+
+// jwtAlgorithms are the signature algorithms accepted, with their key type
+// and hash. Unsigned (none) and HMAC tokens are never accepted.
+var jwtAlgorithms = map[string]struct {
+	kty  string
+	hash crypto.Hash
+	pss  bool
+}{
+	"RS256": {kty: "RSA", hash: crypto.SHA256},
+	"RS384": {kty: "RSA", hash: crypto.SHA384},
+	"RS512": {kty: "RSA", hash: crypto.SHA512},
+	"PS256": {kty: "RSA", hash: crypto.SHA256, pss: true},
+	"PS384": {kty: "RSA", hash: crypto.SHA384, pss: true},
+	"PS512": {kty: "RSA", hash: crypto.SHA512, pss: true},
+	"ES256": {kty: "EC", hash: crypto.SHA256},
+	"ES384": {kty: "EC", hash: crypto.SHA384},
+	"ES512": {kty: "EC", hash: crypto.SHA512},
+	"EdDSA": {kty: "OKP"},
+}
+
+// jwk is a public key of a JWKS
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`   // RSA modulus
+	E   string `json:"e"`   // RSA exponent
+	Crv string `json:"crv"` // EC or OKP curve
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	key crypto.PublicKey
+}
+
+// loadJWKS reads the public keys of a JWKS file. Keys for encryption only
+// are skipped.
+func loadJWKS(filename string) ([]*jwk, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS %s: %w", filename, err)
+	}
+	var keys []*jwk
+	for i, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		if err := k.init(); err != nil {
+			return nil, fmt.Errorf("invalid JWKS %s: key %d: %w", filename, i, err)
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("invalid JWKS %s: no signing keys", filename)
+	}
+	return keys, nil
+}
+
+// init decodes the public key
+func (k *jwk) init() error {
+	param := func(name, s string) ([]byte, error) {
+		b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid %s", name)
+		}
+		return b, nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := param("n", k.N)
+		if err != nil {
+			return err
+		}
+		e, err := param("e", k.E)
+		if err != nil {
+			return err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+			return fmt.Errorf("invalid e")
+		}
+		k.key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		var ecdhCurve ecdh.Curve
+		switch k.Crv {
+		case "P-256":
+			curve, ecdhCurve = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, ecdhCurve = elliptic.P521(), ecdh.P521()
+		default:
+			return fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := param("x", k.X)
+		if err != nil {
+			return err
+		}
+		y, err := param("y", k.Y)
+		if err != nil {
+			return err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return fmt.Errorf("invalid point")
+		}
+		// Parsing the uncompressed point checks that it is on the curve
+		point := append([]byte{4}, append(x, y...)...)
+		if _, err := ecdhCurve.NewPublicKey(point); err != nil {
+			return fmt.Errorf("invalid point: %w", err)
+		}
+		k.key = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := param("x", k.X)
+		if err != nil {
+			return err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid x")
+		}
+		k.key = ed25519.PublicKey(x)
+	default:
+		return fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+	return nil
+}
+
+// verify checks the signature of signed with the key
+func (k *jwk) verify(alg string, signed, sig []byte) bool {
+	a := jwtAlgorithms[alg]
+	if a.kty != k.Kty || (k.Alg != "" && k.Alg != alg) {
+		return false
+	}
+	var digest []byte
+	if a.hash != 0 {
+		h := a.hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+	switch key := k.key.(type) {
+	case *rsa.PublicKey:
+		if a.pss {
+			return rsa.VerifyPSS(key, a.hash, digest, sig, nil) == nil
+		}
+		return rsa.VerifyPKCS1v15(key, a.hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		// The signature is r and s of the curve size each
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, signed, sig)
+	}
+	return false
+}
+
+// jwtClaims are the registered claims checked by the proxy
+type jwtClaims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt *float64    `json:"exp"` // NumericDate, seconds since the epoch
+	NotBefore *float64    `json:"nbf"`
+}
+
+// jwtAudience is the aud claim, a string or an array of strings
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = jwtAudience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("aud must be a string or an array of strings")
+	}
+	*a = many
+	return nil
+}
+
+// jwtVerifier validates bearer JWTs against the keys of a JWKS
+type jwtVerifier struct {
+	keys     []*jwk
+	issuer   string // Required iss (empty accepts any)
+	audience string // Required member of aud (empty accepts any)
+}
+
+// verify validates a compact JWS token and returns its subject. The token
+// must be signed by one of the keys, unexpired, and carry a subject; it must
+// also match the issuer and audience when they are configured.
+func (v *jwtVerifier) verify(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", fmt.Errorf("malformed header: %w", err)
+	}
+	if _, ok := jwtAlgorithms[header.Alg]; !ok {
+		return "", fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if !slices.ContainsFunc(v.keys, func(k *jwk) bool {
+		return (header.Kid == "" || k.Kid == header.Kid) && k.verify(header.Alg, signed, sig)
+	}) {
+		return "", errors.New("invalid signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("malformed claims: %w", err)
+	}
+	switch {
+	case claims.ExpiresAt == nil:
+		return "", errors.New("no exp claim")
+	case now.After(numericDate(*claims.ExpiresAt).Add(jwtLeeway)):
+		return "", errors.New("token expired")
+	case claims.NotBefore != nil && now.Add(jwtLeeway).Before(numericDate(*claims.NotBefore)):
+		return "", errors.New("token not yet valid")
+	case v.issuer != "" && claims.Issuer != v.issuer:
+		return "", fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	case v.audience != "" && !slices.Contains(claims.Audience, v.audience):
+		return "", fmt.Errorf("unexpected audience %q", claims.Audience)
+	case claims.Subject == "":
+		return "", errors.New("no sub claim")
+	}
+	return claims.Subject, nil
+}
+
+// numericDate converts a NumericDate claim to a time
+func numericDate(secs float64) time.Time {
+	sec, frac := math.Modf(secs)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
+
+// decodeJWTPart decodes a base64url encoded JSON part of a token
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testJWTKeys are signing keys with their JWKS entries
+type testJWTKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+	ed  ed25519.PrivateKey
+}
+
+func newTestJWTKeys(t *testing.T) *testJWTKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate Ed25519 key: %v", err)
+	}
+	return &testJWTKeys{rsa: rsaKey, ec: ecKey, ed: edKey}
+}
+
+// writeJWKS writes the public keys as a JWKS file and returns its path
+func (k *testJWTKeys) writeJWKS(t *testing.T) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding.EncodeToString
+	ecdhKey, _ := k.ec.PublicKey.ECDH()
+	ecPub := ecdhKey.Bytes()
+	set := map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": b64(k.rsa.N.Bytes()), "e": b64(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecPub[1:33]), "y": b64(ecPub[33:])},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(k.ed.Public().(ed25519.PublicKey))},
+	}}
+	data, _ := json.Marshal(set)
+	filename := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(filename, data, 0o644); err != nil {
+		t.Fatalf("Failed to write JWKS: %v", err)
+	}
+	return filename
+}
+
+// sign returns a token with claims signed by the key of alg
+func (k *testJWTKeys) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch alg {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+	case "PS256":
+		sig, err = rsa.SignPSS(rand.Reader, k.rsa, crypto.SHA256, digest[:], nil)
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		sig = make([]byte, 64)
+		if err == nil {
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+		}
+	case "EdDSA":
+		sig = ed25519.Sign(k.ed, []byte(signed))
+	case "none":
+	default:
+		t.Fatalf("Unknown algorithm %s", alg)
+	}
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerify(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	jwks, err := loadJWKS(keys.writeJWKS(t))
+	if err != nil {
+		t.Fatalf("Failed to load JWKS: %v", err)
+	}
+	v := &jwtVerifier{keys: jwks, issuer: "https://issuer.example.com", audience: "flproxy"}
+	now := time.Now()
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{
+			"sub": "alice",
+			"iss": "https://issuer.example.com",
+			"aud": []string{"other", "flproxy"},
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{name: "RS256", token: keys.sign(t, "RS256", "rsa", claims(nil))},
+		{name: "PS256", token: keys.sign(t, "PS256", "rsa", claims(nil))},
+		{name: "ES256", token: keys.sign(t, "ES256", "ec", claims(nil))},
+		{name: "EdDSA", token: keys.sign(t, "EdDSA", "ed", claims(nil))},
+		{name: "no kid", token: keys.sign(t, "ES256", "", claims(nil))},
+		{name: "audience string", token: keys.sign(t, "RS256", "rsa", claims(map[string]any{"aud": "flproxy"}))},
+		{name: "expired within leeway", token: keys.sign(t, "RS256", "rsa", claims(map[string]any{"exp": now.Add(-10 * time.Second).Unix()}))},
+		{name: "wrong kid", token: keys.sign(t, "RS256", "ec", claims(nil)), wantErr: "invalid signature"},
+		{name: "unsigned", token: keys.sign(t, "none", "", claims(nil)), wantErr: "unsupported algorithm"},
+		{name: "tampered", token: strings.Replace(keys.sign(t, "RS256", "rsa", claims(nil)), ".", ".e30", 1), wantErr: "invalid signature"},
+		{name: "expired", token: keys.sign(t, "RS256", "rsa", claims(map[string]any{"exp": now.Add(-time.Hour).Unix()})), wantErr: "token expired"},
+		{name: "no expiry", token: keys.sign(t, "RS256", "rsa", claims(map[string]any{"exp": nil})), wantErr: "no exp claim"},
+		{name: "not yet valid", token: keys.sign(t, "RS256", "rsa", claims(map[string]any{"nbf": now.Add(time.Hour).Unix()})), wantErr: "not yet valid"},
+		{name: "wrong issuer", token: keys.sign(t, "RS256", "rsa", claims(map[string]any{"iss": "https://evil.example.com"})), wantErr: "unexpected issuer"},
+		{name: "wrong audience", token: keys.sign(t, "RS256", "rsa", claims(map[string]any{"aud": "other"})), wantErr: "unexpected audience"},
+		{name: "no subject", token: keys.sign(t, "RS256", "rsa", claims(map[string]any{"sub": nil})), wantErr: "no sub claim"},
+		{name: "malformed", token: "not.a-token", wantErr: "malformed token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, err := v.verify(tt.token, now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected the token to be valid, got %v", err)
+			}
+			if sub != "alice" {
+				t.Errorf("Expected subject alice, got %q", sub)
+			}
+		})
+	}
+}
+
+func TestLoadJWKS(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "encryption keys skipped", content: `{"keys": [{"kty": "RSA", "use": "enc"}, {"kty": "OKP", "crv": "Ed25519", "x": "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}]}`},
+		{name: "no keys", content: `{"keys": []}`, wantErr: true},
+		{name: "unsupported key type", content: `{"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}`, wantErr: true},
+		{name: "point off the curve", content: `{"keys": [{"kty": "EC", "crv": "P-256", "x": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", "y": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAE"}]}`, wantErr: true},
+		{name: "invalid JSON", content: `{"keys": `, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "jwks.json")
+			os.WriteFile(filename, []byte(tt.content), 0o644)
+			_, err := loadJWKS(filename)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %t, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// errBodyTooLarge is returned for request bodies over the size limit.
+// The error handler maps it to 413 Content Too Large.
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitBody rejects req if its Content-Length is over max bytes, and
+// otherwise cuts its body off once more than max bytes are read, which
+// catches chunked bodies of unknown length. A max of 0 means no limit.
+func limitBody(req *http.Request, max int64) error {
+	if max <= 0 || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if req.ContentLength > max {
+		return errBodyTooLarge
+	}
+	req.Body = &limitedBody{ReadCloser: req.Body, remaining: max}
+	return nil
+}
+
+// limitedBody fails reads with errBodyTooLarge once more than remaining
+// bytes have been read
+type limitedBody struct {
+	io.ReadCloser
+	mu        sync.Mutex
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	// Read one byte past the limit to tell a body of exactly max bytes from
+	// a longer one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = -1
+		return n, errBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		max           int64
+		wantRejected  bool
+		wantRead      string
+		wantErr       error
+	}{
+		{name: "no limit", body: "hello world", contentLength: 11, max: 0, wantRead: "hello world"},
+		{name: "under the limit", body: "hello", contentLength: 5, max: 10, wantRead: "hello"},
+		{name: "exactly the limit", body: "hello", contentLength: -1, max: 5, wantRead: "hello"},
+		{name: "content length over the limit", body: "hello world", contentLength: 11, max: 5, wantRejected: true},
+		{name: "chunked body over the limit", body: "hello world", contentLength: -1, max: 5, wantRead: "hello", wantErr: errBodyTooLarge},
+		{name: "content length understating the body", body: "hello world", contentLength: 3, max: 5, wantRead: "hello", wantErr: errBodyTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			req.ContentLength = tt.contentLength
+			err := limitBody(req, tt.max)
+			if tt.wantRejected {
+				if !errors.Is(err, errBodyTooLarge) {
+					t.Errorf("Expected the request to be rejected, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			got, err := io.ReadAll(req.Body)
+			if string(got) != tt.wantRead {
+				t.Errorf("Expected to read %q, got %q", tt.wantRead, got)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		if _, err := io.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}))
+	defer backend.Close()
+
+	proxy, err := newReverseProxy(&Config{ToPort: serverPort(t, backend), MaxConns: 1, MaxBodyBytes: 5})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	front := httptest.NewServer(proxy)
+	defer front.Close()
+	defer close(release)
+
+	// Hold the only slot
+	go http.Get(front.URL + "/slow")
+	<-started
+
+	// A request with a too large Content-Length is rejected without waiting for the slot
+	client := &http.Client{Timeout: 2 * time.Second}
+	res, err := client.Post(front.URL+"/", "text/plain", strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatalf("Expected the request to be rejected without queueing, got %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413, got %d", res.StatusCode)
+	}
+}
+
+func TestMaxBodyBytesChunked(t *testing.T) {
+	type result struct {
+		body string
+		err  error
+	}
+	received := make(chan result, 2)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		received <- result{string(body), err}
+	}))
+	defer backend.Close()
+
+	proxy, err := newReverseProxy(&Config{ToPort: serverPort(t, backend), MaxConns: 1, MaxBodyBytes: 5})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	front := httptest.NewServer(proxy)
+	defer front.Close()
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "within the limit", body: "hello", wantStatus: http.StatusOK},
+		{name: "over the limit", body: "hello world", wantStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Hide the length so that the body is sent chunked
+			req, _ := http.NewRequest("POST", front.URL+"/", io.MultiReader(strings.NewReader(tt.body)))
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to send request: %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, res.StatusCode)
+			}
+		})
+	}
+	// Close waits for the handlers, so every body the upstream saw is in received
+	backend.Close()
+	close(received)
+	if got := <-received; got.body != "hello" || got.err != nil {
+		t.Errorf("Expected the body within the limit to reach the upstream, got %q %v", got.body, got.err)
+	}
+	// The upstream may see the start of the body over the limit, but its read
+	// fails before the end: with an unexpected EOF once the proxy drops the
+	// connection, or on the connection closed by Close if that comes first
+	if got, ok := <-received; ok && got.err == nil {
+		t.Errorf("Expected the body over the limit to be cut off, got %q %v", got.body, got.err)
+	}
+}
+
+func TestNewServerLimits(t *testing.T) {
+	config := &Config{
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+		WriteTimeout:      2 * time.Minute,
+		IdleTimeout:       3 * time.Minute,
+		MaxHeaderBytes:    4096,
+	}
+	srv := newServer(config, http.NotFoundHandler(), nil)
+	if srv.ReadHeaderTimeout != 10*time.Second || srv.ReadTimeout != time.Minute || srv.WriteTimeout != 2*time.Minute || srv.IdleTimeout != 3*time.Minute {
+		t.Errorf("Expected the timeouts to be set, got %v/%v/%v/%v", srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+	if srv.MaxHeaderBytes != 4096 {
+		t.Errorf("Expected MaxHeaderBytes 4096, got %d", srv.MaxHeaderBytes)
+	}
+}
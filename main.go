@@ -4,16 +4,21 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 
 func init() {
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usages:\n")
-		fmt.Fprintf(flag.CommandLine.Output(), "  %s [-limit=<number>] <fromPort>:<toPort>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s [options] [<host>:]<fromPort>:<toPort>[,<toPort>...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s [options] -mode=forward -forward-allow=<host>[:<port>][,...] [<host>:]<port>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  (host is an IP address, [IPv6] or * for every interface; ports may be unix domain sockets in format unix:/path)\n")
 		fmt.Fprintf(flag.CommandLine.Output(), "Options:\n")
 		flag.PrintDefaults()
 	}
@@ -26,9 +31,17 @@ func main() {
 		log.Fatalf("configuration error: %v\n", err)
 	}
 
-	log.SetPrefix(fmt.Sprintf("[flproxy(%d->%d)] ", config.FromPort, config.ToPort))
+	to := joinTargets(config.targets())
+	if config.Mode == modeForward {
+		to = modeForward
+	}
+	log.SetPrefix(fmt.Sprintf("[flproxy(%s->%s)] ", config.listenEndpoint(), to))
 
-	if err := ListenProxy(config); err != nil {
+	listen := ListenProxy
+	if config.Mode == modeTCP {
+		listen = ListenTCPProxy
+	}
+	if err := listen(config); err != nil {
 		log.Fatalf("failed to listen: %v\n", err)
 	}
 }
@@ -36,6 +49,70 @@ func main() {
 // parseArgs parses command line arguments and returns configuration
 func parseArgs() (*Config, error) {
 	limit := flag.Int64("limit", 10, "concurrent transfer limit")
+	mode := flag.String("mode", modeHTTP, "proxy mode: http, tcp to pipe raw TCP connections, or forward to serve as an HTTP forward proxy (HTTP_PROXY)")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "read PROXY protocol v1/v2 headers from -proxy-protocol-trusted sources on the listener")
+	proxyProtocolTrusted := flag.String("proxy-protocol-trusted", "", "comma separated CIDRs of load balancers whose PROXY protocol headers are trusted")
+	upstreamProxyProtocol := flag.String("upstream-proxy-protocol", "", "send a PROXY protocol header to the upstreams: v1 or v2 (disables upstream keep-alives in http mode)")
+	routesFile := flag.String("routes", "", "JSON file of routes sending requests to their own upstreams by host, path, method and headers (see README)")
+	ipAccessFile := flag.String("ip-access-file", "", "JSON file of client IP allow and deny lists, global or per route, reloaded when it changes (see README)")
+	authAPIKeys := flag.String("auth-api-keys", "", "file of identity:key API keys clients authenticate with (reloaded when it changes)")
+	authAPIKeyHeader := flag.String("auth-api-key-header", "X-Api-Key", "request header carrying the API key")
+	authHtpasswd := flag.String("auth-htpasswd", "", "htpasswd file of users authenticating with Basic authentication (MD5 or SHA-1 hashes, reloaded when it changes)")
+	authJWKS := flag.String("auth-jwks", "", "JWKS file of the public keys bearer JWTs are verified with (reloaded when it changes)")
+	authJWTIssuer := flag.String("auth-jwt-issuer", "", "iss claim required of JWTs (empty accepts any)")
+	authJWTAudience := flag.String("auth-jwt-audience", "", "value required in the aud claim of JWTs (empty accepts any)")
+	clientLimit := flag.Int64("client-limit", 0, "maximum concurrent requests per client, keyed by the authenticated identity or else the client IP; requests over it get 429 (0 means unlimited)")
+	adminListen := flag.String("admin-listen", "", "address of the admin endpoint listing and canceling requests in flight, without authentication; use a private address such as 127.0.0.1:9901 (empty disables it)")
+	accessLog := flag.Bool("access-log", false, "log one line per request with its client, status, size, duration and request ID")
+	serverTiming := flag.Bool("server-timing", false, "add Server-Timing (queue and upstream time) and X-Flproxy-Attempts headers to responses")
+	traceEndpoint := flag.String("otlp-endpoint", "", "base URL of an OTLP/HTTP collector to export traces to as JSON, such as http://localhost:4318 (empty disables tracing)")
+	traceServiceName := flag.String("trace-service-name", "flow-limit-proxy", "service.name of the exported spans")
+	traceSampleRatio := flag.Float64("trace-sample-ratio", 1, "fraction of new traces sampled (0-1); traces started by clients follow their traceparent")
+	forwardAllow := flag.String("forward-allow", "", "comma separated destinations the forward proxy may reach in format host[:port] (* matches any host or port, *.example.com any subdomain)")
+	tcpQueueTimeout := flag.Duration("tcp-queue-timeout", 10*time.Second, "how long TCP connections over -limit wait for a free slot before being closed (0 closes them immediately)")
+	budgetPercent := flag.Float64("retry-budget-percent", 20, "retries allowed as a percentage of recent successful requests")
+	maxRetries := flag.Int("max-retries", 0, "retries allowed per request (0 retries as long as the 10 second backoff allows, -1 disables retries)")
+	budgetMin := flag.Float64("retry-budget-min", 10, "retries always allowed per second")
+	attemptTimeout := flag.Duration("attempt-timeout", 0, "timeout for each upstream attempt until response headers arrive (0 means none)")
+	requestTimeout := flag.Duration("request-timeout", 0, "deadline for the whole request including queue wait and retries (0 means none)")
+	dialTimeout := flag.Duration("dial-timeout", 10*time.Second, "timeout for connecting to the upstream (0 means none)")
+	responseHeaderTimeout := flag.Duration("response-header-timeout", 0, "timeout awaiting upstream response headers (0 means none)")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 10*time.Second, "timeout for reading the headers of a client request (0 means none)")
+	readTimeout := flag.Duration("read-timeout", 0, "timeout for reading a whole client request including its body (0 means none)")
+	writeTimeout := flag.Duration("write-timeout", 0, "timeout for writing a response, counted from the end of the request headers (0 means none)")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "how long idle keep-alive client connections are kept open (0 means none)")
+	maxHeaderBytes := flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "maximum size of the headers of a client request")
+	maxBodyBytes := flag.Int64("max-body-bytes", 0, "maximum size of request bodies; larger ones are rejected with 413 (0 means unlimited)")
+	hedgePercentile := flag.Float64("hedge-percentile", 0, "hedge idempotent GETs slower than this latency percentile (0 disables hedging)")
+	hedgeMaxPercent := flag.Float64("hedge-max-percent", 5, "hedges allowed as a percentage of eligible requests")
+	lbStrategy := flag.String("lb", lbRoundRobin, "load balancing strategy across toPorts: round-robin, least-in-flight, random-two-choices or consistent-hash")
+	lbHashHeader := flag.String("lb-hash-header", "", "request header hashed by the consistent-hash strategy")
+	healthCheckPath := flag.String("health-check-path", "", "path probed on each upstream instance (empty disables health checks)")
+	healthCheckInterval := flag.Duration("health-check-interval", defaultHealthCheckInterval, "interval between health checks")
+	healthCheckTimeout := flag.Duration("health-check-timeout", 2*time.Second, "timeout for a single health check")
+	healthCheckStatus := flag.Int("health-check-status", http.StatusOK, "status code expected from a healthy upstream")
+	healthyThreshold := flag.Int("healthy-threshold", 2, "consecutive successful health checks before an ejected upstream is reinstated")
+	unhealthyThreshold := flag.Int("unhealthy-threshold", 3, "consecutive failed health checks before an upstream is ejected")
+	outlierErrors := flag.Int("outlier-errors", 0, "consecutive failed requests before an upstream is ejected (0 disables outlier detection)")
+	outlierEjectionTime := flag.Duration("outlier-ejection-time", 30*time.Second, "how long an upstream ejected for failed requests stays out of rotation when health checks are disabled")
+	tlsCert := flag.String("tls-cert", "", "certificate file to serve HTTPS with (reloaded when it changes)")
+	tlsKey := flag.String("tls-key", "", "private key file of -tls-cert")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "minimum TLS version accepted: 1.0, 1.1, 1.2 or 1.3")
+	tlsCiphers := flag.String("tls-ciphers", "", "comma separated cipher suites accepted for TLS 1.2 and below (empty means Go's defaults)")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA bundle to verify client certificates against (empty disables client certificate verification)")
+	h2c := flag.Bool("h2c", false, "accept cleartext HTTP/2 (h2c) with prior knowledge on the listener")
+	upstreamHTTP2 := flag.Bool("upstream-http2", false, "speak only HTTP/2 to the upstreams (h2c with prior knowledge over plain HTTP)")
+	grpcMethodLimit := flag.String("grpc-method-limit", "", "comma separated concurrent call limits per gRPC method in format /pkg.Service/Method=N (calls over the limit fail with RESOURCE_EXHAUSTED)")
+	grpcRetryCodes := flag.String("grpc-retry-codes", "UNAVAILABLE", "comma separated gRPC status codes retried when returned by the upstream (empty disables)")
+	upgradeLimit := flag.Int64("upgrade-limit", 0, "maximum number of upgraded connections such as WebSockets, held until they close (0 means unlimited)")
+	upgradeIdleTimeout := flag.Duration("upgrade-idle-timeout", 0, "close upgraded connections without traffic for this long (0 means never)")
+	upgradeMaxLifetime := flag.Duration("upgrade-max-lifetime", 0, "close upgraded connections open for this long (0 means never)")
+	upstreamTLS := flag.Bool("upstream-tls", false, "connect to the upstreams over HTTPS")
+	upstreamCA := flag.String("upstream-ca", "", "CA bundle to verify upstream certificates against (empty uses the system roots)")
+	upstreamCert := flag.String("upstream-cert", "", "client certificate file presented to the upstreams for mutual TLS (reloaded when it changes)")
+	upstreamKey := flag.String("upstream-key", "", "private key file of -upstream-cert")
+	upstreamServerName := flag.String("upstream-server-name", "", "server name sent in SNI and verified against upstream certificates (defaults to localhost)")
+	upstreamInsecure := flag.Bool("upstream-insecure-skip-verify", false, "skip verifying upstream certificates (for development only)")
 	flag.Parse()
 
 	if len(flag.Args()) != 1 {
@@ -43,30 +120,379 @@ func parseArgs() (*Config, error) {
 		os.Exit(1)
 	}
 
-	from, to, err := parsePortString(flag.Arg(0))
+	if err := validateMode(*mode); err != nil {
+		return nil, err
+	}
+
+	var from Endpoint
+	var to []Endpoint
+	var err error
+	if *mode == modeForward {
+		// Destinations come from the requests, so only the listen side is given
+		from, err = parseListenEndpoint(flag.Arg(0))
+	} else {
+		from, to, err = parsePortString(flag.Arg(0))
+	}
 	if err != nil {
 		return nil, fmt.Errorf("invalid port format: %w", err)
 	}
 
-	return NewConfig(from, to, *limit)
+	if *budgetPercent < 0 || *budgetMin < 0 {
+		return nil, fmt.Errorf("retry budget must not be negative")
+	}
+
+	if *attemptTimeout < 0 || *requestTimeout < 0 || *dialTimeout < 0 || *responseHeaderTimeout < 0 || *upgradeIdleTimeout < 0 || *upgradeMaxLifetime < 0 ||
+		*readHeaderTimeout < 0 || *readTimeout < 0 || *writeTimeout < 0 || *idleTimeout < 0 {
+		return nil, fmt.Errorf("timeouts must not be negative")
+	}
+
+	if (*authJWTIssuer != "" || *authJWTAudience != "") && *authJWKS == "" {
+		return nil, fmt.Errorf("-auth-jwt-issuer and -auth-jwt-audience require -auth-jwks")
+	}
+	if *authAPIKeyHeader == "" {
+		return nil, fmt.Errorf("-auth-api-key-header must not be empty")
+	}
+
+	if *maxHeaderBytes <= 0 {
+		return nil, fmt.Errorf("max header bytes must be positive, got %d", *maxHeaderBytes)
+	}
+	if *maxBodyBytes < 0 {
+		return nil, fmt.Errorf("max body bytes must not be negative")
+	}
+
+	if *adminListen != "" {
+		if _, _, err := net.SplitHostPort(*adminListen); err != nil {
+			return nil, fmt.Errorf("invalid admin address %q: %w", *adminListen, err)
+		}
+	}
+	if *traceEndpoint != "" {
+		if err := validateTraceEndpoint(*traceEndpoint); err != nil {
+			return nil, err
+		}
+	}
+	if *traceSampleRatio < 0 || *traceSampleRatio > 1 {
+		return nil, fmt.Errorf("trace sample ratio must be between 0 and 1, got %v", *traceSampleRatio)
+	}
+
+	if *mode == modeTCP {
+		// These options only make sense for HTTP
+		switch {
+		case *healthCheckPath != "":
+			return nil, fmt.Errorf("-health-check-path is not supported in tcp mode")
+		case *tlsCert != "", *upstreamTLS:
+			return nil, fmt.Errorf("TLS is not supported in tcp mode")
+		case *lbStrategy == lbConsistentHash:
+			return nil, fmt.Errorf("the %s strategy is not supported in tcp mode", lbConsistentHash)
+		case *accessLog:
+			return nil, fmt.Errorf("-access-log is not supported in tcp mode")
+		case *adminListen != "":
+			return nil, fmt.Errorf("-admin-listen is not supported in tcp mode")
+		case *traceEndpoint != "":
+			return nil, fmt.Errorf("tracing is not supported in tcp mode")
+		case *serverTiming:
+			return nil, fmt.Errorf("-server-timing is not supported in tcp mode")
+		case *maxBodyBytes > 0:
+			return nil, fmt.Errorf("-max-body-bytes is not supported in tcp mode")
+		case *ipAccessFile != "":
+			return nil, fmt.Errorf("-ip-access-file is not supported in tcp mode")
+		case *authAPIKeys != "", *authHtpasswd != "", *authJWKS != "":
+			return nil, fmt.Errorf("authentication is not supported in tcp mode")
+		case *clientLimit > 0:
+			return nil, fmt.Errorf("-client-limit is not supported in tcp mode")
+		}
+	}
+	if *mode == modeForward {
+		// These options only make sense with fixed upstreams
+		switch {
+		case *healthCheckPath != "":
+			return nil, fmt.Errorf("-health-check-path is not supported in forward mode")
+		case *upstreamTLS, *upstreamHTTP2:
+			return nil, fmt.Errorf("upstream TLS and HTTP/2 are not supported in forward mode")
+		case *lbStrategy == lbConsistentHash:
+			return nil, fmt.Errorf("the %s strategy is not supported in forward mode", lbConsistentHash)
+		case *serverTiming:
+			return nil, fmt.Errorf("-server-timing is not supported in forward mode")
+		case *authAPIKeys != "", *authHtpasswd != "", *authJWKS != "":
+			return nil, fmt.Errorf("authentication is not supported in forward mode")
+		case *forwardAllow == "":
+			return nil, fmt.Errorf("-forward-allow is required in forward mode")
+		}
+	} else if *forwardAllow != "" {
+		return nil, fmt.Errorf("-forward-allow requires -mode=%s", modeForward)
+	}
+	trusted, err := parseCIDRs(*proxyProtocolTrusted)
+	if err != nil {
+		return nil, err
+	}
+	if *proxyProtocol != (len(trusted) > 0) {
+		return nil, fmt.Errorf("-proxy-protocol and -proxy-protocol-trusted must be specified together")
+	}
+	if *proxyProtocol && from.Socket != "" {
+		return nil, fmt.Errorf("PROXY protocol is not supported on unix domain sockets")
+	}
+	if err := validateProxyProtoVersion(*upstreamProxyProtocol); err != nil {
+		return nil, err
+	}
+	if *upstreamProxyProtocol != "" && (*mode == modeForward || *upstreamHTTP2) {
+		return nil, fmt.Errorf("-upstream-proxy-protocol is not supported in forward mode or with -upstream-http2")
+	}
+
+	var routes []Route
+	var defaultRoute *Route
+	if *routesFile != "" {
+		if *mode != modeHTTP {
+			return nil, fmt.Errorf("-routes is only supported in %s mode", modeHTTP)
+		}
+		routes, defaultRoute, err = loadRoutes(*routesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	allow, err := parseForwardAllow(*forwardAllow)
+	if err != nil {
+		return nil, err
+	}
+	if *tcpQueueTimeout < 0 {
+		return nil, fmt.Errorf("tcp queue timeout must not be negative")
+	}
+
+	if *upgradeLimit < 0 {
+		return nil, fmt.Errorf("upgrade limit must not be negative")
+	}
+	if *clientLimit < 0 {
+		return nil, fmt.Errorf("client limit must not be negative")
+	}
+
+	if *hedgePercentile < 0 || *hedgePercentile >= 100 {
+		return nil, fmt.Errorf("hedge percentile must be between 0 and 100, got %v", *hedgePercentile)
+	}
+	if *hedgeMaxPercent < 0 || *hedgeMaxPercent > 100 {
+		return nil, fmt.Errorf("hedge max percent must be between 0 and 100, got %v", *hedgeMaxPercent)
+	}
+
+	if err := validateLBStrategy(*lbStrategy); err != nil {
+		return nil, err
+	}
+	if *lbStrategy == lbConsistentHash && *lbHashHeader == "" {
+		return nil, fmt.Errorf("-lb-hash-header is required by the %s strategy", lbConsistentHash)
+	}
+
+	if *healthCheckPath != "" && !strings.HasPrefix(*healthCheckPath, "/") {
+		return nil, fmt.Errorf("health check path must start with '/', got %q", *healthCheckPath)
+	}
+	if *healthCheckInterval <= 0 || *healthCheckTimeout <= 0 {
+		return nil, fmt.Errorf("health check interval and timeout must be positive")
+	}
+	if *healthyThreshold < 1 || *unhealthyThreshold < 1 || *outlierErrors < 0 || *outlierEjectionTime < 0 {
+		return nil, fmt.Errorf("health check thresholds must be positive")
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return nil, fmt.Errorf("-tls-cert and -tls-key must be specified together")
+	}
+	minVersion, err := parseTLSVersion(*tlsMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := parseCipherSuites(*tlsCiphers)
+	if err != nil {
+		return nil, err
+	}
+
+	if (*upstreamCert == "") != (*upstreamKey == "") {
+		return nil, fmt.Errorf("-upstream-cert and -upstream-key must be specified together")
+	}
+	if !*upstreamTLS && (*upstreamCA != "" || *upstreamCert != "" || *upstreamServerName != "" || *upstreamInsecure) {
+		return nil, fmt.Errorf("upstream TLS options require -upstream-tls")
+	}
+
+	methodLimits, err := parseGRPCMethodLimits(*grpcMethodLimit)
+	if err != nil {
+		return nil, err
+	}
+	retryCodes, err := parseGRPCCodes(*grpcRetryCodes)
+	if err != nil {
+		return nil, err
+	}
+
+	var config *Config
+	if *mode == modeForward {
+		config, err = NewForwardConfig(from, *limit)
+	} else {
+		config, err = NewConfig(from, to, *limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	config.Mode = *mode
+	config.TCPQueueTimeout = *tcpQueueTimeout
+	config.RetryBudgetPercent = *budgetPercent
+	config.RetryBudgetMinPerSec = *budgetMin
+	config.MaxRetries = *maxRetries
+	config.AttemptTimeout = *attemptTimeout
+	config.RequestTimeout = *requestTimeout
+	config.DialTimeout = *dialTimeout
+	config.ResponseHeaderTimeout = *responseHeaderTimeout
+	config.ReadHeaderTimeout = *readHeaderTimeout
+	config.ReadTimeout = *readTimeout
+	config.WriteTimeout = *writeTimeout
+	config.IdleTimeout = *idleTimeout
+	config.MaxHeaderBytes = *maxHeaderBytes
+	config.MaxBodyBytes = *maxBodyBytes
+	config.HedgePercentile = *hedgePercentile
+	config.HedgeMaxPercent = *hedgeMaxPercent
+	config.LBStrategy = *lbStrategy
+	config.LBHashHeader = *lbHashHeader
+	config.HealthCheckPath = *healthCheckPath
+	config.HealthCheckInterval = *healthCheckInterval
+	config.HealthCheckTimeout = *healthCheckTimeout
+	config.HealthCheckStatus = *healthCheckStatus
+	config.HealthyThreshold = *healthyThreshold
+	config.UnhealthyThreshold = *unhealthyThreshold
+	config.OutlierErrors = *outlierErrors
+	config.OutlierEjectionTime = *outlierEjectionTime
+	config.TLSCertFile = *tlsCert
+	config.TLSKeyFile = *tlsKey
+	config.TLSMinVersion = minVersion
+	config.TLSCipherSuites = cipherSuites
+	config.TLSClientCAFile = *tlsClientCA
+	config.H2C = *h2c
+	config.UpstreamHTTP2 = *upstreamHTTP2
+	config.GRPCMethodLimits = methodLimits
+	config.GRPCRetryCodes = retryCodes
+	config.UpgradeLimit = *upgradeLimit
+	config.UpgradeIdleTimeout = *upgradeIdleTimeout
+	config.UpgradeMaxLifetime = *upgradeMaxLifetime
+	config.ForwardAllow = allow
+	config.Routes = routes
+	config.DefaultRoute = defaultRoute
+	config.ProxyProtocol = *proxyProtocol
+	config.ProxyProtocolTrusted = trusted
+	config.UpstreamProxyProtocol = *upstreamProxyProtocol
+	config.AccessLog = *accessLog
+	config.IPAccessFile = *ipAccessFile
+	config.AuthAPIKeysFile = *authAPIKeys
+	config.AuthAPIKeyHeader = *authAPIKeyHeader
+	config.AuthHtpasswdFile = *authHtpasswd
+	config.AuthJWKSFile = *authJWKS
+	config.AuthJWTIssuer = *authJWTIssuer
+	config.AuthJWTAudience = *authJWTAudience
+	config.ClientLimit = *clientLimit
+	config.AdminAddress = *adminListen
+	config.ServerTiming = *serverTiming
+	config.TraceEndpoint = *traceEndpoint
+	config.TraceServiceName = *traceServiceName
+	config.TraceSampleRatio = *traceSampleRatio
+	if *upstreamTLS {
+		// The same settings apply to every target, including those of
+		// routes, unless the routes file gives the target its own
+		setTLS := func(targets []Target) {
+			for i := range targets {
+				if targets[i].TLS != nil {
+					continue
+				}
+				targets[i].TLS = &UpstreamTLS{
+					CAFile:             *upstreamCA,
+					CertFile:           *upstreamCert,
+					KeyFile:            *upstreamKey,
+					ServerName:         *upstreamServerName,
+					InsecureSkipVerify: *upstreamInsecure,
+				}
+			}
+		}
+		setTLS(config.Targets)
+		for i := range config.Routes {
+			setTLS(config.Routes[i].targets)
+		}
+		if config.DefaultRoute != nil {
+			setTLS(config.DefaultRoute.targets)
+		}
+	}
+
+	return config, nil
 }
 
-// parsePortString parses a port string in format "from:to" and returns the port numbers
-func parsePortString(portStr string) (int, int, error) {
-	ports := strings.Split(portStr, ":")
-	if len(ports) != 2 {
-		return 0, 0, fmt.Errorf("invalid port format, expected 'from:to', got '%s'", portStr)
+// parsePortString parses a port string in format "[host:]from:to[,to...]" and returns the endpoints.
+// Each side is either a port or a unix domain socket in format "unix:/path".
+// The listen host is an IP address, with IPv6 in brackets, or "*" for every interface.
+func parsePortString(portStr string) (Endpoint, []Endpoint, error) {
+	// Skip the listen host, or a socket path up to the next colon
+	offset := 0
+	switch first, _, _ := strings.Cut(portStr, ":"); {
+	case strings.HasPrefix(portStr, unixPrefix):
+		offset = len(unixPrefix)
+	case strings.HasPrefix(portStr, "[") && strings.Contains(portStr, "]:"):
+		offset = strings.Index(portStr, "]:") + 2
+	case strings.Count(portStr, ":") >= 2 && !isNumber(first):
+		offset = len(first) + 1
 	}
+	i := strings.Index(portStr[offset:], ":")
+	if i < 0 {
+		return Endpoint{}, nil, fmt.Errorf("invalid port format, expected 'from:to', got '%s'", portStr)
+	}
+	fromStr, toStr := portStr[:offset+i], portStr[offset+i+1:]
 	
-	from, err := strconv.Atoi(ports[0])
+	from, err := parseListenEndpoint(fromStr)
 	if err != nil {
-		return 0, 0, fmt.Errorf("invalid fromPort '%s': %w", ports[0], err)
+		return Endpoint{}, nil, fmt.Errorf("invalid fromPort '%s': %w", fromStr, err)
 	}
 	
-	to, err := strconv.Atoi(ports[1])
-	if err != nil {
-		return 0, 0, fmt.Errorf("invalid toPort '%s': %w", ports[1], err)
+	var to []Endpoint
+	for _, s := range strings.Split(toStr, ",") {
+		e, err := parseEndpoint(s)
+		if err != nil {
+			return Endpoint{}, nil, fmt.Errorf("invalid toPort '%s': %w", s, err)
+		}
+		to = append(to, e)
 	}
 	
 	return from, to, nil
 }
+
+// parseListenEndpoint parses the listen side of a mapping, which may have a host
+func parseListenEndpoint(s string) (Endpoint, error) {
+	if strings.HasPrefix(s, unixPrefix) || !strings.Contains(s, ":") {
+		return parseEndpoint(s)
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	if host == "*" {
+		host = ""
+	}
+	e, err := parseEndpoint(port)
+	e.Host = host
+	return e, err
+}
+
+// isNumber reports whether s is a decimal number
+func isNumber(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// parseEndpoint parses a port or a unix domain socket in format "unix:/path"
+func parseEndpoint(s string) (Endpoint, error) {
+	if path, ok := strings.CutPrefix(s, unixPrefix); ok {
+		if path == "" {
+			return Endpoint{}, fmt.Errorf("empty socket path")
+		}
+		return Endpoint{Socket: path}, nil
+	}
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	return Endpoint{Port: port}, nil
+}
+
+// joinTargets formats targets as a comma separated list for logging
+func joinTargets(targets []Target) string {
+	s := make([]string, len(targets))
+	for i, t := range targets {
+		s[i] = t.String()
+	}
+	return strings.Join(s, ",")
+}
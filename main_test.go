@@ -1,26 +1,106 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"net/http"
+	"net/netip"
 	"os"
+	"reflect"
+	"slices"
 	"testing"
+	"time"
 )
 
 func TestPortParsing(t *testing.T) {
 	tests := []struct {
 		name     string
 		input    string
-		wantFrom int
-		wantTo   int
+		wantFrom Endpoint
+		wantTo   []Endpoint
 		wantErr  bool
 	}{
 		{
 			name:     "valid ports",
 			input:    "8080:9090",
-			wantFrom: 8080,
-			wantTo:   9090,
+			wantFrom: Endpoint{Port: 8080},
+			wantTo:   []Endpoint{{Port: 9090}},
 			wantErr:  false,
 		},
+		{
+			name:     "multiple to ports",
+			input:    "8080:9090,9091,9092",
+			wantFrom: Endpoint{Port: 8080},
+			wantTo:   []Endpoint{{Port: 9090}, {Port: 9091}, {Port: 9092}},
+			wantErr:  false,
+		},
+		{
+			name:     "unix socket to port",
+			input:    "8080:unix:/run/app.sock",
+			wantFrom: Endpoint{Port: 8080},
+			wantTo:   []Endpoint{{Socket: "/run/app.sock"}},
+			wantErr:  false,
+		},
+		{
+			name:     "unix socket on both sides",
+			input:    "unix:/run/flproxy.sock:unix:/run/app.sock,9090",
+			wantFrom: Endpoint{Socket: "/run/flproxy.sock"},
+			wantTo:   []Endpoint{{Socket: "/run/app.sock"}, {Port: 9090}},
+			wantErr:  false,
+		},
+		{
+			name:     "IPv4 listen host",
+			input:    "127.0.0.1:8080:9090",
+			wantFrom: Endpoint{Host: "127.0.0.1", Port: 8080},
+			wantTo:   []Endpoint{{Port: 9090}},
+			wantErr:  false,
+		},
+		{
+			name:     "IPv6 listen host",
+			input:    "[::1]:8080:9090,9091",
+			wantFrom: Endpoint{Host: "::1", Port: 8080},
+			wantTo:   []Endpoint{{Port: 9090}, {Port: 9091}},
+			wantErr:  false,
+		},
+		{
+			name:     "IPv6 wildcard listen host",
+			input:    "[::]:8080:unix:/run/app.sock",
+			wantFrom: Endpoint{Host: "::", Port: 8080},
+			wantTo:   []Endpoint{{Socket: "/run/app.sock"}},
+			wantErr:  false,
+		},
+		{
+			name:     "wildcard listen host",
+			input:    "*:8080:9090",
+			wantFrom: Endpoint{Port: 8080},
+			wantTo:   []Endpoint{{Port: 9090}},
+			wantErr:  false,
+		},
+		{
+			name:    "unclosed IPv6 listen host",
+			input:   "[::1:8080:9090",
+			wantErr: true,
+		},
+		{
+			name:    "IPv6 listen host without port",
+			input:   "[::1]:9090",
+			wantErr: true,
+		},
+		{
+			name:    "empty socket path",
+			input:   "8080:unix:",
+			wantErr: true,
+		},
+		{
+			name:    "unix socket without to port",
+			input:   "unix:/run/flproxy.sock",
+			wantErr: true,
+		},
+		{
+			name:    "empty to port in list",
+			input:   "8080:9090,",
+			wantErr: true,
+		},
 		{
 			name:    "invalid format - no colon",
 			input:   "8080",
@@ -65,17 +145,59 @@ func TestPortParsing(t *testing.T) {
 			}
 			
 			if from != tt.wantFrom {
-				t.Errorf("Expected from port %d, got %d", tt.wantFrom, from)
+				t.Errorf("Expected from port %v, got %v", tt.wantFrom, from)
 			}
 			
-			if to != tt.wantTo {
-				t.Errorf("Expected to port %d, got %d", tt.wantTo, to)
+			if !slices.Equal(to, tt.wantTo) {
+				t.Errorf("Expected to ports %v, got %v", tt.wantTo, to)
 			}
 		})
 	}
 }
 
+// withDefaults returns want with the fields it leaves unset filled with the
+// flag defaults, so that every field is compared against the parsed config
+func withDefaults(want *Config) *Config {
+	c := *want
+	if c.Targets == nil && c.Mode != modeForward {
+		c.Targets = []Target{{Port: c.ToPort}}
+	}
+	orDefault(&c.RetryBudgetPercent, 20)
+	orDefault(&c.RetryBudgetMinPerSec, 10)
+	orDefault(&c.DialTimeout, 10*time.Second)
+	orDefault(&c.HedgeMaxPercent, 5)
+	orDefault(&c.LBStrategy, lbRoundRobin)
+	orDefault(&c.HealthCheckInterval, defaultHealthCheckInterval)
+	orDefault(&c.HealthCheckTimeout, 2*time.Second)
+	orDefault(&c.HealthCheckStatus, http.StatusOK)
+	orDefault(&c.HealthyThreshold, 2)
+	orDefault(&c.UnhealthyThreshold, 3)
+	orDefault(&c.OutlierEjectionTime, 30*time.Second)
+	orDefault(&c.TLSMinVersion, tls.VersionTLS12)
+	orDefault(&c.Mode, modeHTTP)
+	orDefault(&c.TCPQueueTimeout, 10*time.Second)
+	orDefault(&c.TraceServiceName, "flow-limit-proxy")
+	orDefault(&c.TraceSampleRatio, 1)
+	orDefault(&c.ReadHeaderTimeout, 10*time.Second)
+	orDefault(&c.IdleTimeout, 2*time.Minute)
+	orDefault(&c.MaxHeaderBytes, http.DefaultMaxHeaderBytes)
+	orDefault(&c.AuthAPIKeyHeader, "X-Api-Key")
+	if c.GRPCRetryCodes == nil {
+		c.GRPCRetryCodes = []int{grpcUnavailable}
+	}
+	return &c
+}
+
+// orDefault sets *v to def when it is the zero value
+func orDefault[T comparable](v *T, def T) {
+	var zero T
+	if *v == zero {
+		*v = def
+	}
+}
+
 func TestParseArgs(t *testing.T) {
+	routesFile := writeRoutes(t, `{"routes": [{"path_prefix": "/api/", "upstreams": ["9091"]}]}`)
 	tests := []struct {
 		name     string
 		args     []string
@@ -102,6 +224,516 @@ func TestParseArgs(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "valid config with load balancing",
+			args: []string{"cmd", "-lb=consistent-hash", "-lb-hash-header=X-User-ID", "8080:9090,9091"},
+			want: &Config{
+				FromPort:     8080,
+				ToPort:       9090,
+				MaxConns:     10,
+				Targets:      []Target{{Port: 9090}, {Port: 9091}},
+				LBStrategy:   lbConsistentHash,
+				LBHashHeader: "X-User-ID",
+			},
+			wantErr: false,
+		},
+		{
+			name:    "unknown load balancing strategy",
+			args:    []string{"cmd", "-lb=fastest", "8080:9090,9091"},
+			wantErr: true,
+		},
+		{
+			name:    "consistent hash without header",
+			args:    []string{"cmd", "-lb=consistent-hash", "8080:9090,9091"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with health checks",
+			args: []string{"cmd", "-health-check-path=/healthz", "-health-check-interval=5s", "-health-check-timeout=1s", "-health-check-status=204", "-healthy-threshold=1", "-unhealthy-threshold=5", "-outlier-errors=3", "-outlier-ejection-time=1m", "8080:9090"},
+			want: &Config{
+				FromPort:            8080,
+				ToPort:              9090,
+				MaxConns:            10,
+				HealthCheckPath:     "/healthz",
+				HealthCheckInterval: 5 * time.Second,
+				HealthCheckTimeout:  time.Second,
+				HealthCheckStatus:   http.StatusNoContent,
+				HealthyThreshold:    1,
+				UnhealthyThreshold:  5,
+				OutlierErrors:       3,
+				OutlierEjectionTime: time.Minute,
+			},
+			wantErr: false,
+		},
+		{
+			name:    "invalid health check path",
+			args:    []string{"cmd", "-health-check-path=healthz", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with TLS",
+			args: []string{"cmd", "-tls-cert=cert.pem", "-tls-key=key.pem", "-tls-min-version=1.3", "-tls-ciphers=TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "-tls-client-ca=ca.pem", "8080:9090"},
+			want: &Config{
+				FromPort:        8080,
+				ToPort:          9090,
+				MaxConns:        10,
+				TLSCertFile:     "cert.pem",
+				TLSKeyFile:      "key.pem",
+				TLSMinVersion:   tls.VersionTLS13,
+				TLSCipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+				TLSClientCAFile: "ca.pem",
+			},
+			wantErr: false,
+		},
+		{
+			name:    "TLS certificate without key",
+			args:    []string{"cmd", "-tls-cert=cert.pem", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown TLS version",
+			args:    []string{"cmd", "-tls-min-version=2.0", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with listen host",
+			args: []string{"cmd", "[::1]:8080:9090"},
+			want: &Config{
+				FromPort:   8080,
+				ToPort:     9090,
+				MaxConns:   10,
+				ListenHost: "::1",
+			},
+			wantErr: false,
+		},
+		{
+			name:    "listen host is not an IP address",
+			args:    []string{"cmd", "localhost:8080:9090"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with unix sockets",
+			args: []string{"cmd", "unix:/run/flproxy.sock:unix:/run/app.sock"},
+			want: &Config{
+				MaxConns:     10,
+				ListenSocket: "/run/flproxy.sock",
+				Targets:      []Target{{Socket: "/run/app.sock"}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "valid config with HTTP/2",
+			args: []string{"cmd", "-h2c", "-upstream-http2", "8080:9090"},
+			want: &Config{
+				FromPort:      8080,
+				ToPort:        9090,
+				MaxConns:      10,
+				H2C:           true,
+				UpstreamHTTP2: true,
+			},
+			wantErr: false,
+		},
+		{
+			name: "valid config with gRPC",
+			args: []string{"cmd", "-grpc-method-limit=/pkg.Service/Get=5", "-grpc-retry-codes=UNAVAILABLE,ABORTED", "8080:9090"},
+			want: &Config{
+				FromPort:         8080,
+				ToPort:           9090,
+				MaxConns:         10,
+				GRPCMethodLimits: map[string]int64{"/pkg.Service/Get": 5},
+				GRPCRetryCodes:   []int{grpcUnavailable, 10},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "invalid gRPC method limit",
+			args:    []string{"cmd", "-grpc-method-limit=Get=5", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown gRPC status code",
+			args:    []string{"cmd", "-grpc-retry-codes=DOWN", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with upgrade limits",
+			args: []string{"cmd", "-upgrade-limit=50", "-upgrade-idle-timeout=5m", "-upgrade-max-lifetime=24h", "8080:9090"},
+			want: &Config{
+				FromPort:           8080,
+				ToPort:             9090,
+				MaxConns:           10,
+				UpgradeLimit:       50,
+				UpgradeIdleTimeout: 5 * time.Minute,
+				UpgradeMaxLifetime: 24 * time.Hour,
+			},
+			wantErr: false,
+		},
+		{
+			name:    "negative upgrade limit",
+			args:    []string{"cmd", "-upgrade-limit=-1", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with tcp mode",
+			args: []string{"cmd", "-mode=tcp", "-tcp-queue-timeout=3s", "5432:15432"},
+			want: &Config{
+				FromPort:        5432,
+				ToPort:          15432,
+				MaxConns:        10,
+				Mode:            modeTCP,
+				TCPQueueTimeout: 3 * time.Second,
+			},
+			wantErr: false,
+		},
+		{
+			name:    "unknown mode",
+			args:    []string{"cmd", "-mode=udp", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with forward mode",
+			args: []string{"cmd", "-mode=forward", "-forward-allow=api.example.com:443,*.internal", "-limit=2", "3128"},
+			want: &Config{
+				FromPort:     3128,
+				MaxConns:     2,
+				Mode:         modeForward,
+				ForwardAllow: []string{"api.example.com:443", "*.internal"},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "forward mode without allow list",
+			args:    []string{"cmd", "-mode=forward", "3128"},
+			wantErr: true,
+		},
+		{
+			name:    "forward mode with upstreams",
+			args:    []string{"cmd", "-mode=forward", "-forward-allow=*", "3128:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "allow list without forward mode",
+			args:    []string{"cmd", "-forward-allow=*", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with PROXY protocol",
+			args: []string{"cmd", "-proxy-protocol", "-proxy-protocol-trusted=10.0.0.0/8,192.168.0.1", "-upstream-proxy-protocol=v2", "8080:9090"},
+			want: &Config{
+				FromPort:              8080,
+				ToPort:                9090,
+				MaxConns:              10,
+				ProxyProtocol:         true,
+				ProxyProtocolTrusted:  []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.168.0.1/32")},
+				UpstreamProxyProtocol: proxyProtoV2,
+			},
+			wantErr: false,
+		},
+		{
+			name:    "PROXY protocol without trusted sources",
+			args:    []string{"cmd", "-proxy-protocol", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown upstream PROXY protocol version",
+			args:    []string{"cmd", "-upstream-proxy-protocol=v3", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with routes",
+			args: []string{"cmd", "-routes=" + routesFile, "-max-retries=-1", "8080:9090"},
+			want: &Config{
+				FromPort:   8080,
+				ToPort:     9090,
+				MaxConns:   10,
+				MaxRetries: -1,
+				Routes:     []Route{{Name: "route1", PathPrefix: "/api/", Upstreams: []RouteUpstream{{Address: "9091"}}}},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "missing routes file",
+			args:    []string{"cmd", "-routes=/nonexistent/routes.json", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "routes in tcp mode",
+			args:    []string{"cmd", "-mode=tcp", "-routes=" + routesFile, "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with access log",
+			args: []string{"cmd", "-access-log", "8080:9090"},
+			want: &Config{
+				FromPort:  8080,
+				ToPort:    9090,
+				MaxConns:  10,
+				AccessLog: true,
+			},
+			wantErr: false,
+		},
+		{
+			name: "valid config with tracing",
+			args: []string{"cmd", "-otlp-endpoint=http://localhost:4318", "-trace-sample-ratio=0.5", "8080:9090"},
+			want: &Config{
+				FromPort:         8080,
+				ToPort:           9090,
+				MaxConns:         10,
+				TraceEndpoint:    "http://localhost:4318",
+				TraceServiceName: "flow-limit-proxy",
+				TraceSampleRatio: 0.5,
+			},
+			wantErr: false,
+		},
+		{
+			name:    "invalid OTLP endpoint",
+			args:    []string{"cmd", "-otlp-endpoint=localhost:4318", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid trace sample ratio",
+			args:    []string{"cmd", "-otlp-endpoint=http://localhost:4318", "-trace-sample-ratio=2", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "tracing in tcp mode",
+			args:    []string{"cmd", "-mode=tcp", "-otlp-endpoint=http://localhost:4318", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with server timing",
+			args: []string{"cmd", "-server-timing", "8080:9090"},
+			want: &Config{
+				FromPort:     8080,
+				ToPort:       9090,
+				MaxConns:     10,
+				ServerTiming: true,
+			},
+			wantErr: false,
+		},
+		{
+			name:    "server timing in forward mode",
+			args:    []string{"cmd", "-mode=forward", "-forward-allow=*", "-server-timing", "3128"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with admin endpoint",
+			args: []string{"cmd", "-admin-listen=127.0.0.1:9901", "8080:9090"},
+			want: &Config{
+				FromPort:     8080,
+				ToPort:       9090,
+				MaxConns:     10,
+				AdminAddress: "127.0.0.1:9901",
+			},
+			wantErr: false,
+		},
+		{
+			name:    "invalid admin address",
+			args:    []string{"cmd", "-admin-listen=9901", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "admin endpoint in tcp mode",
+			args:    []string{"cmd", "-mode=tcp", "-admin-listen=127.0.0.1:9901", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "access log in tcp mode",
+			args:    []string{"cmd", "-mode=tcp", "-access-log", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "health check in tcp mode",
+			args:    []string{"cmd", "-mode=tcp", "-health-check-path=/healthz", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with upstream TLS",
+			args: []string{"cmd", "-upstream-tls", "-upstream-ca=ca.pem", "-upstream-cert=client.pem", "-upstream-key=client-key.pem", "-upstream-server-name=backend.internal", "8080:9090,9091"},
+			want: &Config{
+				FromPort: 8080,
+				ToPort:   9090,
+				MaxConns: 10,
+				Targets: []Target{
+					{Port: 9090, TLS: &UpstreamTLS{CAFile: "ca.pem", CertFile: "client.pem", KeyFile: "client-key.pem", ServerName: "backend.internal"}},
+					{Port: 9091, TLS: &UpstreamTLS{CAFile: "ca.pem", CertFile: "client.pem", KeyFile: "client-key.pem", ServerName: "backend.internal"}},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "upstream client certificate without key",
+			args:    []string{"cmd", "-upstream-tls", "-upstream-cert=client.pem", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "upstream TLS option without -upstream-tls",
+			args:    []string{"cmd", "-upstream-insecure-skip-verify", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with retry budget",
+			args: []string{"cmd", "-retry-budget-percent=50", "-retry-budget-min=1", "8080:9090"},
+			want: &Config{
+				FromPort:             8080,
+				ToPort:               9090,
+				MaxConns:             10,
+				RetryBudgetPercent:   50,
+				RetryBudgetMinPerSec: 1,
+			},
+			wantErr: false,
+		},
+		{
+			name:    "negative retry budget",
+			args:    []string{"cmd", "-retry-budget-percent=-1", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with timeouts",
+			args: []string{"cmd", "-attempt-timeout=2s", "-request-timeout=15s", "-dial-timeout=1s", "-response-header-timeout=5s", "8080:9090"},
+			want: &Config{
+				FromPort:              8080,
+				ToPort:                9090,
+				MaxConns:              10,
+				AttemptTimeout:        2 * time.Second,
+				RequestTimeout:        15 * time.Second,
+				DialTimeout:           time.Second,
+				ResponseHeaderTimeout: 5 * time.Second,
+			},
+			wantErr: false,
+		},
+		{
+			name:    "negative timeout",
+			args:    []string{"cmd", "-request-timeout=-1s", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with server limits",
+			args: []string{"cmd", "-read-header-timeout=3s", "-read-timeout=30s", "-write-timeout=1m", "-idle-timeout=90s", "-max-header-bytes=8192", "-max-body-bytes=1048576", "8080:9090"},
+			want: &Config{
+				FromPort:          8080,
+				ToPort:            9090,
+				MaxConns:          10,
+				ReadHeaderTimeout: 3 * time.Second,
+				ReadTimeout:       30 * time.Second,
+				WriteTimeout:      time.Minute,
+				IdleTimeout:       90 * time.Second,
+				MaxHeaderBytes:    8192,
+				MaxBodyBytes:      1 << 20,
+			},
+			wantErr: false,
+		},
+		{
+			name:    "negative read header timeout",
+			args:    []string{"cmd", "-read-header-timeout=-1s", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "zero max header bytes",
+			args:    []string{"cmd", "-max-header-bytes=0", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "negative max body bytes",
+			args:    []string{"cmd", "-max-body-bytes=-1", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with IP access file",
+			args: []string{"cmd", "-ip-access-file=ip-access.json", "8080:9090"},
+			want: &Config{
+				FromPort:     8080,
+				ToPort:       9090,
+				MaxConns:     10,
+				IPAccessFile: "ip-access.json",
+			},
+			wantErr: false,
+		},
+		{
+			name:    "IP access file in tcp mode",
+			args:    []string{"cmd", "-mode=tcp", "-ip-access-file=ip-access.json", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with authentication",
+			args: []string{"cmd", "-auth-api-keys=api-keys.txt", "-auth-api-key-header=Authorization-Key", "-auth-htpasswd=.htpasswd", "-auth-jwks=jwks.json", "-auth-jwt-issuer=https://issuer.example.com", "-auth-jwt-audience=flproxy", "8080:9090"},
+			want: &Config{
+				FromPort:         8080,
+				ToPort:           9090,
+				MaxConns:         10,
+				AuthAPIKeysFile:  "api-keys.txt",
+				AuthAPIKeyHeader: "Authorization-Key",
+				AuthHtpasswdFile: ".htpasswd",
+				AuthJWKSFile:     "jwks.json",
+				AuthJWTIssuer:    "https://issuer.example.com",
+				AuthJWTAudience:  "flproxy",
+			},
+			wantErr: false,
+		},
+		{
+			name: "valid config with client limit",
+			args: []string{"cmd", "-auth-api-keys=api-keys.txt", "-client-limit=4", "8080:9090"},
+			want: &Config{
+				FromPort:        8080,
+				ToPort:          9090,
+				MaxConns:        10,
+				AuthAPIKeysFile: "api-keys.txt",
+				ClientLimit:     4,
+			},
+			wantErr: false,
+		},
+		{
+			name:    "negative client limit",
+			args:    []string{"cmd", "-client-limit=-1", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "client limit in tcp mode",
+			args:    []string{"cmd", "-mode=tcp", "-client-limit=4", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "JWT issuer without JWKS",
+			args:    []string{"cmd", "-auth-jwt-issuer=https://issuer.example.com", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "empty API key header",
+			args:    []string{"cmd", "-auth-api-keys=api-keys.txt", "-auth-api-key-header=", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "authentication in tcp mode",
+			args:    []string{"cmd", "-mode=tcp", "-auth-htpasswd=.htpasswd", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name:    "authentication in forward mode",
+			args:    []string{"cmd", "-mode=forward", "-forward-allow=api.example.com:443", "-auth-api-keys=api-keys.txt", "3128"},
+			wantErr: true,
+		},
+		{
+			name:    "max body bytes in tcp mode",
+			args:    []string{"cmd", "-mode=tcp", "-max-body-bytes=1024", "8080:9090"},
+			wantErr: true,
+		},
+		{
+			name: "valid config with hedging",
+			args: []string{"cmd", "-hedge-percentile=95", "-hedge-max-percent=10", "8080:9090"},
+			want: &Config{
+				FromPort:        8080,
+				ToPort:          9090,
+				MaxConns:        10,
+				HedgePercentile: 95,
+				HedgeMaxPercent: 10,
+			},
+			wantErr: false,
+		},
+		{
+			name:    "invalid hedge percentile",
+			args:    []string{"cmd", "-hedge-percentile=100", "8080:9090"},
+			wantErr: true,
+		},
 		{
 			name:    "invalid port format",
 			args:    []string{"cmd", "8080"},
@@ -137,20 +769,264 @@ func TestParseArgs(t *testing.T) {
 				t.Errorf("Unexpected error for args %v: %v", tt.args, err)
 				return
 			}
+			want := withDefaults(tt.want)
+			
+			if got.FromPort != want.FromPort {
+				t.Errorf("Expected FromPort %d, got %d", want.FromPort, got.FromPort)
+			}
+			
+			if got.ListenHost != want.ListenHost {
+				t.Errorf("Expected ListenHost %q, got %q", want.ListenHost, got.ListenHost)
+			}
+			
+			if got.ListenSocket != want.ListenSocket {
+				t.Errorf("Expected ListenSocket %q, got %q", want.ListenSocket, got.ListenSocket)
+			}
+			
+			if got.ToPort != want.ToPort {
+				t.Errorf("Expected ToPort %d, got %d", want.ToPort, got.ToPort)
+			}
+			
+			if got.MaxConns != want.MaxConns {
+				t.Errorf("Expected MaxConns %d, got %d", want.MaxConns, got.MaxConns)
+			}
+			
+			if !reflect.DeepEqual(got.Targets, want.Targets) {
+				t.Errorf("Expected Targets %v, got %v", want.Targets, got.Targets)
+			}
+			
+			if got.LBStrategy != want.LBStrategy {
+				t.Errorf("Expected LBStrategy %q, got %q", want.LBStrategy, got.LBStrategy)
+			}
+			
+			if got.LBHashHeader != want.LBHashHeader {
+				t.Errorf("Expected LBHashHeader %q, got %q", want.LBHashHeader, got.LBHashHeader)
+			}
+			
+			if got.HealthCheckPath != want.HealthCheckPath {
+				t.Errorf("Expected HealthCheckPath %q, got %q", want.HealthCheckPath, got.HealthCheckPath)
+			}
+			
+			if got.HealthCheckInterval != want.HealthCheckInterval {
+				t.Errorf("Expected HealthCheckInterval %v, got %v", want.HealthCheckInterval, got.HealthCheckInterval)
+			}
+			
+			if got.OutlierErrors != want.OutlierErrors {
+				t.Errorf("Expected OutlierErrors %d, got %d", want.OutlierErrors, got.OutlierErrors)
+			}
+			
+			if got.HealthCheckTimeout != want.HealthCheckTimeout || got.HealthCheckStatus != want.HealthCheckStatus || got.HealthyThreshold != want.HealthyThreshold || got.UnhealthyThreshold != want.UnhealthyThreshold {
+				t.Errorf("Expected health check timeout/status/thresholds %v/%d/%d/%d, got %v/%d/%d/%d", want.HealthCheckTimeout, want.HealthCheckStatus, want.HealthyThreshold, want.UnhealthyThreshold, got.HealthCheckTimeout, got.HealthCheckStatus, got.HealthyThreshold, got.UnhealthyThreshold)
+			}
+			
+			if got.OutlierEjectionTime != want.OutlierEjectionTime {
+				t.Errorf("Expected OutlierEjectionTime %v, got %v", want.OutlierEjectionTime, got.OutlierEjectionTime)
+			}
+			
+			if got.TLSCertFile != want.TLSCertFile {
+				t.Errorf("Expected TLSCertFile %q, got %q", want.TLSCertFile, got.TLSCertFile)
+			}
+			
+			if got.TLSKeyFile != want.TLSKeyFile {
+				t.Errorf("Expected TLSKeyFile %q, got %q", want.TLSKeyFile, got.TLSKeyFile)
+			}
+			
+			if got.TLSMinVersion != want.TLSMinVersion {
+				t.Errorf("Expected TLSMinVersion %x, got %x", want.TLSMinVersion, got.TLSMinVersion)
+			}
+			
+			if !slices.Equal(got.TLSCipherSuites, want.TLSCipherSuites) || got.TLSClientCAFile != want.TLSClientCAFile {
+				t.Errorf("Expected TLS ciphers %v and client CA %q, got %v and %q", want.TLSCipherSuites, want.TLSClientCAFile, got.TLSCipherSuites, got.TLSClientCAFile)
+			}
+			
+			if !reflect.DeepEqual(got.GRPCMethodLimits, want.GRPCMethodLimits) {
+				t.Errorf("Expected GRPCMethodLimits %v, got %v", want.GRPCMethodLimits, got.GRPCMethodLimits)
+			}
+			
+			if !slices.Equal(got.GRPCRetryCodes, want.GRPCRetryCodes) {
+				t.Errorf("Expected GRPCRetryCodes %v, got %v", want.GRPCRetryCodes, got.GRPCRetryCodes)
+			}
+			
+			if got.UpgradeLimit != want.UpgradeLimit {
+				t.Errorf("Expected UpgradeLimit %d, got %d", want.UpgradeLimit, got.UpgradeLimit)
+			}
+			
+			if got.UpgradeIdleTimeout != want.UpgradeIdleTimeout {
+				t.Errorf("Expected UpgradeIdleTimeout %v, got %v", want.UpgradeIdleTimeout, got.UpgradeIdleTimeout)
+			}
+			
+			if got.UpgradeMaxLifetime != want.UpgradeMaxLifetime {
+				t.Errorf("Expected UpgradeMaxLifetime %v, got %v", want.UpgradeMaxLifetime, got.UpgradeMaxLifetime)
+			}
+			
+			if got.Mode != want.Mode {
+				t.Errorf("Expected Mode %q, got %q", want.Mode, got.Mode)
+			}
+			
+			if got.TCPQueueTimeout != want.TCPQueueTimeout {
+				t.Errorf("Expected TCPQueueTimeout %v, got %v", want.TCPQueueTimeout, got.TCPQueueTimeout)
+			}
+			
+			if got.ProxyProtocol != want.ProxyProtocol || !slices.Equal(got.ProxyProtocolTrusted, want.ProxyProtocolTrusted) {
+				t.Errorf("Expected PROXY protocol from %v, got %t %v", want.ProxyProtocolTrusted, got.ProxyProtocol, got.ProxyProtocolTrusted)
+			}
+			
+			if got.UpstreamProxyProtocol != want.UpstreamProxyProtocol {
+				t.Errorf("Expected UpstreamProxyProtocol %q, got %q", want.UpstreamProxyProtocol, got.UpstreamProxyProtocol)
+			}
+			
+			if got.MaxRetries != want.MaxRetries {
+				t.Errorf("Expected MaxRetries %d, got %d", want.MaxRetries, got.MaxRetries)
+			}
+			
+			if len(want.Routes) != len(got.Routes) {
+				t.Errorf("Expected %d routes, got %d", len(want.Routes), len(got.Routes))
+			}
+			for i := range min(len(want.Routes), len(got.Routes)) {
+				if w, g := want.Routes[i], got.Routes[i]; g.Name != w.Name || g.PathPrefix != w.PathPrefix || !reflect.DeepEqual(g.Upstreams, w.Upstreams) {
+					t.Errorf("Expected route %+v, got %+v", w, g)
+				}
+			}
+			
+			if !slices.Equal(got.ForwardAllow, want.ForwardAllow) {
+				t.Errorf("Expected ForwardAllow %v, got %v", want.ForwardAllow, got.ForwardAllow)
+			}
 			
-			if got.FromPort != tt.want.FromPort {
-				t.Errorf("Expected FromPort %d, got %d", tt.want.FromPort, got.FromPort)
+			if got.TraceEndpoint != want.TraceEndpoint || got.TraceServiceName != want.TraceServiceName || got.TraceSampleRatio != want.TraceSampleRatio {
+				t.Errorf("Expected tracing to %q as %q at %v, got %q as %q at %v", want.TraceEndpoint, want.TraceServiceName, want.TraceSampleRatio, got.TraceEndpoint, got.TraceServiceName, got.TraceSampleRatio)
 			}
 			
-			if got.ToPort != tt.want.ToPort {
-				t.Errorf("Expected ToPort %d, got %d", tt.want.ToPort, got.ToPort)
+			if got.AdminAddress != want.AdminAddress {
+				t.Errorf("Expected AdminAddress %q, got %q", want.AdminAddress, got.AdminAddress)
 			}
 			
-			if got.MaxConns != tt.want.MaxConns {
-				t.Errorf("Expected MaxConns %d, got %d", tt.want.MaxConns, got.MaxConns)
+			if got.ServerTiming != want.ServerTiming {
+				t.Errorf("Expected ServerTiming %t, got %t", want.ServerTiming, got.ServerTiming)
+			}
+			
+			if got.AccessLog != want.AccessLog {
+				t.Errorf("Expected AccessLog %t, got %t", want.AccessLog, got.AccessLog)
+			}
+			
+			if got.H2C != want.H2C {
+				t.Errorf("Expected H2C %t, got %t", want.H2C, got.H2C)
+			}
+			
+			if got.UpstreamHTTP2 != want.UpstreamHTTP2 {
+				t.Errorf("Expected UpstreamHTTP2 %t, got %t", want.UpstreamHTTP2, got.UpstreamHTTP2)
+			}
+			
+			if got.RetryBudgetPercent != want.RetryBudgetPercent {
+				t.Errorf("Expected RetryBudgetPercent %v, got %v", want.RetryBudgetPercent, got.RetryBudgetPercent)
+			}
+			
+			if got.RetryBudgetMinPerSec != want.RetryBudgetMinPerSec {
+				t.Errorf("Expected RetryBudgetMinPerSec %v, got %v", want.RetryBudgetMinPerSec, got.RetryBudgetMinPerSec)
+			}
+			
+			if got.AttemptTimeout != want.AttemptTimeout {
+				t.Errorf("Expected AttemptTimeout %v, got %v", want.AttemptTimeout, got.AttemptTimeout)
+			}
+			
+			if got.RequestTimeout != want.RequestTimeout {
+				t.Errorf("Expected RequestTimeout %v, got %v", want.RequestTimeout, got.RequestTimeout)
+			}
+			
+			if got.DialTimeout != want.DialTimeout {
+				t.Errorf("Expected DialTimeout %v, got %v", want.DialTimeout, got.DialTimeout)
+			}
+			
+			if got.ResponseHeaderTimeout != want.ResponseHeaderTimeout {
+				t.Errorf("Expected ResponseHeaderTimeout %v, got %v", want.ResponseHeaderTimeout, got.ResponseHeaderTimeout)
+			}
+			
+			if got.ReadHeaderTimeout != want.ReadHeaderTimeout || got.ReadTimeout != want.ReadTimeout || got.WriteTimeout != want.WriteTimeout || got.IdleTimeout != want.IdleTimeout {
+				t.Errorf("Expected server timeouts %v/%v/%v/%v, got %v/%v/%v/%v", want.ReadHeaderTimeout, want.ReadTimeout, want.WriteTimeout, want.IdleTimeout, got.ReadHeaderTimeout, got.ReadTimeout, got.WriteTimeout, got.IdleTimeout)
+			}
+			
+			if got.MaxHeaderBytes != want.MaxHeaderBytes {
+				t.Errorf("Expected MaxHeaderBytes %d, got %d", want.MaxHeaderBytes, got.MaxHeaderBytes)
+			}
+			
+			if got.IPAccessFile != want.IPAccessFile {
+				t.Errorf("Expected IPAccessFile %q, got %q", want.IPAccessFile, got.IPAccessFile)
+			}
+			
+			if got.AuthAPIKeysFile != want.AuthAPIKeysFile || got.AuthHtpasswdFile != want.AuthHtpasswdFile || got.AuthJWKSFile != want.AuthJWKSFile {
+				t.Errorf("Expected auth files %q/%q/%q, got %q/%q/%q", want.AuthAPIKeysFile, want.AuthHtpasswdFile, want.AuthJWKSFile, got.AuthAPIKeysFile, got.AuthHtpasswdFile, got.AuthJWKSFile)
+			}
+			
+			if got.AuthAPIKeyHeader != want.AuthAPIKeyHeader {
+				t.Errorf("Expected AuthAPIKeyHeader %q, got %q", want.AuthAPIKeyHeader, got.AuthAPIKeyHeader)
+			}
+			
+			if got.AuthJWTIssuer != want.AuthJWTIssuer || got.AuthJWTAudience != want.AuthJWTAudience {
+				t.Errorf("Expected JWT issuer/audience %q/%q, got %q/%q", want.AuthJWTIssuer, want.AuthJWTAudience, got.AuthJWTIssuer, got.AuthJWTAudience)
+			}
+			
+			if got.ClientLimit != want.ClientLimit {
+				t.Errorf("Expected ClientLimit %d, got %d", want.ClientLimit, got.ClientLimit)
+			}
+			
+			if got.MaxBodyBytes != want.MaxBodyBytes {
+				t.Errorf("Expected MaxBodyBytes %d, got %d", want.MaxBodyBytes, got.MaxBodyBytes)
+			}
+			
+			if got.HedgePercentile != want.HedgePercentile {
+				t.Errorf("Expected HedgePercentile %v, got %v", want.HedgePercentile, got.HedgePercentile)
+			}
+			
+			if got.HedgeMaxPercent != want.HedgeMaxPercent {
+				t.Errorf("Expected HedgeMaxPercent %v, got %v", want.HedgeMaxPercent, got.HedgeMaxPercent)
 			}
 		})
 	}
 }
 
 
+
+func TestParseArgsRouteUpstreamTLS(t *testing.T) {
+	routesFile := writeRoutes(t, `{"routes": [{"upstreams": ["9091", {"address": "9443", "tls": {"ca": "backend-ca.pem"}}]}]}`)
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantCAs []string // CA file of each route target, "-" for plain HTTP
+	}{
+		{
+			name:    "route target TLS only",
+			args:    []string{"cmd", "-routes=" + routesFile, "8080:9090"},
+			wantCAs: []string{"-", "backend-ca.pem"},
+		},
+		{
+			name:    "command line TLS for the other targets",
+			args:    []string{"cmd", "-routes=" + routesFile, "-upstream-tls", "-upstream-ca=ca.pem", "8080:9090"},
+			wantCAs: []string{"ca.pem", "backend-ca.pem"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flag.CommandLine = flag.NewFlagSet(tt.args[0], flag.ContinueOnError)
+			oldArgs := os.Args
+			os.Args = tt.args
+			defer func() { os.Args = oldArgs }()
+			
+			got, err := parseArgs()
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var cas []string
+			for _, target := range got.Routes[0].targets {
+				if target.TLS == nil {
+					cas = append(cas, "-")
+				} else {
+					cas = append(cas, target.TLS.CAFile)
+				}
+			}
+			if !slices.Equal(cas, tt.wantCAs) {
+				t.Errorf("Expected target CAs %v, got %v", tt.wantCAs, cas)
+			}
+		})
+	}
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
-	"os"
-	"os/signal"
-	"syscall"
+	"slices"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
@@ -20,27 +24,193 @@ import (
 // Config holds the proxy configuration
 type Config struct {
 	FromPort   uint  // Source port to listen on (1-65535)
-	ToPort     uint  // Target port to forward requests to (1-65535)
+	ToPort     uint  // Target port to forward requests to (1-65535); the first of Targets
 	MaxConns   int64 // Maximum number of concurrent connections
+
+	Mode            string        // Proxy mode: http (default), tcp or forward
+	TCPQueueTimeout time.Duration // How long excess TCP connections wait for a slot (0 rejects them immediately)
+
+	ListenHost   string // IP address to listen on (empty listens on every interface)
+	ListenSocket string // Unix domain socket to listen on instead of FromPort
+
+	ProxyProtocol         bool           // Read PROXY protocol v1/v2 headers from trusted sources on the listener
+	ProxyProtocolTrusted  []netip.Prefix // Sources whose PROXY protocol headers are trusted
+	UpstreamProxyProtocol string         // PROXY protocol version sent to the upstreams (v1 or v2, empty sends none)
+
+	Targets      []Target // Upstream instances requests are balanced across
+	Routes       []Route  // Routing table; requests go to the first matching route (empty sends every request to Targets)
+	DefaultRoute *Route   // Route for requests matching no route (nil answers 404)
+	RouteName    string   // Name of the route this proxy serves, used by header rule templates
+	LBStrategy   string   // Load balancing strategy (round-robin, least-in-flight, random-two-choices, consistent-hash)
+	LBHashHeader string   // Request header hashed by the consistent-hash strategy
+
+	RetryBudgetPercent   float64 // Retries allowed as a percentage of recent successful requests
+	RetryBudgetMinPerSec float64 // Retries always allowed per second regardless of traffic
+	MaxRetries           int     // Retries allowed per request (0 means as many as fit in the backoff, negative disables retries)
+
+	MaxBodyBytes int64 // Maximum size of request bodies (0 means unlimited)
+
+	RequestHeaders  *HeaderRules // Rules applied to the headers of requests sent to the upstreams
+	ResponseHeaders *HeaderRules // Rules applied to the headers of responses sent to the clients
+
+	AttemptTimeout        time.Duration // Timeout for a single upstream attempt, until response headers arrive
+	RequestTimeout        time.Duration // Deadline for the whole request, including queue wait and all retries
+	DialTimeout           time.Duration // Timeout for connecting to the upstream
+	ResponseHeaderTimeout time.Duration // Timeout awaiting response headers once the request is written
+
+	ReadHeaderTimeout time.Duration // Timeout for reading the headers of a client request (0 means none)
+	ReadTimeout       time.Duration // Timeout for reading a whole client request including its body (0 means none)
+	WriteTimeout      time.Duration // Timeout for writing a response, from the end of the request headers (0 means none)
+	IdleTimeout       time.Duration // How long idle keep-alive connections of the clients are kept (0 means none)
+	MaxHeaderBytes    int           // Maximum size of the headers of a client request
+
+	HedgePercentile float64 // Latency percentile after which idempotent GETs are hedged (0 disables hedging)
+	HedgeMaxPercent float64 // Hedges allowed as a percentage of eligible requests
+
+	HealthCheckPath     string        // Path probed on each upstream instance (empty disables health checks)
+	HealthCheckInterval time.Duration // Interval between health checks
+	HealthCheckTimeout  time.Duration // Timeout for a single health check
+	HealthCheckStatus   int           // Status code expected from a healthy instance
+	HealthyThreshold    int           // Consecutive successful checks before an ejected instance is reinstated
+	UnhealthyThreshold  int           // Consecutive failed checks before an instance is ejected
+	OutlierErrors       int           // Consecutive failed requests before an instance is ejected (0 disables outlier detection)
+	OutlierEjectionTime time.Duration // How long an outlier stays ejected when health checks are disabled
+
+	TLSCertFile     string   // Certificate served by the listener (enables HTTPS together with TLSKeyFile)
+	TLSKeyFile      string   // Private key of TLSCertFile
+	TLSMinVersion   uint16   // Minimum TLS version accepted by the listener (defaults to TLS 1.2)
+	TLSCipherSuites []uint16 // Cipher suites accepted by the listener (defaults to Go's defaults)
+	TLSClientCAFile string   // CA bundle client certificates must be signed by (empty disables client verification)
+
+	H2C           bool // Accept cleartext HTTP/2 (h2c) with prior knowledge on the listener
+	UpstreamHTTP2 bool // Speak only HTTP/2 to the upstreams, using h2c over plain HTTP
+
+	GRPCMethodLimits map[string]int64 // Concurrent calls allowed per gRPC method ("/pkg.Service/Method")
+	GRPCRetryCodes   []int            // gRPC status codes retried when the upstream returns them
+
+	UpgradeLimit       int64         // Maximum number of upgraded connections such as WebSockets (0 means unlimited)
+	UpgradeIdleTimeout time.Duration // Close upgraded connections idle for this long (0 means never)
+	UpgradeMaxLifetime time.Duration // Close upgraded connections open for this long (0 means never)
+
+	ForwardAllow []string // Destinations the forward proxy may reach, in format "host[:port]" with wildcards
+
+	IPAccessFile string // JSON file of the client IP allow and deny lists, reloaded when it changes (empty allows every client)
+
+	AuthAPIKeysFile  string // File of "identity:key" API keys (empty disables API key authentication)
+	AuthAPIKeyHeader string // Request header carrying the API key
+	AuthHtpasswdFile string // htpasswd file for Basic authentication (empty disables it)
+	AuthJWKSFile     string // JWKS file bearer JWTs are validated against (empty disables JWT authentication)
+	AuthJWTIssuer    string // iss required of JWTs (empty accepts any)
+	AuthJWTAudience  string // Value required in the aud of JWTs (empty accepts any)
+	ClientLimit      int64  // Maximum concurrent requests per client, by identity or else IP (0 means unlimited)
+
+	AdminAddress string // Address of the admin endpoint listing and canceling requests in flight (empty disables it)
+	AccessLog    bool   // Log one line per request
+	ServerTiming bool   // Add Server-Timing and X-Flproxy-Attempts headers to responses
+
+	TraceEndpoint    string  // Base URL of the OTLP/HTTP collector spans are exported to (empty disables tracing)
+	TraceServiceName string  // service.name of the exported spans
+	TraceSampleRatio float64 // Fraction of new traces sampled; traces started by clients follow their sampled flag
+}
+
+// Target is an upstream instance requests are forwarded to
+type Target struct {
+	Port   uint         // Port on localhost (1-65535)
+	Socket string       // Unix domain socket of the instance, used instead of Port when set
+	TLS    *UpstreamTLS // HTTPS settings of the instance (nil uses plain HTTP)
+}
+
+func (t Target) String() string {
+	return Endpoint{Port: int(t.Port), Socket: t.Socket}.String()
+}
+
+// Endpoint is one side of a port mapping: a port, or a unix domain socket
+// when Socket is set. Host is only used on the listen side.
+type Endpoint struct {
+	Host   string
+	Port   int
+	Socket string
+}
+
+func (e Endpoint) String() string {
+	if e.Socket != "" {
+		return unixPrefix + e.Socket
+	}
+	if e.Host != "" {
+		return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+	}
+	return strconv.Itoa(e.Port)
+}
+
+// validate validates the port and host, or that the socket path is not empty
+func (e Endpoint) validate() error {
+	if e.Socket != "" {
+		return nil
+	}
+	if e.Host != "" {
+		if _, err := netip.ParseAddr(e.Host); err != nil {
+			return fmt.Errorf("host must be an IP address, got %q", e.Host)
+		}
+	}
+	return validatePort(e.Port)
 }
 
 // NewConfig creates a new Config with validation
-func NewConfig(fromPort, toPort int, limit int64) (*Config, error) {
-	if err := validatePort(fromPort); err != nil {
+func NewConfig(from Endpoint, to []Endpoint, limit int64) (*Config, error) {
+	if err := from.validate(); err != nil {
 		return nil, fmt.Errorf("invalid fromPort: %w", err)
 	}
 	
-	if err := validatePort(toPort); err != nil {
-		return nil, fmt.Errorf("invalid toPort: %w", err)
+	if len(to) == 0 {
+		return nil, fmt.Errorf("at least one toPort is required")
+	}
+	
+	targets := make([]Target, 0, len(to))
+	for _, e := range to {
+		if err := e.validate(); err != nil {
+			return nil, fmt.Errorf("invalid toPort: %w", err)
+		}
+		if e.Host != "" {
+			return nil, fmt.Errorf("invalid toPort: upstreams are always on localhost, got host %q", e.Host)
+		}
+		targets = append(targets, Target{Port: uint(e.Port), Socket: e.Socket})
 	}
 	
 	return &Config{
-		FromPort: uint(fromPort),
-		ToPort:   uint(toPort),
-		MaxConns: limit,
+		FromPort:     uint(from.Port),
+		ToPort:       targets[0].Port,
+		MaxConns:     limit,
+		ListenHost:   from.Host,
+		ListenSocket: from.Socket,
+		Targets:      targets,
 	}, nil
 }
 
+// listenEndpoint returns the endpoint the proxy listens on
+func (c *Config) listenEndpoint() Endpoint {
+	return Endpoint{Host: c.ListenHost, Port: int(c.FromPort), Socket: c.ListenSocket}
+}
+
+// routeNames returns the names of the routes, including the default route
+func (c *Config) routeNames() []string {
+	var names []string
+	for _, r := range c.Routes {
+		names = append(names, r.Name)
+	}
+	if c.DefaultRoute != nil {
+		names = append(names, c.DefaultRoute.Name)
+	}
+	return names
+}
+
+// targets returns the upstream instances, falling back to ToPort when Targets is empty
+func (c *Config) targets() []Target {
+	if len(c.Targets) == 0 {
+		return []Target{{Port: c.ToPort}}
+	}
+	return c.Targets
+}
+
 // validatePort validates that a port number is within the valid range
 func validatePort(port int) error {
 	if port < 1 || port > 65535 {
@@ -50,90 +220,386 @@ func validatePort(port int) error {
 }
 
 func ListenProxy(config *Config) error {
-	proxy, err := newReverseProxy(config.ToPort, config.MaxConns)
+	var filter *ipFilter
+	if config.IPAccessFile != "" {
+		f, err := newIPFilter(config.IPAccessFile, config.routeNames())
+		if err != nil {
+			return fmt.Errorf("failed to load IP access lists: %w", err)
+		}
+		filter = f
+	}
+	auth, err := newAuthenticator(config)
 	if err != nil {
-		return fmt.Errorf("failed to new proxy: %w", err)
+		return fmt.Errorf("failed to load credentials: %w", err)
 	}
-	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", config.FromPort),
-		Handler: proxy,
+	var proxy http.Handler
+	closeProxy := func() {}
+	if config.Mode == modeForward {
+		proxy = newForwardProxy(config)
+	} else if len(config.Routes) > 0 || config.DefaultRoute != nil {
+		rt, err := newRouter(config)
+		if err != nil {
+			return fmt.Errorf("failed to new router: %w", err)
+		}
+		rt.filter = filter
+		proxy = rt
+		closeProxy = rt.close
+	} else {
+		rp, err := newReverseProxy(config)
+		if err != nil {
+			return fmt.Errorf("failed to new proxy: %w", err)
+		}
+		proxy = rp
+		closeProxy = func() { closeReverseProxy(rp) }
+	}
+	// 同時通信数の制御より前に、認証とクライアントのIPアドレスで拒否する
+	if limits := newClientLimiter(config.ClientLimit); limits != nil {
+		proxy = &clientLimitHandler{next: proxy, limits: limits}
+	}
+	if auth != nil {
+		proxy = &authHandler{next: proxy, auth: auth}
+	}
+	if filter != nil {
+		proxy = &ipFilterHandler{next: proxy, filter: filter}
 	}
+	tlsConfig, err := newServerTLSConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to configure TLS: %w", err)
+	}
+	ln, err := listen(config)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	tracer := newTracer(config)
+	var requests *inflightRegistry
+	var admin *adminServer
+	if config.AdminAddress != "" {
+		requests = newInflightRegistry()
+		admin = startAdmin(config.AdminAddress, newAdminHandler(requests))
+	}
+	srv := newServer(config, newRequestIDHandler(proxy, config.AccessLog, tracer, requests), tlsConfig)
 
 	// graceful shutdown
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, os.Interrupt)
-	go func() {
-		<-quit
+	go handleSignals(ln, func() {
 		ctx := context.Background()
 		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 		defer cancel()
 		if err := srv.Shutdown(ctx); err != nil {
 			log.Printf("failed to gracefully shutdown: %v\n", err)
 		}
-	}()
+		admin.shutdown(ctx)
+	})
 
-	log.Printf("start proxy...(limit:%d)", config.MaxConns)
-	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+	log.Printf("start proxy...(limit:%d, tls:%t, h2c:%t)", config.MaxConns, tlsConfig != nil, config.H2C)
+	notifyReady()
+	if tlsConfig != nil {
+		// 証明書はTLSConfig.GetCertificateから読み込む
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
 		return fmt.Errorf("failed to ListenAndServ: %w", err)
 	}
+	closeProxy()
+	ctx, cancel := context.WithTimeout(context.Background(), traceExportTimeout)
+	defer cancel()
+	tracer.shutdown(ctx)
 	log.Printf("shutdown")
 
 	return nil
 }
 
-func newReverseProxy(targetPort uint, limit int64) (*httputil.ReverseProxy, error) {
-	target, err := url.Parse(fmt.Sprintf("http://localhost:%d", targetPort))
+// newServer creates the HTTP server of the listener. With HTTP/2, each stream
+// is a separate request, so the concurrency limit counts streams.
+func newServer(config *Config, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	srv := &http.Server{
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		Protocols:         newServerProtocols(config),
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+	if config.UpstreamProxyProtocol != "" {
+		srv.ConnContext = withClientConn
+	}
+	return srv
+}
+
+// listen opens the listener on the configured host and port or unix domain socket
+func listen(config *Config) (net.Listener, error) {
+	// A listener passed by systemd socket activation or an upgrade comes first
+	ln, err := inheritedListener()
+	switch {
+	case err != nil:
+		return nil, err
+	case ln == nil && config.ListenSocket != "":
+		ln, err = listenUnix(config.ListenSocket)
+	case ln == nil:
+		ln, err = net.Listen("tcp", net.JoinHostPort(config.ListenHost, strconv.FormatUint(uint64(config.FromPort), 10)))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.ProxyProtocol {
+		ln = newProxyProtoListener(ln, config.ProxyProtocolTrusted)
+	}
+	return ln, nil
+}
+
+func newReverseProxy(config *Config) (*httputil.ReverseProxy, error) {
+	target, err := url.Parse(fmt.Sprintf("http://localhost:%d", config.ToPort))
 	if err != nil {
 		return nil, err
 	}
 	proxy := httputil.NewSingleHostReverseProxy(target)
-	proxy.Transport = newCustomTransport(limit)
-	proxy.ErrorHandler = func(_ http.ResponseWriter, r *http.Request, err error) {
-		log.Printf("fail request: %s %s: %v", r.Method, r.URL, err)
+	transport, err := newCustomTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	proxy.Transport = transport
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		setForwardedHeaders(req)
+		director(req)
+		config.RequestHeaders.apply(req.Header, headerVars(req, config.RouteName))
+		// Removing X-Forwarded-For keeps the reverse proxy from adding it back
+		if config.RequestHeaders != nil && slices.Contains(config.RequestHeaders.Remove, "X-Forwarded-For") {
+			req.Header["X-Forwarded-For"] = nil
+		}
+	}
+	if config.ResponseHeaders != nil {
+		proxy.ModifyResponse = func(res *http.Response) error {
+			config.ResponseHeaders.apply(res.Header, headerVars(res.Request, config.RouteName))
+			return nil
+		}
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if cause := context.Cause(r.Context()); errors.Is(cause, errCanceledByAdmin) {
+			err = cause
+		}
+		log.Printf("fail request: %s %s: %v (request_id:%s)", r.Method, r.URL, err, requestIDFromContext(r.Context()))
+		// gRPC clients expect the error as a gRPC status
+		if isGRPC(r) {
+			writeGRPCError(w, err)
+			return
+		}
+		w.WriteHeader(errorStatus(err))
 	}
 
 	return proxy, nil
 }
 
+// closeReverseProxy stops the health checks of a proxy created by newReverseProxy
+func closeReverseProxy(proxy *httputil.ReverseProxy) {
+	proxy.Transport.(*customTransport).close()
+}
+
+// errorStatus returns the HTTP status code reported to the client for a failed request.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, errIPDenied):
+		return http.StatusForbidden
+	case errors.Is(err, errBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errClientLimitExceeded):
+		return http.StatusTooManyRequests
+	case isTimeout(err):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, errNoHealthyUpstream), errors.Is(err, errUpgradeLimitExceeded), errors.Is(err, errCanceledByAdmin):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
 // customTransport は、プロキシするHTTP通信を制御するための構造体です。
 // 以下の機能を持ちます。
 // - 同時通信数の制御
 // - 通信エラー時のリトライ
+// 上流インスタンスの選択、ヘルスチェック、リトライバジェット、ヘッジなどは
+// balancer、healthChecker、retryBudget、hedgerなど各フィールドの型が受け持ちます。
 type customTransport struct {
-	base http.RoundTripper
-	sem  *semaphore.Weighted
+	base     http.RoundTripper
+	sem      *semaphore.Weighted
+	budget   *retryBudget
+	hedge    *hedger
+	balancer *balancer
+	health   *healthChecker
+	grpc     *grpcPolicy
+	upgrade  *upgradeLimiter
+
+	maxRetries   int
+	maxBodyBytes int64 // Request bodies over this size are rejected (see limitBody)
+	serverTiming bool  // Report the queue wait and upstream time (see setServerTiming)
+
+	attemptTimeout        time.Duration // Per attempt, until response headers arrive (see attempt)
+	requestTimeout        time.Duration // Covers the queue wait and every retry (see newRequestContext)
+	responseHeaderTimeout time.Duration // Per attempt, until response headers arrive (see attempt)
 }
 
-func newCustomTransport(concurrentLimit int64) http.RoundTripper {
-	return &customTransport{
-		base: http.DefaultTransport,
-		sem:  semaphore.NewWeighted(concurrentLimit),
+func newCustomTransport(config *Config) (http.RoundTripper, error) {
+	base := newBaseTransport(config)
+	balancer, err := newBalancer(config, base)
+	if err != nil {
+		return nil, err
+	}
+	t := &customTransport{
+		base:                  base,
+		sem:                   semaphore.NewWeighted(config.MaxConns),
+		budget:                newRetryBudget(config.RetryBudgetPercent, config.RetryBudgetMinPerSec),
+		hedge:                 newHedger(config.HedgePercentile, config.HedgeMaxPercent),
+		balancer:              balancer,
+		health:                newHealthChecker(config),
+		grpc:                  newGRPCPolicy(config),
+		upgrade:               newUpgradeLimiter(config),
+		maxRetries:            config.MaxRetries,
+		maxBodyBytes:          config.MaxBodyBytes,
+		serverTiming:          config.ServerTiming,
+		attemptTimeout:        config.AttemptTimeout,
+		requestTimeout:        config.RequestTimeout,
+		responseHeaderTimeout: config.ResponseHeaderTimeout,
 	}
+	t.health.start(t.balancer.upstreams)
+	return t, nil
+}
+
+// close stops the background health checks of the upstreams
+func (t *customTransport) close() {
+	t.health.close()
 }
 
 func (t *customTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	// 同時通信数の制御
-	if err := t.sem.Acquire(req.Context(), 1); err != nil {
+	// Content-Lengthが上限を超えていたら、枠を使わずにすぐ拒否する
+	// 長さが分からないボディは、上限を超えたところで打ち切る
+	if err := limitBody(req, t.maxBodyBytes); err != nil {
+		return nil, err
+	}
+	// リクエスト全体の期限（同時通信数の待ちとすべてのリトライを含む）
+	ctx, cancel := newRequestContext(req.Context(), t.requestTimeout)
+	// gRPCのメソッドごとの上限は、待たずにすぐ拒否する
+	// 上限の枠はストリームが終わるまで保持する
+	release, err := t.grpc.acquire(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// アップグレードした接続の枠は、トンネルが閉じるまで保持する
+	releaseUpgrade, err := t.upgrade.acquire(req)
+	if err != nil {
+		release()
+		cancel()
+		return nil, err
+	}
+	res, err := t.roundTrip(req.WithContext(ctx))
+	if err != nil {
+		releaseUpgrade()
+		release()
+		cancel()
+		return nil, err
+	}
+	t.upgrade.watch(res)
+	inflightFromContext(req.Context()).setState(stateResponding)
+	onBodyClose(res, func() {
+		releaseUpgrade()
+		release()
+		cancel()
+	})
+	return res, nil
+}
+
+func (t *customTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	// 正常なインスタンスがなければ、待たずにすぐ失敗させる
+	if !t.balancer.available() {
+		return nil, errNoHealthyUpstream
+	}
+
+	// 同時通信数の制御（待ち時間をスパンに記録する）
+	inflight := inflightFromContext(req.Context())
+	inflight.setState(stateQueued)
+	waitStart := time.Now()
+	_, wait := startSpan(req.Context(), "queue wait", spanKindInternal)
+	err := t.sem.Acquire(req.Context(), 1)
+	wait.finish(err)
+	queue := time.Since(waitStart)
+	if err != nil {
+		if cause := timeoutCause(req.Context(), err); cause != err {
+			return nil, cause
+		}
 		return nil, fmt.Errorf("failed to acquire semaphore: %v", err)
 	}
 	defer t.sem.Release(1)
 
 	// 指数バックオフしながらリクエストを送る
+	// リトライ時は直前に失敗したインスタンス以外を優先する
+	// gRPCのリクエストボディは、リトライで送り直せるよう記録する
+	body := t.grpc.replayableBody(req)
 	var res *http.Response
+	var failed *upstream
 	tryCount := 0
-	err := backoff.Retry(func() error {
+	upstreamStart := time.Now()
+	err = backoff.Retry(func() error {
 		tryCount++
 		var err error
-		res, err = t.base.RoundTrip(req)
+		u := t.balancer.pick(req, failed)
+		if u == nil {
+			return backoff.Permanent(errNoHealthyUpstream)
+		}
+		inflight.setAttempt(tryCount)
+		// 試行ごとにスパンを作り、上流にはこのスパンをtraceparentで伝える
+		ctx, span := startSpan(req.Context(), "upstream attempt", spanKindClient)
+		span.setAttr("flproxy.retry", tryCount-1)
+		span.setAttr("flproxy.upstream", u.target.String())
+		defer func() { span.finish(err) }()
+		outreq := req.WithContext(ctx)
+		if body != nil {
+			if !body.canReplay() {
+				return backoff.Permanent(errBodyNotReplayable)
+			}
+			outreq.Body = body.newReader()
+			outreq.GetBody = func() (io.ReadCloser, error) { return body.newReader(), nil }
+		}
+		res, err = t.hedgedAttempt(outreq, u)
+		if res != nil {
+			span.setAttr("http.response.status_code", res.StatusCode)
+		}
 		// エラーのときだけリトライ。errがnilでステータスコード500は成功とみなす。
+		// gRPCはgrpc-statusがリトライ対象のコードならリトライする。
+		if err == nil {
+			err = t.grpc.checkStatus(req, res)
+		}
 		if err != nil {
-			log.Printf("retry%d: %s %s", tryCount, req.Method, req.URL)
+			failed = u
+			// リクエストが取り消されていたら、ボディが上限を超えていたらリトライしない
+			if errors.Is(context.Cause(req.Context()), errCanceledByAdmin) || errors.Is(err, errBodyTooLarge) {
+				return backoff.Permanent(err)
+			}
+			// リトライ回数の上限に達していたらエラーを返す
+			if t.maxRetries < 0 || (t.maxRetries > 0 && tryCount > t.maxRetries) {
+				return backoff.Permanent(err)
+			}
+			// バジェットを使い切っていたらリトライせずにエラーを返す
+			if !t.budget.withdraw() {
+				log.Printf("retry budget exhausted: %s %s (request_id:%s)", req.Method, req.URL, requestIDFromContext(req.Context()))
+				return backoff.Permanent(err)
+			}
+			log.Printf("retry%d: %s %s (request_id:%s)", tryCount, req.Method, req.URL, requestIDFromContext(req.Context()))
+			inflight.setState(stateRetrying)
 			return err
 		}
+		t.budget.deposit()
 		return nil
-	}, newBackOffConfig())
+	}, backoff.WithContext(newBackOffConfig(), req.Context()))
 	if err != nil {
-		return nil, err
+		return nil, timeoutCause(req.Context(), err)
+	}
+	// 待ち時間と上流での時間（リトライを含む）をレスポンスヘッダーで返す
+	if t.serverTiming {
+		setServerTiming(res, queue, time.Since(upstreamStart), tryCount)
 	}
 
 	return res, nil
@@ -145,3 +611,36 @@ func newBackOffConfig() *backoff.ExponentialBackOff {
 	config.MaxElapsedTime = 10 * time.Second
 	return config
 }
+
+// onBodyClose arranges for fn to be called once, after the response body is
+// closed. The body of a 101 Switching Protocols response keeps implementing
+// io.ReadWriteCloser so that httputil.ReverseProxy can still tunnel it.
+func onBodyClose(res *http.Response, fn func()) {
+	body := &hookedBody{ReadCloser: res.Body, fn: fn}
+	if rwc, ok := res.Body.(io.ReadWriteCloser); ok && res.StatusCode == http.StatusSwitchingProtocols {
+		res.Body = &hookedReadWriteBody{hookedBody: body, w: rwc}
+		return
+	}
+	res.Body = body
+}
+
+type hookedBody struct {
+	io.ReadCloser
+	once sync.Once
+	fn   func()
+}
+
+func (b *hookedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.fn)
+	return err
+}
+
+type hookedReadWriteBody struct {
+	*hookedBody
+	w io.Writer
+}
+
+func (b *hookedReadWriteBody) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
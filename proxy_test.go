@@ -3,17 +3,22 @@ package main
 import (
 	"context"
 	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestNewReverseProxy(t *testing.T) {
-	proxy, err := newReverseProxy(8080, 10)
+	proxy, err := newReverseProxy(&Config{ToPort: 8080, MaxConns: 10})
 	if err != nil {
 		t.Fatalf("newReverseProxy failed: %v", err)
 	}
@@ -32,7 +37,7 @@ func TestNewReverseProxy(t *testing.T) {
 }
 
 func TestNewCustomTransport(t *testing.T) {
-	transport := newCustomTransport(5)
+	transport := newTestTransport(t, &Config{MaxConns: 5})
 	
 	if transport == nil {
 		t.Fatal("Expected non-nil transport")
@@ -61,7 +66,7 @@ func TestCustomTransportRoundTrip(t *testing.T) {
 	defer server.Close()
 	
 	// Create custom transport
-	transport := newCustomTransport(1)
+	transport := newTestTransport(t, &Config{ToPort: serverPort(t, server), MaxConns: 1})
 	
 	// Create test request
 	req, err := http.NewRequest("GET", server.URL, nil)
@@ -90,7 +95,7 @@ func TestCustomTransportConcurrentLimit(t *testing.T) {
 	defer server.Close()
 	
 	// Create transport with limit of 2
-	transport := newCustomTransport(2)
+	transport := newTestTransport(t, &Config{ToPort: serverPort(t, server), MaxConns: 2})
 	
 	// Create multiple requests
 	requests := make([]*http.Request, 5)
@@ -159,7 +164,7 @@ func TestCustomTransportRetry(t *testing.T) {
 	}))
 	defer server.Close()
 	
-	transport := newCustomTransport(1)
+	transport := newTestTransport(t, &Config{ToPort: serverPort(t, server), MaxConns: 1})
 	
 	req, err := http.NewRequest("GET", server.URL, nil)
 	if err != nil {
@@ -228,14 +233,8 @@ func TestReverseProxyIntegration(t *testing.T) {
 	}))
 	defer targetServer.Close()
 	
-	// Parse target URL to get port
-	_, err := url.Parse(targetServer.URL)
-	if err != nil {
-		t.Fatalf("Failed to parse target URL: %v", err)
-	}
-	
 	// Create reverse proxy pointing to target server
-	proxy, err := newReverseProxy(8080, 10) // Port doesn't matter for this test
+	proxy, err := newReverseProxy(&Config{ToPort: serverPort(t, targetServer), MaxConns: 10})
 	if err != nil {
 		t.Fatalf("Failed to create reverse proxy: %v", err)
 	}
@@ -252,11 +251,16 @@ func TestReverseProxyIntegration(t *testing.T) {
 	}
 	defer resp.Body.Close()
 	
-	// Note: This test will fail because we're not actually forwarding to the target server
-	// In a real integration test, you'd need to set up proper port forwarding
-	// For now, we just verify the proxy handles the request without crashing
-	if resp.StatusCode != http.StatusBadGateway && resp.StatusCode != http.StatusOK {
-		t.Logf("Response status: %d (expected in test environment)", resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+	
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response body: %v", err)
+	}
+	if string(body) != "target response" {
+		t.Errorf("Expected body %q, got %q", "target response", body)
 	}
 }
 
@@ -268,7 +272,7 @@ func TestContextCancellation(t *testing.T) {
 	}))
 	defer server.Close()
 	
-	transport := newCustomTransport(1)
+	transport := newTestTransport(t, &Config{ToPort: serverPort(t, server), MaxConns: 1})
 	
 	// Create request with cancelled context
 	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
@@ -351,38 +355,140 @@ func TestValidatePort(t *testing.T) {
 	}
 }
 
+func TestListenHost(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     string
+		wantHost string
+	}{
+		{name: "IPv4", host: "127.0.0.1", wantHost: "127.0.0.1"},
+		{name: "IPv6", host: "::1", wantHost: "::1"},
+		{name: "wildcard", host: "", wantHost: "::"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Port 0 picks a free port
+			ln, err := listen(&Config{ListenHost: tt.host})
+			if err != nil {
+				t.Skipf("Cannot listen on %q: %v", tt.host, err)
+			}
+			defer ln.Close()
+
+			addr := ln.Addr().(*net.TCPAddr)
+			if !addr.IP.Equal(net.ParseIP(tt.wantHost)) {
+				t.Errorf("Expected listener on %s, got %s", tt.wantHost, addr.IP)
+			}
+		})
+	}
+}
+
 func TestNewConfig(t *testing.T) {
 	tests := []struct {
 		name     string
-		fromPort int
-		toPort   int
+		from     Endpoint
+		to       []Endpoint
 		limit    int64
 		want     *Config
 		wantErr  bool
 	}{
 		{
 			name:     "valid config",
-			fromPort: 8080,
-			toPort:   9090,
+			from:     Endpoint{Port: 8080},
+			to:       []Endpoint{{Port: 9090}},
 			limit:    10,
 			want: &Config{
 				FromPort: 8080,
 				ToPort:   9090,
 				MaxConns: 10,
+				Targets:  []Target{{Port: 9090}},
+			},
+			wantErr: false,
+		},
+		{
+			name:     "multiple toPorts",
+			from:     Endpoint{Port: 8080},
+			to:       []Endpoint{{Port: 9090}, {Port: 9091}},
+			limit:    10,
+			want: &Config{
+				FromPort: 8080,
+				ToPort:   9090,
+				MaxConns: 10,
+				Targets:  []Target{{Port: 9090}, {Port: 9091}},
+			},
+			wantErr: false,
+		},
+		{
+			name:     "IPv4 listen host",
+			from:     Endpoint{Host: "127.0.0.1", Port: 8080},
+			to:       []Endpoint{{Port: 9090}},
+			limit:    10,
+			want: &Config{
+				FromPort:   8080,
+				ToPort:     9090,
+				MaxConns:   10,
+				ListenHost: "127.0.0.1",
+				Targets:    []Target{{Port: 9090}},
+			},
+			wantErr: false,
+		},
+		{
+			name:     "IPv6 listen host",
+			from:     Endpoint{Host: "::1", Port: 8080},
+			to:       []Endpoint{{Port: 9090}},
+			limit:    10,
+			want: &Config{
+				FromPort:   8080,
+				ToPort:     9090,
+				MaxConns:   10,
+				ListenHost: "::1",
+				Targets:    []Target{{Port: 9090}},
+			},
+			wantErr: false,
+		},
+		{
+			name:     "invalid listen host",
+			from:     Endpoint{Host: "example.com", Port: 8080},
+			to:       []Endpoint{{Port: 9090}},
+			limit:    10,
+			wantErr:  true,
+		},
+		{
+			name:     "host on toPort",
+			from:     Endpoint{Port: 8080},
+			to:       []Endpoint{{Host: "10.0.0.1", Port: 9090}},
+			limit:    10,
+			wantErr:  true,
+		},
+		{
+			name:     "unix sockets",
+			from:     Endpoint{Socket: "/run/flproxy.sock"},
+			to:       []Endpoint{{Socket: "/run/app.sock"}},
+			limit:    10,
+			want: &Config{
+				MaxConns:     10,
+				ListenSocket: "/run/flproxy.sock",
+				Targets:      []Target{{Socket: "/run/app.sock"}},
 			},
 			wantErr: false,
 		},
 		{
 			name:     "invalid fromPort",
-			fromPort: 0,
-			toPort:   8080,
+			from:     Endpoint{Port: 0},
+			to:       []Endpoint{{Port: 8080}},
 			limit:    10,
 			wantErr:  true,
 		},
 		{
 			name:     "invalid toPort",
-			fromPort: 8080,
-			toPort:   65536,
+			from:     Endpoint{Port: 8080},
+			to:       []Endpoint{{Port: 65536}},
+			limit:    10,
+			wantErr:  true,
+		},
+		{
+			name:     "no toPorts",
+			from:     Endpoint{Port: 8080},
 			limit:    10,
 			wantErr:  true,
 		},
@@ -390,22 +496,30 @@ func TestNewConfig(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := NewConfig(tt.fromPort, tt.toPort, tt.limit)
+			got, err := NewConfig(tt.from, tt.to, tt.limit)
 			
 			if tt.wantErr {
 				if err == nil {
-					t.Errorf("Expected error for NewConfig(%d, %d, %d), but got none", 
-						tt.fromPort, tt.toPort, tt.limit)
+					t.Errorf("Expected error for NewConfig(%v, %v, %d), but got none", 
+						tt.from, tt.to, tt.limit)
 				}
 				return
 			}
 			
 			if err != nil {
-				t.Errorf("Unexpected error for NewConfig(%d, %d, %d): %v", 
-					tt.fromPort, tt.toPort, tt.limit, err)
+				t.Errorf("Unexpected error for NewConfig(%v, %v, %d): %v", 
+					tt.from, tt.to, tt.limit, err)
 				return
 			}
 			
+			if got.ListenHost != tt.want.ListenHost {
+				t.Errorf("Expected ListenHost %q, got %q", tt.want.ListenHost, got.ListenHost)
+			}
+			
+			if got.ListenSocket != tt.want.ListenSocket {
+				t.Errorf("Expected ListenSocket %q, got %q", tt.want.ListenSocket, got.ListenSocket)
+			}
+			
 			if got.FromPort != tt.want.FromPort {
 				t.Errorf("Expected FromPort %d, got %d", tt.want.FromPort, got.FromPort)
 			}
@@ -417,20 +531,24 @@ func TestNewConfig(t *testing.T) {
 			if got.MaxConns != tt.want.MaxConns {
 				t.Errorf("Expected MaxConns %d, got %d", tt.want.MaxConns, got.MaxConns)
 			}
+			
+			if !slices.Equal(got.Targets, tt.want.Targets) {
+				t.Errorf("Expected Targets %v, got %v", tt.want.Targets, got.Targets)
+			}
 		})
 	}
 }
 
 func TestSemaphoreContextCancellation(t *testing.T) {
-	// Create a transport with limit of 1
-	transport := newCustomTransport(1)
-	
 	// Create a server that responds quickly
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	}))
 	defer server.Close()
 	
+	// Create a transport with limit of 1
+	transport := newTestTransport(t, &Config{ToPort: serverPort(t, server), MaxConns: 1})
+	
 	
 	// Start first request in a goroutine and hold it
 	done := make(chan struct{})
@@ -481,3 +599,63 @@ func TestSemaphoreContextCancellation(t *testing.T) {
 	// Wait for the first goroutine to complete
 	<-done
 }
+
+// serverPort returns the port the test server is listening on
+func serverPort(t *testing.T, server *httptest.Server) uint {
+	t.Helper()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse server URL: %v", err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatalf("Failed to parse server port: %v", err)
+	}
+	return uint(port)
+}
+
+// newTestTransport creates a customTransport and fails the test on error
+func newTestTransport(t *testing.T, config *Config) http.RoundTripper {
+	t.Helper()
+	transport, err := newCustomTransport(config)
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	return transport
+}
+
+func TestCustomTransportMaxRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		wantCalls  int32
+	}{
+		{name: "retries disabled", maxRetries: -1, wantCalls: 1},
+		{name: "two retries", maxRetries: 2, wantCalls: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				// Fail every attempt with a connection error
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.Close()
+			}))
+			defer server.Close()
+
+			transport := newTestTransport(t, &Config{ToPort: serverPort(t, server), MaxConns: 1, MaxRetries: tt.maxRetries})
+			req, _ := http.NewRequest("GET", server.URL, nil)
+			if _, err := transport.RoundTrip(req); err == nil {
+				t.Fatal("Expected error when every attempt fails")
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("Expected %d calls, got %d", tt.wantCalls, got)
+			}
+		})
+	}
+}
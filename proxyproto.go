@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol versions sent to the upstreams
+const (
+	proxyProtoV1 = "v1"
+	proxyProtoV2 = "v2"
+)
+
+// proxyProtoHeaderTimeout is how long a trusted source has to send its PROXY
+// protocol header. Connections without one are served with their own address.
+const proxyProtoHeaderTimeout = 5 * time.Second
+
+// proxyProtoV2Sig starts every PROXY protocol v2 header
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoV1MaxLen is the longest valid v1 header, including CRLF
+const proxyProtoV1MaxLen = 107
+
+// validateProxyProtoVersion validates the PROXY protocol version name
+func validateProxyProtoVersion(version string) error {
+	switch version {
+	case "", proxyProtoV1, proxyProtoV2:
+		return nil
+	}
+	return fmt.Errorf("unknown PROXY protocol version %q, expected %s or %s", version, proxyProtoV1, proxyProtoV2)
+}
+
+// parseCIDRs parses a comma separated list of CIDRs. A bare IP address is
+// taken as a single address.
+func parseCIDRs(s string) ([]netip.Prefix, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(s, ",") {
+		prefix, err := parseCIDR(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// parseCIDR parses a CIDR, or a bare IP address taken as a single address
+func parseCIDR(s string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+	}
+	return prefix.Masked(), nil
+}
+
+// containsAddr reports whether addr is a TCP address within one of prefixes
+func containsAddr(prefixes []netip.Prefix, addr net.Addr) bool {
+	ap, ok := addrPort(addr)
+	if !ok {
+		return false
+	}
+	for _, prefix := range prefixes {
+		if prefix.Contains(ap.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrPort returns the address of a TCP connection end, with IPv4-mapped IPv6
+// addresses unmapped
+func addrPort(addr net.Addr) (netip.AddrPort, bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	ap := tcpAddr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
+
+// proxyProtoListener reads PROXY protocol headers from connections of trusted
+// sources, so that their RemoteAddr is the original client. Connections of
+// other sources are returned as is, and any header they send is not parsed.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []netip.Prefix
+}
+
+func newProxyProtoListener(ln net.Listener, trusted []netip.Prefix) net.Listener {
+	return &proxyProtoListener{Listener: ln, trusted: trusted}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !containsAddr(l.trusted, conn.RemoteAddr()) {
+		return conn, nil
+	}
+	// The header is read on first use, so that a slow source does not block Accept
+	return &proxyProtoConn{Conn: conn, br: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtoConn is a connection from a trusted source. Its addresses are the
+// ones in the PROXY protocol header, if any.
+type proxyProtoConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	once     sync.Once
+	src, dst net.Addr
+	err      error
+}
+
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtoHeaderTimeout))
+		c.src, c.dst, c.err = readProxyHeader(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Printf("invalid PROXY protocol header from %s: %v", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite keeps half-close working in tcp mode
+func (c *proxyProtoConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header. It returns nil
+// addresses when there is no header, or when the header does not carry TCP
+// addresses, such as health checks of the load balancer.
+func readProxyHeader(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// The client waits for the server to speak first
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	switch first[0] {
+	case 'P':
+		if prefix, _ := br.Peek(6); string(prefix) == "PROXY " {
+			return readProxyHeaderV1(br)
+		}
+	case proxyProtoV2Sig[0]:
+		if prefix, _ := br.Peek(len(proxyProtoV2Sig)); bytes.Equal(prefix, proxyProtoV2Sig) {
+			return readProxyHeaderV2(br)
+		}
+	}
+	return nil, nil, nil
+}
+
+// readProxyHeaderV1 reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func readProxyHeaderV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	line, err := br.ReadSlice('\n')
+	if err != nil || len(line) > proxyProtoV1MaxLen || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("malformed v1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddr(ip, port string) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+// readProxyHeaderV2 reads a binary v2 header. TLVs after the addresses are skipped.
+func readProxyHeaderV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(br, fixed); err != nil {
+		return nil, nil, fmt.Errorf("malformed v2 header: %w", err)
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported v2 version %d", fixed[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, nil, fmt.Errorf("malformed v2 header: %w", err)
+	}
+	switch fixed[12] & 0x0f {
+	case 0:
+		// LOCAL: the connection was made by the load balancer itself, so any
+		// address block is ignored
+		return nil, nil, nil
+	case 1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("unsupported v2 command %d", fixed[12]&0x0f)
+	}
+
+	var size int
+	switch fixed[13] >> 4 {
+	case 0: // AF_UNSPEC
+		return nil, nil, nil
+	case 1: // AF_INET
+		size = 4
+	case 2: // AF_INET6
+		size = 16
+	case 3: // AF_UNIX
+		return nil, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported v2 address family %d", fixed[13]>>4)
+	}
+	// Only STREAM is proxied; a DGRAM header describes some other connection
+	if fixed[13]&0x0f != 1 {
+		return nil, nil, fmt.Errorf("unsupported v2 transport %d", fixed[13]&0x0f)
+	}
+	if len(payload) < 2*size+4 {
+		return nil, nil, fmt.Errorf("malformed v2 header: short address block")
+	}
+	srcIP, _ := netip.AddrFromSlice(payload[:size])
+	dstIP, _ := netip.AddrFromSlice(payload[size : 2*size])
+	srcPort := binary.BigEndian.Uint16(payload[2*size:])
+	dstPort := binary.BigEndian.Uint16(payload[2*size+2:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort)),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort)), nil
+}
+
+// proxyHeader builds a PROXY protocol header for a connection from src to dst.
+// Without TCP addresses of the same family, such as for health checks, the
+// header tells the upstream to use the connection's own addresses.
+func proxyHeader(version string, src, dst net.Addr) []byte {
+	s, sok := addrPort(src)
+	d, dok := addrPort(dst)
+	known := sok && dok && s.Addr().Is4() == d.Addr().Is4()
+
+	if version == proxyProtoV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		proto := "TCP4"
+		if s.Addr().Is6() {
+			proto = "TCP6"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", proto, s.Addr(), d.Addr(), s.Port(), d.Port())
+	}
+
+	b := append([]byte{}, proxyProtoV2Sig...)
+	if !known {
+		// LOCAL command with no addresses
+		return append(b, 0x20, 0x00, 0, 0)
+	}
+	if s.Addr().Is4() {
+		b = append(b, 0x21, 0x11, 0, 12)
+	} else {
+		b = append(b, 0x21, 0x21, 0, 36)
+	}
+	b = append(b, s.Addr().AsSlice()...)
+	b = append(b, d.Addr().AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, s.Port())
+	return binary.BigEndian.AppendUint16(b, d.Port())
+}
+
+type clientConnKey struct{}
+
+// withClientConn records the client connection of the requests served on it,
+// for the PROXY protocol header sent to the upstream
+func withClientConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, clientConnKey{}, conn)
+}
+
+// sendProxyHeader makes transport send a PROXY protocol header on each new
+// connection. Connections are not reused, since a header describes a single
+// client.
+func sendProxyHeader(transport *http.Transport, version string) {
+	dial := transport.DialContext
+	transport.DisableKeepAlives = true
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		var src, dst net.Addr
+		if client, ok := ctx.Value(clientConnKey{}).(net.Conn); ok {
+			src, dst = client.RemoteAddr(), client.LocalAddr()
+		}
+		if _, err := conn.Write(proxyHeader(version, src, dst)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
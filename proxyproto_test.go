@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRemoteAddrServer serves the remote address of each request, reading
+// PROXY protocol headers from local connections. It returns the port.
+func newRemoteAddrServer(t *testing.T) uint {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	})}
+	go srv.Serve(newProxyProtoListener(ln, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}))
+	t.Cleanup(func() { srv.Close() })
+	return uint(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// sendRequest sends header followed by a GET request to addr and returns the response body
+func sendRequest(t *testing.T, addr, header string) (int, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n", header)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return res.StatusCode, string(body)
+}
+
+func TestParseCIDRs(t *testing.T) {
+	got, err := parseCIDRs("10.0.0.0/8, 192.168.1.5/24,127.0.0.1,::1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("127.0.0.1/32"),
+		netip.MustParsePrefix("::1/128"),
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	for _, input := range []string{"10.0.0.0/33", "localhost", "10.0.0.0/8,"} {
+		if _, err := parseCIDRs(input); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7").To4(), Port: 56324}
+	v4dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 443}
+	v6src := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 56324}
+	v6dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+
+	tests := []struct {
+		name    string
+		input   string
+		src     string
+		dst     string
+		wantErr bool
+	}{
+		{name: "v1 tcp4", input: "PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n", src: "203.0.113.7:56324", dst: "192.0.2.1:443"},
+		{name: "v1 tcp6", input: "PROXY TCP6 2001:db8::7 2001:db8::1 56324 443\r\n", src: "[2001:db8::7]:56324", dst: "[2001:db8::1]:443"},
+		{name: "v1 unknown", input: "PROXY UNKNOWN\r\n"},
+		{name: "v1 built", input: string(proxyHeader(proxyProtoV1, v4src, v4dst)), src: "203.0.113.7:56324", dst: "192.0.2.1:443"},
+		{name: "v1 built without addresses", input: string(proxyHeader(proxyProtoV1, nil, nil))},
+		{name: "v2 tcp4", input: string(proxyHeader(proxyProtoV2, v4src, v4dst)), src: "203.0.113.7:56324", dst: "192.0.2.1:443"},
+		{name: "v2 tcp6", input: string(proxyHeader(proxyProtoV2, v6src, v6dst)), src: "[2001:db8::7]:56324", dst: "[2001:db8::1]:443"},
+		{name: "v2 local", input: string(proxyHeader(proxyProtoV2, v4src, v6dst))},
+		{name: "v2 local with addresses", input: v2Header(0x20, 0x11, v4src, v4dst)},
+		{name: "v2 unix", input: v2Header(0x21, 0x31, nil, nil)},
+		{name: "v2 udp4", input: v2Header(0x21, 0x12, v4src, v4dst), wantErr: true},
+		{name: "v2 unknown transport", input: v2Header(0x21, 0x13, v4src, v4dst), wantErr: true},
+		{name: "v2 unknown command", input: v2Header(0x22, 0x11, v4src, v4dst), wantErr: true},
+		{name: "v2 unknown family", input: v2Header(0x21, 0x41, v4src, v4dst), wantErr: true},
+		{name: "no header", input: ""},
+		{name: "v1 malformed", input: "PROXY TCP4 203.0.113.7\r\n", wantErr: true},
+		{name: "v1 invalid address", input: "PROXY TCP4 example.com 192.0.2.1 56324 443\r\n", wantErr: true},
+		{name: "v2 truncated", input: string(proxyHeader(proxyProtoV2, v4src, v4dst)[:14]) + "\xff\xff", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(tt.input + "GET / HTTP/1.1\r\n"))
+			src, dst, err := readProxyHeader(br)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error, got %v %v", src, dst)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := addrString(src); got != tt.src {
+				t.Errorf("Expected source %q, got %q", tt.src, got)
+			}
+			if got := addrString(dst); got != tt.dst {
+				t.Errorf("Expected destination %q, got %q", tt.dst, got)
+			}
+			if rest, _ := br.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("Expected the request to follow the header, got %q", rest)
+			}
+		})
+	}
+}
+
+// v2Header builds a PROXY protocol v2 header with the given command and
+// family/transport bytes and an IPv4 address block, if src and dst are set
+func v2Header(command, family byte, src, dst *net.TCPAddr) string {
+	b := append(slices.Clone(proxyProtoV2Sig), command, family, 0, 0)
+	if src != nil {
+		b = append(b, src.IP.To4()...)
+		b = append(b, dst.IP.To4()...)
+		b = binary.BigEndian.AppendUint16(b, uint16(src.Port))
+		b = binary.BigEndian.AppendUint16(b, uint16(dst.Port))
+	}
+	binary.BigEndian.PutUint16(b[14:16], uint16(len(b)-16))
+	return string(b)
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	addr := fmt.Sprintf("127.0.0.1:%d", newRemoteAddrServer(t))
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "v1", header: "PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n", want: "203.0.113.7:56324"},
+		{name: "v2", header: string(proxyHeader(proxyProtoV2, &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443})), want: "[2001:db8::7]:1234"},
+		{name: "no header", header: "", want: "127.0.0.1:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := sendRequest(t, addr, tt.header)
+			if status != http.StatusOK || !strings.HasPrefix(body, tt.want) {
+				t.Errorf("Expected remote address %s, got %d %q", tt.want, status, body)
+			}
+		})
+	}
+}
+
+func TestProxyProtoListenerUntrustedSource(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	})}
+	go srv.Serve(newProxyProtoListener(ln, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}))
+	defer srv.Close()
+
+	// The header of an untrusted source is not parsed, so the request is malformed
+	status, _ := sendRequest(t, ln.Addr().String(), "PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n")
+	if status != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an untrusted header, got %d", status)
+	}
+}
+
+func TestUpstreamProxyProtocol(t *testing.T) {
+	for _, version := range []string{proxyProtoV1, proxyProtoV2} {
+		t.Run(version, func(t *testing.T) {
+			config := &Config{
+				ToPort:                newRemoteAddrServer(t),
+				MaxConns:              1,
+				ListenHost:            "127.0.0.1",
+				ProxyProtocol:         true,
+				ProxyProtocolTrusted:  []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")},
+				UpstreamProxyProtocol: version,
+			}
+			proxy, err := newReverseProxy(config)
+			if err != nil {
+				t.Fatalf("Failed to create reverse proxy: %v", err)
+			}
+			ln, err := listen(config)
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			srv := newServer(config, proxy, nil)
+			go srv.Serve(ln)
+			defer srv.Close()
+
+			// The client address from the load balancer reaches the upstream
+			for range 2 {
+				status, body := sendRequest(t, ln.Addr().String(), "PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n")
+				if status != http.StatusOK || body != "203.0.113.7:56324" {
+					t.Errorf("Expected the upstream to see 203.0.113.7:56324, got %d %q", status, body)
+				}
+			}
+		})
+	}
+}
+
+func TestTCPProxyUpstreamProxyProtocol(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		src, _, err := readProxyHeader(bufio.NewReader(conn))
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		received <- addrString(src)
+	}()
+
+	addr := startTCPProxy(t, &Config{
+		ToPort:                uint(upstream.Addr().(*net.TCPAddr).Port),
+		MaxConns:              1,
+		UpstreamProxyProtocol: proxyProtoV2,
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	select {
+	case got := <-received:
+		if got != conn.LocalAddr().String() {
+			t.Errorf("Expected the upstream to see %s, got %q", conn.LocalAddr(), got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the PROXY protocol header")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// maxRequestIDLength is the longest request ID accepted from a client
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// withRequestID returns ctx carrying the request ID
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFromContext returns the request ID in ctx, or "-" if there is none
+func requestIDFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return "-"
+}
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether a request ID sent by a client can be used
+// as is. IDs are written to the logs, so only short printable ones are.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDHandler gives every request an ID before passing it to next. The
+// ID sent by the client in X-Request-Id is kept when valid. The ID is sent to
+// the upstream and back to the client in X-Request-Id, and logs about the
+// request include it. With accessLog, one line is logged per request, with
+// the identity of the client once authenticated further down the chain. With
+// a tracer, each request is traced as a server span. With a registry, the
+// request can be inspected and canceled on the admin endpoint while in flight.
+type requestIDHandler struct {
+	next      http.Handler
+	accessLog bool
+	tracer    *tracer
+	requests  *inflightRegistry
+}
+
+func newRequestIDHandler(next http.Handler, accessLog bool, tracer *tracer, requests *inflightRegistry) *requestIDHandler {
+	return &requestIDHandler{next: next, accessLog: accessLog, tracer: tracer, requests: requests}
+}
+
+func (h *requestIDHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	id := req.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	if client == "" {
+		client = "-"
+	}
+
+	ctx, span := h.tracer.startServer(req)
+	span.setAttr("http.request.method", req.Method)
+	span.setAttr("url.path", req.URL.Path)
+	span.setAttr("server.address", req.Host)
+	span.setAttr("client.address", client)
+	tracked := &inflightRequest{
+		ID:     id,
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Client: client,
+		Start:  start,
+	}
+	ctx, done := h.requests.add(ctx, tracked)
+	defer done()
+	// The ID is replaced when it is already in flight
+	id = tracked.ID
+	span.setAttr("flproxy.request_id", id)
+	ctx, user := withIdentity(ctx)
+	req = req.WithContext(withRequestID(ctx, id))
+	req.Header.Set(requestIDHeader, id)
+
+	rw := &responseLogger{ResponseWriter: w, id: id}
+	h.next.ServeHTTP(rw, req)
+	status := rw.status(req)
+
+	span.setAttr("http.response.status_code", status)
+	if status >= 500 {
+		span.setError(fmt.Errorf("%d %s", status, http.StatusText(status)))
+	}
+	span.finish(nil)
+	if h.accessLog {
+		name := user.name
+		if name == "" {
+			name = "-"
+		}
+		log.Printf("access: %s %s \"%s %s %s\" %d %dB %v (request_id:%s)",
+			client, name, req.Method, req.RequestURI, req.Proto, status, rw.bytes, time.Since(start).Round(time.Millisecond), id)
+	}
+}
+
+// responseLogger records the status and size of a response, and sets
+// X-Request-Id on it, replacing any the upstream sent
+type responseLogger struct {
+	http.ResponseWriter
+	id         string
+	statusCode int
+	bytes      int64
+	hijacked   bool
+}
+
+func (w *responseLogger) WriteHeader(code int) {
+	if w.statusCode < 200 {
+		w.Header().Set(requestIDHeader, w.id)
+		w.statusCode = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseLogger) Write(p []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// status returns the status code sent to the client. The status of a
+// hijacked connection is the one CONNECT tunnels and upgrades answer with.
+func (w *responseLogger) status(req *http.Request) int {
+	switch {
+	case w.statusCode == 0 && w.hijacked && req.Method == http.MethodConnect:
+		return http.StatusOK
+	case w.statusCode == 0 && w.hijacked:
+		return http.StatusSwitchingProtocols
+	case w.statusCode == 0:
+		return http.StatusOK
+	}
+	return w.statusCode
+}
+
+// Flush and Hijack keep streaming responses, upgrades and CONNECT tunnels
+// working through the wrapper
+
+func (w *responseLogger) Flush() {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *responseLogger) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	// The handler answers on the connection itself, with these headers for upgrades
+	w.Header().Set(requestIDHeader, w.id)
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	w.hijacked = err == nil
+	return conn, brw, err
+}
+
+func (w *responseLogger) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLog redirects the log output to a buffer until the test ends
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	out := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(out) })
+	return &buf
+}
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{id: "abc-123", want: true},
+		{id: "f81d4fae-7dec-11d0-a765-00a0c91e6bf6", want: true},
+		{id: "", want: false},
+		{id: "has space", want: false},
+		{id: "line\nbreak", want: false},
+		{id: "non-ascii-é", want: false},
+		{id: strings.Repeat("a", maxRequestIDLength), want: true},
+		{id: strings.Repeat("a", maxRequestIDLength+1), want: false},
+	}
+
+	for _, tt := range tests {
+		if got := validRequestID(tt.id); got != tt.want {
+			t.Errorf("Expected %t for %q, got %t", tt.want, tt.id, got)
+		}
+	}
+}
+
+func TestRequestIDHandler(t *testing.T) {
+	var upstreamID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get(requestIDHeader)
+		// An upstream echoing another ID does not replace the proxy's
+		w.Header().Set(requestIDHeader, "from-upstream")
+		w.WriteHeader(http.StatusTeapot)
+		fmt.Fprint(w, "hello")
+	}))
+	defer server.Close()
+
+	proxy, err := newReverseProxy(&Config{ToPort: serverPort(t, server), MaxConns: 1})
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	requests := newInflightRegistry()
+	_, done := requests.add(context.Background(), &inflightRequest{ID: "in-flight"})
+	defer done()
+	handler := newRequestIDHandler(proxy, true, nil, requests)
+
+	tests := []struct {
+		name     string
+		clientID string
+		keep     bool
+	}{
+		{name: "generated", clientID: "", keep: false},
+		{name: "from the client", clientID: "client-id-1", keep: true},
+		{name: "invalid from the client", clientID: "bad id", keep: false},
+		{name: "already in flight", clientID: "in-flight", keep: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			req := httptest.NewRequest("GET", "http://example.com/path?q=1", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			if tt.clientID != "" {
+				req.Header.Set(requestIDHeader, tt.clientID)
+			}
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+
+			id := res.Header().Get(requestIDHeader)
+			if tt.keep && id != tt.clientID {
+				t.Errorf("Expected the client's ID %q, got %q", tt.clientID, id)
+			}
+			if !tt.keep && (!validRequestID(id) || id == tt.clientID || len(id) != 32) {
+				t.Errorf("Expected a generated ID, got %q", id)
+			}
+			if upstreamID != id {
+				t.Errorf("Expected the upstream to get %q, got %q", id, upstreamID)
+			}
+			if got := res.Header().Values(requestIDHeader); len(got) != 1 {
+				t.Errorf("Expected one ID in the response, got %v", got)
+			}
+			want := `access: 192.0.2.1 - "GET http://example.com/path?q=1 HTTP/1.1" 418 5B`
+			if line := logs.String(); !strings.Contains(line, want) || !strings.Contains(line, "(request_id:"+id+")") {
+				t.Errorf("Expected access log %q with the ID, got %q", want, line)
+			}
+		})
+	}
+
+	// Without the access log, nothing is logged for successful requests
+	logs := captureLog(t)
+	newRequestIDHandler(proxy, false, nil, nil).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/", nil))
+	if logs.Len() != 0 {
+		t.Errorf("Expected no log, got %q", logs.String())
+	}
+}
+
+func TestRequestIDInLogs(t *testing.T) {
+	// Nothing listens on the port, so the request is retried and fails
+	server := httptest.NewServer(http.NotFoundHandler())
+	port := serverPort(t, server)
+	server.Close()
+
+	logs := captureLog(t)
+	config := &Config{ToPort: port, MaxConns: 1, MaxRetries: 1}
+	proxy, err := newReverseProxy(config)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set(requestIDHeader, "trace-me")
+	res := httptest.NewRecorder()
+	newRequestIDHandler(proxy, true, nil, nil).ServeHTTP(res, req)
+
+	if res.Code != http.StatusBadGateway {
+		t.Errorf("Expected status 502, got %d", res.Code)
+	}
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	for _, prefix := range []string{"retry1:", "fail request:", "access:"} {
+		found := false
+		for _, line := range lines {
+			if strings.Contains(line, prefix) {
+				found = true
+				if !strings.HasSuffix(line, "(request_id:trace-me)") {
+					t.Errorf("Expected the request ID in %q", line)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("Expected a %s line, got %q", prefix, logs.String())
+		}
+	}
+}
+
+func TestRequestIDHandlerUpgrade(t *testing.T) {
+	config := &Config{ToPort: serverPort(t, newEchoUpgradeServer(t)), MaxConns: 1}
+	proxy, err := newReverseProxy(config)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	server := httptest.NewServer(newRequestIDHandler(proxy, true, nil, nil))
+	defer server.Close()
+
+	conn, br, status := openTunnel(t, server.Listener.Addr().String())
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status 101, got %d", status)
+	}
+	if !echo(conn, br, "hello") {
+		t.Error("Expected the tunnel to work through the request ID handler")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation (SD_LISTEN_FDS_START). Upgrades pass the listener there too.
+const listenFDsStart = 3
+
+// upgradeEnv tells a process started by an upgrade that it inherits the
+// listener as fd 3 and reports readiness on fd 4
+const upgradeEnv = "FLPROXY_UPGRADE"
+
+// upgradeReadyTimeout is how long the new process has to start serving
+// before the upgrade is abandoned
+const upgradeReadyTimeout = 30 * time.Second
+
+// inheritedFD reports whether a listening socket was passed as fd 3, either
+// by systemd socket activation or by the previous process during an upgrade
+func inheritedFD() bool {
+	if os.Getenv(upgradeEnv) != "" {
+		return true
+	}
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || n < 1 {
+		return false
+	}
+	if n > 1 {
+		log.Printf("WARNING: systemd passed %d sockets, only the first is used", n)
+	}
+	// Not meant for processes started by upgrades
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return true
+}
+
+// inheritedListener returns the listener passed by systemd or the previous
+// process, or nil if there is none
+func inheritedListener() (net.Listener, error) {
+	if !inheritedFD() {
+		return nil, nil
+	}
+	f := os.NewFile(listenFDsStart, "listener")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited fd %d is not a listening socket: %w", listenFDsStart, err)
+	}
+	log.Printf("inherited listener on %s", ln.Addr())
+	return ln, nil
+}
+
+// notifyReady tells the previous process that this one is serving, so that
+// it can start draining. It does nothing unless started by an upgrade.
+func notifyReady() {
+	if os.Getenv(upgradeEnv) == "" {
+		return
+	}
+	os.Unsetenv(upgradeEnv)
+	f := os.NewFile(listenFDsStart+1, "ready")
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Printf("failed to notify the previous process: %v", err)
+	}
+}
+
+// handleSignals calls shutdown on a shutdown signal. On an upgrade signal, it
+// first starts a new process of the current binary on the same listener, and
+// only shuts down once the new process is serving. If the upgrade fails, the
+// current process keeps serving.
+func handleSignals(ln net.Listener, shutdown func()) {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, os.Interrupt)
+	upgrade := make(chan os.Signal, 1)
+	if len(upgradeSignals) > 0 {
+		signal.Notify(upgrade, upgradeSignals...)
+	}
+
+	for {
+		select {
+		case <-quit:
+			shutdown()
+			return
+		case <-upgrade:
+			exe, err := os.Executable()
+			if err == nil {
+				err = startProcess(ln, exe, os.Args[1:])
+			}
+			if err != nil {
+				log.Printf("failed to upgrade: %v", err)
+				continue
+			}
+			log.Printf("new process is serving, draining")
+			shutdown()
+			return
+		}
+	}
+}
+
+// startProcess starts exe with args, passing on the listener, and waits until
+// it is serving
+func startProcess(ln net.Listener, exe string, args []string) error {
+	raw := rawListener(ln)
+	filer, ok := raw.(interface{ File() (*os.File, error) })
+	if !ok {
+		return fmt.Errorf("cannot pass on a %T", raw)
+	}
+	lnFile, err := filer.File()
+	if err != nil {
+		return err
+	}
+	defer lnFile.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), upgradeEnv+"=1")
+	cmd.ExtraFiles = []*os.File{lnFile, w}
+	err = cmd.Start()
+	w.Close()
+	setNonblock(raw)
+	if err != nil {
+		return err
+	}
+	log.Printf("started new process %d", cmd.Process.Pid)
+
+	// The pipe closes without a byte if the new process exits first
+	r.SetReadDeadline(time.Now().Add(upgradeReadyTimeout))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("new process %d was not ready within %v", cmd.Process.Pid, upgradeReadyTimeout)
+		}
+		return fmt.Errorf("new process %d exited before serving", cmd.Process.Pid)
+	}
+	// The new process outlives this one
+	cmd.Process.Release()
+
+	// The socket file now belongs to the new process
+	if ul, ok := raw.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	return nil
+}
+
+// rawListener returns the socket listener under any wrapping listener
+func rawListener(ln net.Listener) net.Listener {
+	if pp, ok := ln.(*proxyProtoListener); ok {
+		return pp.Listener
+	}
+	return ln
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// upgradeSignals is empty, since passing the listener to a new process needs
+// unix file descriptors
+var upgradeSignals []os.Signal
+
+func setNonblock(net.Listener) {}
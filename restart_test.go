@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestInheritedFD(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name string
+		env  map[string]string
+		want bool
+	}{
+		{name: "none", env: map[string]string{}, want: false},
+		{name: "systemd", env: map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "1"}, want: true},
+		{name: "systemd with several sockets", env: map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "2"}, want: true},
+		{name: "systemd for another process", env: map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"}, want: false},
+		{name: "systemd without sockets", env: map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "0"}, want: false},
+		{name: "upgrade", env: map[string]string{upgradeEnv: "1"}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", upgradeEnv} {
+				t.Setenv(key, tt.env[key])
+			}
+			if got := inheritedFD(); got != tt.want {
+				t.Errorf("Expected %t, got %t", tt.want, got)
+			}
+			if tt.want && tt.env["LISTEN_FDS"] != "" && os.Getenv("LISTEN_FDS") != "" {
+				t.Error("Expected LISTEN_FDS to be cleared")
+			}
+		})
+	}
+}
+
+// TestUpgradeHelperProcess is the new process started by TestStartProcess.
+// It serves one request on the inherited listener.
+func TestUpgradeHelperProcess(t *testing.T) {
+	if os.Getenv(upgradeEnv) == "" {
+		t.Skip("only run by TestStartProcess")
+	}
+	ln, err := listen(&Config{})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	served := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "new process")
+		close(served)
+	})}
+	go srv.Serve(ln)
+	notifyReady()
+
+	select {
+	case <-served:
+	case <-time.After(10 * time.Second):
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+}
+
+func TestStartProcess(t *testing.T) {
+	tests := []struct {
+		network string
+		address string
+	}{
+		{network: "tcp", address: "127.0.0.1:0"},
+		{network: "unix", address: filepath.Join(t.TempDir(), "proxy.sock")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			ln, err := net.Listen(tt.network, tt.address)
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			addr := ln.Addr()
+
+			if err := startProcess(ln, os.Args[0], []string{"-test.run=^TestUpgradeHelperProcess$"}); err != nil {
+				ln.Close()
+				t.Fatalf("Failed to start the new process: %v", err)
+			}
+			// The old process stops accepting; the socket stays open in the new one
+			ln.Close()
+
+			client := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, addr.Network(), addr.String())
+				},
+			}}
+			res, err := client.Get("http://localhost/")
+			if err != nil {
+				t.Fatalf("Request after the upgrade failed: %v", err)
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			if string(body) != "new process" {
+				t.Errorf("Expected the new process to answer, got %q", body)
+			}
+		})
+	}
+}
+
+func TestStartProcessFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	exe, err := exec.LookPath("false")
+	if err != nil {
+		t.Skip("false is not available")
+	}
+	// The new process exits without serving
+	if err := startProcess(ln, exe, nil); err == nil {
+		t.Error("Expected error when the new process exits before serving")
+	}
+
+	// The old listener keeps working
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	res, err := http.Get("http://" + ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Request after the failed upgrade failed: %v", err)
+	}
+	res.Body.Close()
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// upgradeSignals start a new process on the same listener, see handleSignals
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// setNonblock puts the listening socket back in non-blocking mode. Passing it
+// to a new process makes it blocking, and a blocking Accept could not be
+// interrupted by closing the listener.
+func setNonblock(ln net.Listener) {
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		syscall.SetNonblock(int(fd), true)
+	})
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Route sends the requests it matches to its own upstreams, with its own
+// concurrency limit, retry policy and path rewrite. Unset fields match any
+// request or keep the command line settings.
+type Route struct {
+	Name string `json:"name"`
+
+	// Matching; every given condition must hold
+	Host       string            `json:"host"`        // Host header, "*.example.com" for any subdomain
+	PathPrefix string            `json:"path_prefix"` // Path prefix, such as "/api/"
+	PathRegex  string            `json:"path_regex"`  // Regular expression matched against the path
+	Methods    []string          `json:"methods"`     // Request methods
+	Headers    map[string]string `json:"headers"`     // Header values, matched exactly
+
+	// Forwarding
+	Upstreams   []RouteUpstream `json:"upstreams"`    // Upstream instances (empty uses the command line targets)
+	Limit       int64           `json:"limit"`        // Maximum concurrent requests (0 uses -limit)
+	StripPrefix string          `json:"strip_prefix"` // Prefix removed from the path before forwarding
+	AddPrefix   string          `json:"add_prefix"`   // Prefix added to the path before forwarding
+
+	MaxBodyBytes *int64 `json:"max_body_bytes"` // Maximum size of request bodies, 0 for unlimited (unset uses -max-body-bytes)
+
+	// Header rewriting
+	RequestHeaders  *HeaderRules `json:"request_headers"`  // Rules for the headers sent to the upstreams
+	ResponseHeaders *HeaderRules `json:"response_headers"` // Rules for the headers sent back to the clients
+
+	// Retry policy
+	MaxRetries           *int      `json:"max_retries"`
+	RetryBudgetPercent   *float64  `json:"retry_budget_percent"`
+	RetryBudgetMinPerSec *float64  `json:"retry_budget_min_per_sec"`
+	AttemptTimeout       *duration `json:"attempt_timeout"`
+	RequestTimeout       *duration `json:"request_timeout"`
+
+	ServerTiming *bool `json:"server_timing"` // Add Server-Timing and X-Flproxy-Attempts headers (unset uses -server-timing)
+
+	pathRegex *regexp.Regexp
+	targets   []Target
+}
+
+// RouteUpstream is an upstream instance of a route, written in JSON as its
+// address or as an object with its own HTTPS settings:
+//
+//	"9091"
+//	{"address": "9443", "tls": {"ca": "backend-ca.pem", "server_name": "backend.internal"}}
+type RouteUpstream struct {
+	Address string       `json:"address"` // Port or unix:/path socket
+	TLS     *UpstreamTLS `json:"tls"`     // HTTPS settings of the instance (nil uses the -upstream-tls settings)
+}
+
+func (u *RouteUpstream) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &u.Address); err == nil {
+		return nil
+	}
+	type plain RouteUpstream
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode((*plain)(u)); err != nil {
+		return fmt.Errorf("upstream must be an address or an object with address and tls: %w", err)
+	}
+	return nil
+}
+
+// routesFile is the format of the -routes file
+type routesFile struct {
+	Routes  []Route `json:"routes"`
+	Default *Route  `json:"default"` // Route for requests matching no route (omitted answers 404)
+}
+
+// duration is a time.Duration written as a string such as "5s" in JSON
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadRoutes reads a routing table from a JSON file
+func loadRoutes(filename string) ([]Route, *Route, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	var file routesFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, nil, fmt.Errorf("invalid routes file %s: %w", filename, err)
+	}
+	if len(file.Routes) == 0 && file.Default == nil {
+		return nil, nil, fmt.Errorf("invalid routes file %s: no routes", filename)
+	}
+
+	for i := range file.Routes {
+		r := &file.Routes[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("route%d", i+1)
+		}
+		if err := r.init(); err != nil {
+			return nil, nil, fmt.Errorf("invalid route %s: %w", r.Name, err)
+		}
+	}
+	if d := file.Default; d != nil {
+		if d.Name == "" {
+			d.Name = "default"
+		}
+		if d.Host != "" || d.PathPrefix != "" || d.PathRegex != "" || len(d.Methods) > 0 || len(d.Headers) > 0 {
+			return nil, nil, fmt.Errorf("invalid default route: it matches every request and takes no conditions")
+		}
+		if err := d.init(); err != nil {
+			return nil, nil, fmt.Errorf("invalid default route: %w", err)
+		}
+	}
+	return file.Routes, file.Default, nil
+}
+
+// init validates the route and prepares it for matching
+func (r *Route) init() error {
+	if r.Host != "" {
+		r.Host = strings.ToLower(r.Host)
+		if _, err := parseForwardAllow(r.Host); err != nil {
+			return fmt.Errorf("invalid host %q", r.Host)
+		}
+	}
+	for _, prefix := range []string{r.PathPrefix, r.StripPrefix, r.AddPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("path prefixes must start with '/', got %q", prefix)
+		}
+	}
+	if r.PathRegex != "" {
+		re, err := regexp.Compile(r.PathRegex)
+		if err != nil {
+			return fmt.Errorf("invalid path_regex: %w", err)
+		}
+		r.pathRegex = re
+	}
+	for i, m := range r.Methods {
+		r.Methods[i] = strings.ToUpper(m)
+	}
+
+	for _, u := range r.Upstreams {
+		e, err := parseEndpoint(u.Address)
+		if err != nil {
+			return fmt.Errorf("invalid upstream %q: %w", u.Address, err)
+		}
+		if err := e.validate(); err != nil {
+			return fmt.Errorf("invalid upstream %q: %w", u.Address, err)
+		}
+		if err := u.TLS.validate(); err != nil {
+			return fmt.Errorf("invalid tls of upstream %q: %w", u.Address, err)
+		}
+		r.targets = append(r.targets, Target{Port: uint(e.Port), Socket: e.Socket, TLS: u.TLS})
+	}
+
+	if err := r.RequestHeaders.init(); err != nil {
+		return fmt.Errorf("invalid request_headers: %w", err)
+	}
+	if err := r.ResponseHeaders.init(); err != nil {
+		return fmt.Errorf("invalid response_headers: %w", err)
+	}
+
+	switch {
+	case r.Limit < 0:
+		return fmt.Errorf("limit must not be negative")
+	case r.RetryBudgetPercent != nil && *r.RetryBudgetPercent < 0,
+		r.RetryBudgetMinPerSec != nil && *r.RetryBudgetMinPerSec < 0:
+		return fmt.Errorf("retry budget must not be negative")
+	case r.AttemptTimeout != nil && *r.AttemptTimeout < 0,
+		r.RequestTimeout != nil && *r.RequestTimeout < 0:
+		return fmt.Errorf("timeouts must not be negative")
+	case r.MaxBodyBytes != nil && *r.MaxBodyBytes < 0:
+		return fmt.Errorf("max_body_bytes must not be negative")
+	}
+	return nil
+}
+
+// matches reports whether req meets every condition of the route
+func (r *Route) matches(req *http.Request) bool {
+	if r.Host != "" {
+		host, port, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host, port = req.Host, ""
+		}
+		if !matchDestination(r.Host, strings.ToLower(host), port) {
+			return false
+		}
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+		return false
+	}
+	if r.pathRegex != nil && !r.pathRegex.MatchString(req.URL.Path) {
+		return false
+	}
+	if len(r.Methods) > 0 && !slices.Contains(r.Methods, req.Method) {
+		return false
+	}
+	for name, value := range r.Headers {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// rewrite returns req with the path rewritten by StripPrefix and AddPrefix
+func (r *Route) rewrite(req *http.Request) *http.Request {
+	if r.StripPrefix == "" && r.AddPrefix == "" {
+		return req
+	}
+	out := new(http.Request)
+	*out = *req
+	u := *req.URL
+	out.URL = &u
+
+	// Rewrite the escaped form when there is one, so that escapes such as
+	// %2F are kept
+	if u.RawPath != "" {
+		raw := r.rewritePath(u.RawPath)
+		if p, err := url.PathUnescape(raw); err == nil {
+			u.Path, u.RawPath = p, raw
+			return out
+		}
+	}
+	u.Path = r.rewritePath(u.Path)
+	u.RawPath = ""
+	return out
+}
+
+func (r *Route) rewritePath(p string) string {
+	p = strings.TrimPrefix(p, r.StripPrefix)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	if r.AddPrefix != "" {
+		trailing := strings.HasSuffix(p, "/")
+		p = path.Join(r.AddPrefix, p)
+		if trailing && !strings.HasSuffix(p, "/") {
+			p += "/"
+		}
+	}
+	return p
+}
+
+// config returns the settings of the proxy for the route: base with the
+// route's upstreams, limit, retry policy, body size limit and header rules
+func (r *Route) config(base *Config) *Config {
+	c := *base
+	c.Routes, c.DefaultRoute = nil, nil
+	c.RouteName = r.Name
+	c.RequestHeaders, c.ResponseHeaders = r.RequestHeaders, r.ResponseHeaders
+	if len(r.targets) > 0 {
+		c.Targets = r.targets
+		c.ToPort = r.targets[0].Port
+	}
+	if r.Limit > 0 {
+		c.MaxConns = r.Limit
+	}
+	if r.MaxRetries != nil {
+		c.MaxRetries = *r.MaxRetries
+	}
+	if r.RetryBudgetPercent != nil {
+		c.RetryBudgetPercent = *r.RetryBudgetPercent
+	}
+	if r.RetryBudgetMinPerSec != nil {
+		c.RetryBudgetMinPerSec = *r.RetryBudgetMinPerSec
+	}
+	if r.AttemptTimeout != nil {
+		c.AttemptTimeout = time.Duration(*r.AttemptTimeout)
+	}
+	if r.RequestTimeout != nil {
+		c.RequestTimeout = time.Duration(*r.RequestTimeout)
+	}
+	if r.ServerTiming != nil {
+		c.ServerTiming = *r.ServerTiming
+	}
+	if r.MaxBodyBytes != nil {
+		c.MaxBodyBytes = *r.MaxBodyBytes
+	}
+	return &c
+}
+
+// router sends each request to the first route it matches. Every route has
+// its own reverse proxy, so limits and retry budgets are not shared.
+type router struct {
+	routes   []*Route
+	proxies  map[*Route]*httputil.ReverseProxy
+	fallback *Route
+	filter   *ipFilter // Lists of each route applied before its proxy (nil allows every client)
+}
+
+func newRouter(config *Config) (*router, error) {
+	rt := &router{proxies: map[*Route]*httputil.ReverseProxy{}, fallback: config.DefaultRoute}
+	for i := range config.Routes {
+		rt.routes = append(rt.routes, &config.Routes[i])
+	}
+	all := rt.routes
+	if rt.fallback != nil {
+		all = append(slices.Clip(all), rt.fallback)
+	}
+	for _, r := range all {
+		c := r.config(config)
+		proxy, err := newReverseProxy(c)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", r.Name, err)
+		}
+		rt.proxies[r] = proxy
+		log.Printf("route %s -> %s (limit:%d)", r.Name, joinTargets(c.targets()), c.MaxConns)
+	}
+	return rt, nil
+}
+
+// close stops the health checks of every route
+func (rt *router) close() {
+	for _, proxy := range rt.proxies {
+		closeReverseProxy(proxy)
+	}
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	route := rt.fallback
+	for _, r := range rt.routes {
+		if r.matches(req) {
+			route = r
+			break
+		}
+	}
+	if route == nil {
+		http.NotFound(w, req)
+		return
+	}
+	spanFromContext(req.Context()).setAttr("flproxy.route", route.Name)
+	inflightFromContext(req.Context()).setRoute(route.Name)
+	if !rt.filter.allows(req, route.Name) {
+		rt.filter.deny(w, req, route.Name)
+		return
+	}
+	rt.proxies[route].ServeHTTP(w, route.rewrite(req))
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeRoutes writes a routes file and returns its path
+func writeRoutes(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write routes: %v", err)
+	}
+	return filename
+}
+
+// newNamedServer answers every request with its name and the request path.
+// It returns the port.
+func newNamedServer(t *testing.T, name string) uint {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+	}))
+	t.Cleanup(server.Close)
+	return serverPort(t, server)
+}
+
+func TestLoadRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "valid", content: `{"routes": [{"name": "api", "host": "*.example.com", "path_prefix": "/api/", "methods": ["get"], "upstreams": ["9091", "unix:/tmp/api.sock"], "limit": 5, "max_retries": 2, "attempt_timeout": "1s", "server_timing": false, "max_body_bytes": 1024}], "default": {}}`},
+		{name: "default only", content: `{"default": {"upstreams": ["9091"]}}`},
+		{name: "no routes", content: `{"routes": []}`, wantErr: true},
+		{name: "unknown field", content: `{"routes": [{"path": "/api/"}]}`, wantErr: true},
+		{name: "invalid regex", content: `{"routes": [{"path_regex": "("}]}`, wantErr: true},
+		{name: "relative prefix", content: `{"routes": [{"path_prefix": "api/"}]}`, wantErr: true},
+		{name: "invalid upstream", content: `{"routes": [{"upstreams": ["70000"]}]}`, wantErr: true},
+		{name: "invalid duration", content: `{"routes": [{"request_timeout": 5}]}`, wantErr: true},
+		{name: "negative limit", content: `{"routes": [{"limit": -1}]}`, wantErr: true},
+		{name: "negative max body bytes", content: `{"routes": [{"max_body_bytes": -1}]}`, wantErr: true},
+		{name: "header rules", content: `{"routes": [{"request_headers": {"set": {"x-route": "{route}"}}, "response_headers": {"remove": ["server"]}}], "default": {}}`},
+		{name: "invalid header rules", content: `{"routes": [{"request_headers": {"set": {"X-A": "{user}"}}}]}`, wantErr: true},
+		{name: "default with conditions", content: `{"default": {"path_prefix": "/"}}`, wantErr: true},
+		{name: "upstream with tls", content: `{"routes": [{"upstreams": ["9091", {"address": "9443", "tls": {"ca": "ca.pem", "cert": "client.pem", "key": "client-key.pem", "server_name": "backend.internal"}}]}], "default": {}}`},
+		{name: "upstream tls cert without key", content: `{"routes": [{"upstreams": [{"address": "9443", "tls": {"cert": "client.pem"}}]}]}`, wantErr: true},
+		{name: "unknown upstream field", content: `{"routes": [{"upstreams": [{"address": "9443", "ca": "ca.pem"}]}]}`, wantErr: true},
+		{name: "invalid upstream type", content: `{"routes": [{"upstreams": [9091]}]}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes, def, err := loadRoutes(writeRoutes(t, tt.content))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for %s", tt.content)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			for _, r := range append(routes, *def) {
+				if r.Name == "" {
+					t.Error("Expected every route to be named")
+				}
+			}
+		})
+	}
+
+	routes, _, _ := loadRoutes(writeRoutes(t, tests[0].content))
+	r := routes[0]
+	if r.Methods[0] != http.MethodGet || len(r.targets) != 2 || r.targets[1].Socket != "/tmp/api.sock" {
+		t.Errorf("Expected normalized methods and targets, got %v %v", r.Methods, r.targets)
+	}
+	c := r.config(&Config{ToPort: 9090, MaxConns: 10, RequestTimeout: time.Minute, ServerTiming: true, MaxBodyBytes: 1 << 20})
+	if c.ToPort != 9091 || c.MaxConns != 5 || c.MaxRetries != 2 || c.AttemptTimeout != time.Second || c.RequestTimeout != time.Minute || c.ServerTiming || c.MaxBodyBytes != 1024 {
+		t.Errorf("Expected route settings over the command line ones, got %+v", c)
+	}
+
+	routes, _, _ = loadRoutes(writeRoutes(t, tests[13].content))
+	if targets := routes[0].targets; targets[0].TLS != nil || targets[1].TLS == nil || targets[1].TLS.ServerName != "backend.internal" {
+		t.Errorf("Expected TLS on the second upstream only, got %+v", targets)
+	}
+
+	routes, _, _ = loadRoutes(writeRoutes(t, tests[10].content))
+	c = routes[0].config(&Config{})
+	if c.RouteName != "route1" || c.RequestHeaders.Set["X-Route"] != "{route}" || c.ResponseHeaders.Remove[0] != "Server" {
+		t.Errorf("Expected the route name and header rules, got %q %+v %+v", c.RouteName, c.RequestHeaders, c.ResponseHeaders)
+	}
+}
+
+func TestRouteMatches(t *testing.T) {
+	tests := []struct {
+		name  string
+		route Route
+		req   func() *http.Request
+		want  bool
+	}{
+		{
+			name:  "empty route",
+			route: Route{},
+			req:   func() *http.Request { return httptest.NewRequest("GET", "http://example.com/", nil) },
+			want:  true,
+		},
+		{
+			name:  "host",
+			route: Route{Host: "api.example.com"},
+			req:   func() *http.Request { return httptest.NewRequest("GET", "http://API.example.com:8080/", nil) },
+			want:  true,
+		},
+		{
+			name:  "wildcard host",
+			route: Route{Host: "*.example.com"},
+			req:   func() *http.Request { return httptest.NewRequest("GET", "http://example.com/", nil) },
+			want:  false,
+		},
+		{
+			name:  "path prefix",
+			route: Route{PathPrefix: "/api/"},
+			req:   func() *http.Request { return httptest.NewRequest("GET", "http://example.com/apis", nil) },
+			want:  false,
+		},
+		{
+			name:  "path regex",
+			route: Route{PathRegex: `^/v[0-9]+/`},
+			req:   func() *http.Request { return httptest.NewRequest("GET", "http://example.com/v2/users", nil) },
+			want:  true,
+		},
+		{
+			name:  "method",
+			route: Route{Methods: []string{"post"}},
+			req:   func() *http.Request { return httptest.NewRequest("GET", "http://example.com/", nil) },
+			want:  false,
+		},
+		{
+			name:  "headers",
+			route: Route{Headers: map[string]string{"X-Tenant": "a"}},
+			req: func() *http.Request {
+				req := httptest.NewRequest("GET", "http://example.com/", nil)
+				req.Header.Set("X-Tenant", "a")
+				return req
+			},
+			want: true,
+		},
+		{
+			name:  "every condition",
+			route: Route{Host: "example.com", PathPrefix: "/api/", Methods: []string{"GET"}, Headers: map[string]string{"X-Tenant": "a"}},
+			req:   func() *http.Request { return httptest.NewRequest("GET", "http://example.com/api/", nil) },
+			want:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.route.init(); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := tt.route.matches(tt.req()); got != tt.want {
+				t.Errorf("Expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRouteRewrite(t *testing.T) {
+	tests := []struct {
+		strip string
+		add   string
+		path  string
+		want  string
+	}{
+		{path: "/api/users", want: "/api/users"},
+		{strip: "/api", path: "/api/users", want: "/users"},
+		{strip: "/api/", path: "/api/users", want: "/users"},
+		{strip: "/api", path: "/api", want: "/"},
+		{add: "/v1", path: "/users/", want: "/v1/users/"},
+		{strip: "/api", add: "/internal/", path: "/api/a%2Fb", want: "/internal/a%2Fb"},
+		{strip: "/other", path: "/api/users", want: "/api/users"},
+	}
+
+	for _, tt := range tests {
+		route := &Route{StripPrefix: tt.strip, AddPrefix: tt.add}
+		req := httptest.NewRequest("GET", "http://example.com"+tt.path, nil)
+		got := route.rewrite(req)
+		if got.URL.EscapedPath() != tt.want {
+			t.Errorf("Expected %q for %q (strip %q, add %q), got %q", tt.want, tt.path, tt.strip, tt.add, got.URL.EscapedPath())
+		}
+		if req.URL.EscapedPath() != tt.path {
+			t.Errorf("Expected the original request to be unchanged, got %q", req.URL.EscapedPath())
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	api := newNamedServer(t, "api")
+	web := newNamedServer(t, "web")
+	fallback := newNamedServer(t, "fallback")
+
+	routes, _, err := loadRoutes(writeRoutes(t, fmt.Sprintf(`{
+		"routes": [
+			{"name": "api", "path_prefix": "/api/", "strip_prefix": "/api", "upstreams": ["%d"]},
+			{"name": "admin", "host": "admin.example.com", "methods": ["POST"], "upstreams": ["%d"], "add_prefix": "/admin"},
+			{"name": "web", "host": "*.example.com", "upstreams": ["%d"]}
+		]
+	}`, api, web, web)))
+	if err != nil {
+		t.Fatalf("Failed to load routes: %v", err)
+	}
+	config := &Config{ToPort: fallback, MaxConns: 1, Routes: routes}
+	rt, err := newRouter(config)
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+	proxy := httptest.NewServer(rt)
+	defer proxy.Close()
+
+	tests := []struct {
+		method string
+		host   string
+		path   string
+		status int
+		want   string
+	}{
+		{method: "GET", host: "example.com", path: "/api/users", status: http.StatusOK, want: "api /users"},
+		{method: "POST", host: "admin.example.com", path: "/users", status: http.StatusOK, want: "web /admin/users"},
+		{method: "GET", host: "admin.example.com", path: "/users", status: http.StatusOK, want: "web /users"},
+		{method: "GET", host: "example.org", path: "/users", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, proxy.URL+tt.path, nil)
+		req.Host = tt.host
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tt.status || (tt.want != "" && string(body) != tt.want) {
+			t.Errorf("Expected %d %q for %s %s%s, got %d %q", tt.status, tt.want, tt.method, tt.host, tt.path, res.StatusCode, body)
+		}
+	}
+
+	// Unmatched requests go to the default route, here the command line targets
+	config.DefaultRoute = &Route{Name: "default"}
+	rt, err = newRouter(config)
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+	res := httptest.NewRecorder()
+	rt.ServeHTTP(res, httptest.NewRequest("GET", "http://example.org/users", nil))
+	if res.Code != http.StatusOK || res.Body.String() != "fallback /users" {
+		t.Errorf("Expected the default route to answer, got %d %q", res.Code, res.Body.String())
+	}
+}
+
+func TestRouterLimitsPerRoute(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := newNamedServer(t, "fast")
+
+	config := &Config{
+		ToPort:         fast,
+		MaxConns:       10,
+		RequestTimeout: 200 * time.Millisecond,
+		Routes: []Route{
+			{Name: "slow", PathPrefix: "/slow", Limit: 1, targets: []Target{{Port: serverPort(t, slow)}}},
+		},
+		DefaultRoute: &Route{Name: "default"},
+	}
+	rt, err := newRouter(config)
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+	proxy := httptest.NewServer(rt)
+	defer proxy.Close()
+
+	go func() {
+		if res, err := http.Get(proxy.URL + "/slow"); err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-started
+
+	res, err := http.Get(proxy.URL + "/slow")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Expected status 504 at the route limit, got %d", res.StatusCode)
+	}
+
+	res, err = http.Get(proxy.URL + "/other")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected the other route not to share the limit, got %d", res.StatusCode)
+	}
+}
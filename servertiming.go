@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// attemptsHeader reports how many attempts a response took
+const attemptsHeader = "X-Flproxy-Attempts"
+
+// setServerTiming adds the time the request waited for a slot and spent on
+// the upstream, including retries, to the Server-Timing header of res. Any
+// Server-Timing entries of the upstream are kept.
+func setServerTiming(res *http.Response, queue, upstream time.Duration, attempts int) {
+	res.Header.Add("Server-Timing", fmt.Sprintf("queue;dur=%s, upstream;dur=%s", millis(queue), millis(upstream)))
+	res.Header.Set(attemptsHeader, strconv.Itoa(attempts))
+}
+
+// millis formats d in milliseconds, as Server-Timing durations are
+func millis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', -1, 64)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestMillis(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{d: 0, want: "0"},
+		{d: 120 * time.Millisecond, want: "120"},
+		{d: 1500 * time.Microsecond, want: "1.5"},
+		{d: 2*time.Second + 345678*time.Nanosecond, want: "2000.345"},
+	}
+
+	for _, tt := range tests {
+		if got := millis(tt.d); got != tt.want {
+			t.Errorf("Expected %q for %v, got %q", tt.want, tt.d, got)
+		}
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			// The first attempt fails, so the response takes two
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Header().Set("Server-Timing", "db;dur=12")
+	}))
+	defer server.Close()
+
+	timing := regexp.MustCompile(`^queue;dur=[0-9.]+, upstream;dur=[0-9.]+$`)
+	tests := []struct {
+		name         string
+		config       Config
+		wantTiming   bool
+		wantUpstream string
+	}{
+		{name: "enabled", config: Config{ServerTiming: true}, wantTiming: true, wantUpstream: "db;dur=12"},
+		{name: "disabled", config: Config{}, wantUpstream: "db;dur=12"},
+		{name: "stripped", config: Config{ServerTiming: true, ResponseHeaders: &HeaderRules{Remove: []string{"Server-Timing", attemptsHeader}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = 0
+			config := tt.config
+			config.ToPort = serverPort(t, server)
+			config.MaxConns = 1
+			proxy, err := newReverseProxy(&config)
+			if err != nil {
+				t.Fatalf("Failed to create proxy: %v", err)
+			}
+			res := httptest.NewRecorder()
+			proxy.ServeHTTP(res, httptest.NewRequest("GET", "http://example.com/", nil))
+
+			values := res.Header().Values("Server-Timing")
+			var want []string
+			if tt.wantUpstream != "" {
+				want = append(want, tt.wantUpstream)
+			}
+			if tt.wantTiming {
+				want = append(want, "queue;dur=..., upstream;dur=...")
+			}
+			if len(values) != len(want) || (tt.wantTiming && !timing.MatchString(values[len(values)-1])) {
+				t.Errorf("Expected Server-Timing %q, got %q", want, values)
+			}
+			attempts := res.Header().Get(attemptsHeader)
+			if tt.wantTiming && attempts != "2" || !tt.wantTiming && attempts != "" {
+				t.Errorf("Expected %s for %t, got %q", attemptsHeader, tt.wantTiming, attempts)
+			}
+		})
+	}
+}
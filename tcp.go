@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"golang.org/x/sync/semaphore"
+)
+
+// Proxy modes
+const (
+	modeHTTP = "http"
+	modeTCP  = "tcp"
+)
+
+// validateMode validates the proxy mode name
+func validateMode(mode string) error {
+	switch mode {
+	case "", modeHTTP, modeTCP, modeForward:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q, expected %s, %s or %s", mode, modeHTTP, modeTCP, modeForward)
+}
+
+// ListenTCPProxy accepts TCP connections and pipes them to the upstreams
+// until a shutdown signal is received.
+func ListenTCPProxy(config *Config) error {
+	proxy, err := newTCPProxy(config)
+	if err != nil {
+		return fmt.Errorf("failed to new proxy: %w", err)
+	}
+	ln, err := listen(config)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	// graceful shutdown
+	go handleSignals(ln, func() { ln.Close() })
+
+	log.Printf("start tcp proxy...(limit:%d)", config.MaxConns)
+	notifyReady()
+	if err := proxy.serve(ln); err != nil {
+		return fmt.Errorf("failed to serve: %w", err)
+	}
+	if !proxy.wait(10 * time.Second) {
+		log.Printf("failed to gracefully shutdown: connections still open")
+	}
+	proxy.health.close()
+	log.Printf("shutdown")
+
+	return nil
+}
+
+// tcpProxy pipes TCP connections to the upstreams. Like customTransport, it
+// limits concurrent connections, balances them across the upstreams and
+// retries failed dials with exponential backoff. A slot is held for the whole
+// life of the connection.
+type tcpProxy struct {
+	sem           *semaphore.Weighted
+	queueTimeout  time.Duration
+	balancer      *balancer
+	health        *healthChecker
+	dialer        *net.Dialer
+	proxyProtocol string
+
+	conns sync.WaitGroup
+}
+
+func newTCPProxy(config *Config) (*tcpProxy, error) {
+	balancer, err := newBalancer(config, newBaseTransport(config))
+	if err != nil {
+		return nil, err
+	}
+	return &tcpProxy{
+		sem:          semaphore.NewWeighted(config.MaxConns),
+		queueTimeout: config.TCPQueueTimeout,
+		balancer:     balancer,
+		// Only outlier detection applies; health checks are HTTP requests
+		health:        newHealthChecker(config),
+		dialer:        &net.Dialer{Timeout: config.DialTimeout, KeepAlive: 30 * time.Second},
+		proxyProtocol: config.UpstreamProxyProtocol,
+	}, nil
+}
+
+// serve accepts connections until ln is closed
+func (p *tcpProxy) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		p.conns.Add(1)
+		go func() {
+			defer p.conns.Done()
+			p.handle(conn)
+		}()
+	}
+}
+
+// wait waits for open connections to finish and reports whether they did
+// before the timeout
+func (p *tcpProxy) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		p.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (p *tcpProxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	// 同時接続数の制御。空きがなければqueueTimeoutまで待ち、それでも空かなければ切断する
+	if !p.sem.TryAcquire(1) {
+		if p.queueTimeout <= 0 {
+			log.Printf("reject connection from %s: connection limit reached", conn.RemoteAddr())
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), p.queueTimeout)
+		err := p.sem.Acquire(ctx, 1)
+		cancel()
+		if err != nil {
+			log.Printf("reject connection from %s: no free slot within %v", conn.RemoteAddr(), p.queueTimeout)
+			return
+		}
+	}
+	defer p.sem.Release(1)
+
+	upstream, u, err := p.dial()
+	if err != nil {
+		log.Printf("fail connection from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer upstream.Close()
+	u.inflight.Add(1)
+	defer u.inflight.Add(-1)
+
+	if p.proxyProtocol != "" {
+		if _, err := upstream.Write(proxyHeader(p.proxyProtocol, conn.RemoteAddr(), conn.LocalAddr())); err != nil {
+			log.Printf("fail connection from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+
+	pipe(conn, upstream)
+}
+
+// dial connects to an upstream, retrying with exponential backoff and
+// preferring a different instance after a failure
+func (p *tcpProxy) dial() (net.Conn, *upstream, error) {
+	var conn net.Conn
+	var picked, failed *upstream
+	tryCount := 0
+	err := backoff.Retry(func() error {
+		tryCount++
+		u := p.balancer.pick(nil, failed)
+		if u == nil {
+			return backoff.Permanent(errNoHealthyUpstream)
+		}
+		network, addr := "tcp", u.host
+		if u.target.Socket != "" {
+			network, addr = "unix", u.target.Socket
+		}
+		var err error
+		conn, err = p.dialer.Dial(network, addr)
+		p.health.observe(u, err)
+		if err != nil {
+			failed = u
+			log.Printf("retry%d: dial %s: %v", tryCount, u.target, err)
+			return err
+		}
+		picked = u
+		return nil
+	}, newBackOffConfig())
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, picked, nil
+}
+
+// closeWriter is implemented by connections supporting half-close, such as
+// *net.TCPConn and *net.UnixConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies bytes in both directions until both sides are done. When one
+// side finishes sending, only the write side of the other is closed, so that
+// the response to a half-closed request still gets through.
+func pipe(client, upstream net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyHalf(upstream, client)
+	}()
+	go func() {
+		defer wg.Done()
+		copyHalf(client, upstream)
+	}()
+	wg.Wait()
+}
+
+// copyHalf copies src to dst and then closes the write side of dst. On an
+// error, both connections are closed to stop the other direction too.
+func copyHalf(dst, src net.Conn) {
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		src.Close()
+		return
+	}
+	if cw, ok := dst.(closeWriter); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTCPEchoServer echoes everything it receives and writes "bye" once the
+// client has finished sending. It returns the port.
+func newTCPEchoServer(t *testing.T) uint {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.Write([]byte("bye"))
+			}()
+		}
+	}()
+	return uint(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// startTCPProxy serves a tcpProxy for config on a local port and returns its address
+func startTCPProxy(t *testing.T, config *Config) string {
+	t.Helper()
+	proxy, err := newTCPProxy(config)
+	if err != nil {
+		t.Fatalf("Failed to create tcp proxy: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go proxy.serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+// dialTCP connects to addr and checks that msg is echoed back
+func dialTCP(t *testing.T, addr, msg string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(msg))
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+		t.Fatalf("Expected echo %q, got %q (%v)", msg, buf, err)
+	}
+	return conn
+}
+
+func TestValidateMode(t *testing.T) {
+	for _, mode := range []string{"", modeHTTP, modeTCP, modeForward} {
+		if err := validateMode(mode); err != nil {
+			t.Errorf("Unexpected error for mode %q: %v", mode, err)
+		}
+	}
+	if err := validateMode("udp"); err == nil {
+		t.Error("Expected error for unknown mode")
+	}
+}
+
+func TestTCPProxyHalfClose(t *testing.T) {
+	addr := startTCPProxy(t, &Config{ToPort: newTCPEchoServer(t), MaxConns: 1})
+
+	conn := dialTCP(t, addr, "hello")
+
+	// After the client finishes sending, the upstream can still answer
+	conn.(*net.TCPConn).CloseWrite()
+	rest, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if string(rest) != "bye" {
+		t.Errorf("Expected %q after half-close, got %q", "bye", rest)
+	}
+}
+
+func TestTCPProxyRejectsExcessConnections(t *testing.T) {
+	addr := startTCPProxy(t, &Config{ToPort: newTCPEchoServer(t), MaxConns: 1})
+
+	first := dialTCP(t, addr, "first")
+
+	// Without a queue timeout, the connection over the limit is closed
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(2 * time.Second))
+	second.Write([]byte("second"))
+	// The close shows as EOF, or as a reset since the proxy didn't read what was sent
+	n, err := second.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); n > 0 || err == nil || ok && netErr.Timeout() {
+		t.Errorf("Expected the connection over the limit to be closed, got %d bytes (%v)", n, err)
+	}
+
+	first.Close()
+	if !waitFor(t, 2*time.Second, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(500 * time.Millisecond))
+		conn.Write([]byte("x"))
+		_, err = conn.Read(make([]byte, 1))
+		return err == nil
+	}) {
+		t.Error("Expected the slot to be released when the connection closes")
+	}
+}
+
+func TestTCPProxyQueuesExcessConnections(t *testing.T) {
+	addr := startTCPProxy(t, &Config{ToPort: newTCPEchoServer(t), MaxConns: 1, TCPQueueTimeout: 3 * time.Second})
+
+	first := dialTCP(t, addr, "first")
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		first.Close()
+	}()
+
+	// The second connection waits for the first one to close
+	start := time.Now()
+	dialTCP(t, addr, "second")
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected the second connection to wait for a slot, took %v", elapsed)
+	}
+}
+
+func TestTCPProxyRetriesDial(t *testing.T) {
+	// A port nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	deadPort := uint(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+
+	addr := startTCPProxy(t, &Config{
+		MaxConns:   2,
+		Targets:    []Target{{Port: deadPort}, {Port: newTCPEchoServer(t)}},
+		LBStrategy: lbRoundRobin,
+	})
+
+	// The dial to the dead port is retried on the other instance
+	for i := 0; i < 2; i++ {
+		dialTCP(t, addr, "hello").Close()
+	}
+}
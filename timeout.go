@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+// Errors returned when one of the upstream timeouts expires.
+// The error handler maps all of them to 504 Gateway Timeout.
+var (
+	errAttemptTimeout        = errors.New("upstream attempt timed out")
+	errRequestTimeout        = errors.New("request deadline exceeded")
+	errDialTimeout           = errors.New("upstream dial timed out")
+	errResponseHeaderTimeout = errors.New("timed out awaiting upstream response headers")
+)
+
+// isTimeout reports whether err was caused by one of the upstream timeouts.
+func isTimeout(err error) bool {
+	return errors.Is(err, errAttemptTimeout) ||
+		errors.Is(err, errRequestTimeout) ||
+		errors.Is(err, errDialTimeout) ||
+		errors.Is(err, errResponseHeaderTimeout)
+}
+
+// timeoutCause returns the timeout error that canceled ctx, or err if ctx was
+// not canceled by one of the upstream timeouts.
+func timeoutCause(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); isTimeout(cause) {
+		return cause
+	}
+	return err
+}
+
+// newBaseTransport creates the transport used to talk to the upstream.
+// Dial errors caused by the dial timeout are reported as errDialTimeout.
+// The protocols spoken to the upstream are chosen by newUpstreamProtocols.
+func newBaseTransport(config *Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		var netErr net.Error
+		if err != nil && ctx.Err() == nil && errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("%w: %w", errDialTimeout, err)
+		}
+		return conn, err
+	}
+	transport.Protocols = newUpstreamProtocols(config)
+	if config.UpstreamProxyProtocol != "" {
+		sendProxyHeader(transport, config.UpstreamProxyProtocol)
+	}
+	return transport
+}
+
+// newRequestContext returns a context that expires after the request timeout,
+// if any. It covers the wait for a semaphore slot and every retry.
+func newRequestContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeoutCause(parent, timeout, errRequestTimeout)
+}
+
+// attempt sends req to the upstream instance u once, applying the per-attempt
+// and response header timeouts. Both stop counting once response headers
+// arrive; the attempt's context is released when the response body is closed.
+func (t *customTransport) attempt(req *http.Request, u *upstream) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	u.inflight.Add(1)
+
+	if t.attemptTimeout > 0 {
+		timer := time.AfterFunc(t.attemptTimeout, func() { cancel(errAttemptTimeout) })
+		defer timer.Stop()
+	}
+	if t.responseHeaderTimeout > 0 {
+		// The timer starts once the whole request, including its body, is written
+		timer := time.AfterFunc(t.responseHeaderTimeout, func() { cancel(errResponseHeaderTimeout) })
+		timer.Stop()
+		defer timer.Stop()
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			WroteRequest: func(httptrace.WroteRequestInfo) {
+				timer.Reset(t.responseHeaderTimeout)
+			},
+		})
+	}
+
+	outreq := req.WithContext(ctx)
+	outreq.URL = u.url(req.URL)
+	injectTraceparent(outreq)
+
+	res, err := u.transport.RoundTrip(outreq)
+	// Failures caused by the client going away say nothing about the upstream
+	if req.Context().Err() == nil {
+		t.health.observe(u, err)
+	}
+	if err != nil {
+		err = timeoutCause(ctx, err)
+		cancel(nil)
+		u.inflight.Add(-1)
+		return nil, err
+	}
+	onBodyClose(res, func() {
+		cancel(nil)
+		u.inflight.Add(-1)
+	})
+	return res, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newSlowServer returns a server that delays its response headers by delay
+// for the first slowCalls calls (all calls when slowCalls is negative)
+func newSlowServer(delay time.Duration, slowCalls int32) (*httptest.Server, *atomic.Int32) {
+	var callCount atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := callCount.Add(1)
+		if slowCalls < 0 || n <= slowCalls {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	return server, &callCount
+}
+
+func TestAttemptTimeoutRetries(t *testing.T) {
+	server, callCount := newSlowServer(time.Second, 1)
+	defer server.Close()
+
+	transport := newTestTransport(t, &Config{ToPort: serverPort(t, server), MaxConns: 1, AttemptTimeout: 100 * time.Millisecond})
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	if got := callCount.Load(); got != 2 {
+		t.Errorf("Expected 2 calls (timed out attempt + retry), got %d", got)
+	}
+}
+
+func TestTimeoutErrors(t *testing.T) {
+	// A tiny retry budget so that the first failure is returned as is
+	noRetry := 0.01
+
+	tests := []struct {
+		name    string
+		config  *Config
+		wantErr error
+	}{
+		{
+			name:    "attempt timeout",
+			config:  &Config{MaxConns: 1, RetryBudgetMinPerSec: noRetry, AttemptTimeout: 50 * time.Millisecond},
+			wantErr: errAttemptTimeout,
+		},
+		{
+			name:    "response header timeout",
+			config:  &Config{MaxConns: 1, RetryBudgetMinPerSec: noRetry, ResponseHeaderTimeout: 50 * time.Millisecond},
+			wantErr: errResponseHeaderTimeout,
+		},
+		{
+			name:    "request timeout",
+			config:  &Config{MaxConns: 1, AttemptTimeout: 50 * time.Millisecond, RequestTimeout: 300 * time.Millisecond},
+			wantErr: errRequestTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := newSlowServer(time.Second, -1)
+			defer server.Close()
+
+			tt.config.ToPort = serverPort(t, server)
+			transport := newTestTransport(t, tt.config)
+
+			req, err := http.NewRequest("GET", server.URL, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+
+			start := time.Now()
+			_, err = transport.RoundTrip(req)
+			elapsed := time.Since(start)
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if elapsed > 800*time.Millisecond {
+				t.Errorf("Expected request to time out quickly, took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestRequestTimeoutCoversQueueWait(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	transport := newTestTransport(t, &Config{ToPort: serverPort(t, server), MaxConns: 1, RequestTimeout: 100 * time.Millisecond})
+
+	// Occupy the only slot
+	customT := transport.(*customTransport)
+	if err := customT.sem.Acquire(context.Background(), 1); err != nil {
+		t.Fatalf("Failed to acquire semaphore: %v", err)
+	}
+	defer customT.sem.Release(1)
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+
+	_, err = transport.RoundTrip(req)
+	if !errors.Is(err, errRequestTimeout) {
+		t.Errorf("Expected error %v, got %v", errRequestTimeout, err)
+	}
+}
+
+func TestAttemptTimeoutDoesNotCutBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("body"))
+	}))
+	defer server.Close()
+
+	transport := newTestTransport(t, &Config{ToPort: serverPort(t, server), MaxConns: 1, AttemptTimeout: 50 * time.Millisecond})
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The attempt timeout stops counting once headers arrive
+	time.Sleep(100 * time.Millisecond)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read body after attempt timeout elapsed: %v", err)
+	}
+	if string(body) != "body" {
+		t.Errorf("Expected body %q, got %q", "body", body)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	transport := newBaseTransport(&Config{DialTimeout: time.Nanosecond})
+
+	req, err := http.NewRequest("GET", "http://127.0.0.1:9", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+
+	_, err = transport.RoundTrip(req)
+	if !errors.Is(err, errDialTimeout) {
+		t.Errorf("Expected error %v, got %v", errDialTimeout, err)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "attempt timeout", err: errAttemptTimeout, want: http.StatusGatewayTimeout},
+		{name: "request timeout", err: errRequestTimeout, want: http.StatusGatewayTimeout},
+		{name: "dial timeout", err: fmt.Errorf("%w: i/o timeout", errDialTimeout), want: http.StatusGatewayTimeout},
+		{name: "response header timeout", err: errResponseHeaderTimeout, want: http.StatusGatewayTimeout},
+		{name: "no healthy upstream", err: errNoHealthyUpstream, want: http.StatusServiceUnavailable},
+		{name: "upgrade limit", err: errUpgradeLimitExceeded, want: http.StatusServiceUnavailable},
+		{name: "unauthenticated", err: fmt.Errorf("%w: invalid API key", errUnauthenticated), want: http.StatusUnauthorized},
+		{name: "other error", err: errors.New("connection refused"), want: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorStatus(tt.err); got != tt.want {
+				t.Errorf("Expected status %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestReverseProxyTimeoutStatus(t *testing.T) {
+	targetServer, _ := newSlowServer(time.Second, -1)
+	defer targetServer.Close()
+
+	proxy, err := newReverseProxy(&Config{
+		ToPort:         serverPort(t, targetServer),
+		MaxConns:       1,
+		AttemptTimeout: 50 * time.Millisecond,
+		RequestTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create reverse proxy: %v", err)
+	}
+
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	resp, err := http.Get(proxyServer.URL)
+	if err != nil {
+		t.Fatalf("Failed to make request through proxy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Expected status 504, got %d", resp.StatusCode)
+	}
+}
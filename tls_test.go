@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing certificates for tests
+type testCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	serial  int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "flproxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse CA certificate: %v", err)
+	}
+	return &testCA{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		serial:  1,
+	}
+}
+
+// issue returns a PEM encoded certificate and key for localhost signed by the CA
+func (ca *testCA) issue(t *testing.T, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	ca.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes data to name in dir and returns the path
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+	return path
+}
+
+// serveTLS serves handler over TLS with tlsConfig on a local port and returns its address
+func serveTLS(t *testing.T, tlsConfig *tls.Config, handler http.Handler) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(tls.NewListener(ln, tlsConfig))
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	if v, err := parseTLSVersion("1.3"); err != nil || v != tls.VersionTLS13 {
+		t.Errorf("Expected TLS 1.3, got %x (%v)", v, err)
+	}
+	if _, err := parseTLSVersion("3.0"); err == nil {
+		t.Error("Expected error for unknown TLS version")
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	ids, err := parseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}
+	if len(ids) != len(want) || ids[0] != want[0] || ids[1] != want[1] {
+		t.Errorf("Expected %v, got %v", want, ids)
+	}
+
+	if ids, err := parseCipherSuites(""); err != nil || ids != nil {
+		t.Errorf("Expected nil cipher suites for empty string, got %v (%v)", ids, err)
+	}
+
+	if _, err := parseCipherSuites("TLS_UNKNOWN"); err == nil {
+		t.Error("Expected error for unknown cipher suite")
+	}
+}
+
+func TestNewServerTLSConfigDisabled(t *testing.T) {
+	tlsConfig, err := newServerTLSConfig(&Config{})
+	if err != nil || tlsConfig != nil {
+		t.Errorf("Expected no TLS config, got %v (%v)", tlsConfig, err)
+	}
+
+	if _, err := newServerTLSConfig(&Config{TLSCertFile: "cert.pem"}); err == nil {
+		t.Error("Expected error for certificate without key")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, x509.ExtKeyUsageServerAuth)
+	certFile := writeFile(t, dir, "cert.pem", certPEM)
+	keyFile := writeFile(t, dir, "key.pem", keyPEM)
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to create reloader: %v", err)
+	}
+	reloader.checkInterval = 0
+
+	first, err := reloader.getCertificate(nil)
+	if err != nil {
+		t.Fatalf("Failed to get certificate: %v", err)
+	}
+
+	// Replace the files with a new certificate
+	certPEM, keyPEM = ca.issue(t, x509.ExtKeyUsageServerAuth)
+	writeFile(t, dir, "cert.pem", certPEM)
+	writeFile(t, dir, "key.pem", keyPEM)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	second, err := reloader.getCertificate(nil)
+	if err != nil {
+		t.Fatalf("Failed to get certificate: %v", err)
+	}
+	if bytes.Equal(first.Certificate[0], second.Certificate[0]) {
+		t.Error("Expected the certificate to be reloaded after the files changed")
+	}
+
+	// A broken file keeps the current certificate
+	writeFile(t, dir, "cert.pem", []byte("broken"))
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+
+	third, err := reloader.getCertificate(nil)
+	if err != nil {
+		t.Fatalf("Failed to get certificate: %v", err)
+	}
+	if !bytes.Equal(second.Certificate[0], third.Certificate[0]) {
+		t.Error("Expected the current certificate to be kept when reloading fails")
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, x509.ExtKeyUsageServerAuth)
+
+	tlsConfig, err := newServerTLSConfig(&Config{
+		TLSCertFile:   writeFile(t, dir, "cert.pem", certPEM),
+		TLSKeyFile:    writeFile(t, dir, "key.pem", keyPEM),
+		TLSMinVersion: tls.VersionTLS13,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create TLS config: %v", err)
+	}
+	addr := serveTLS(t, tlsConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	resp, err := client.Get("https://" + addr)
+	if err != nil {
+		t.Fatalf("Failed to make HTTPS request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "secure" {
+		t.Errorf("Expected body %q, got %q", "secure", body)
+	}
+
+	// Clients below the minimum version are rejected
+	oldClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS12}}}
+	if _, err := oldClient.Get("https://" + addr); err == nil {
+		t.Error("Expected TLS 1.2 client to be rejected")
+	}
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, x509.ExtKeyUsageServerAuth)
+
+	tlsConfig, err := newServerTLSConfig(&Config{
+		TLSCertFile:     writeFile(t, dir, "cert.pem", certPEM),
+		TLSKeyFile:      writeFile(t, dir, "key.pem", keyPEM),
+		TLSClientCAFile: writeFile(t, dir, "ca.pem", ca.certPEM),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create TLS config: %v", err)
+	}
+	addr := serveTLS(t, tlsConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	// Without a client certificate
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if _, err := client.Get("https://" + addr); err == nil {
+		t.Error("Expected request without a client certificate to be rejected")
+	}
+
+	// With a client certificate signed by the CA
+	clientCertPEM, clientKeyPEM := ca.issue(t, x509.ExtKeyUsageClientAuth)
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatalf("Failed to load client certificate: %v", err)
+	}
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}}}
+	resp, err := client.Get("https://" + addr)
+	if err != nil {
+		t.Fatalf("Failed to make request with a client certificate: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestUpstreamTLSClientConfigErrors(t *testing.T) {
+	if _, err := (&UpstreamTLS{CertFile: "client.pem"}).clientConfig(); err == nil {
+		t.Error("Expected error for client certificate without key")
+	}
+	if _, err := (&UpstreamTLS{CAFile: filepath.Join(t.TempDir(), "missing.pem")}).clientConfig(); err == nil {
+		t.Error("Expected error for missing CA file")
+	}
+	if _, err := newCustomTransport(&Config{MaxConns: 1, Targets: []Target{{Port: 9090, TLS: &UpstreamTLS{KeyFile: "key.pem"}}}}); err == nil {
+		t.Error("Expected transport creation to fail with an invalid upstream TLS configuration")
+	}
+}
+
+func TestCustomTransportUpstreamTLS(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, x509.ExtKeyUsageServerAuth)
+	clientCertPEM, clientKeyPEM := ca.issue(t, x509.ExtKeyUsageClientAuth)
+	caFile := writeFile(t, dir, "ca.pem", ca.certPEM)
+	clientCertFile := writeFile(t, dir, "client.pem", clientCertPEM)
+	clientKeyFile := writeFile(t, dir, "client-key.pem", clientKeyPEM)
+
+	serverConfig, err := newServerTLSConfig(&Config{
+		TLSCertFile: writeFile(t, dir, "cert.pem", certPEM),
+		TLSKeyFile:  writeFile(t, dir, "key.pem", keyPEM),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create TLS config: %v", err)
+	}
+	mtlsConfig := serverConfig.Clone()
+	mtlsConfig.ClientCAs = x509.NewCertPool()
+	mtlsConfig.ClientCAs.AddCert(ca.cert)
+	mtlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Header().Set("X-Client-Cert", r.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+		w.Write([]byte("secure"))
+	})
+	_, port, _ := net.SplitHostPort(serveTLS(t, serverConfig, handler))
+	_, mtlsPort, _ := net.SplitHostPort(serveTLS(t, mtlsConfig, handler))
+
+	tests := []struct {
+		name           string
+		port           string
+		tls            *UpstreamTLS
+		wantErr        bool
+		wantClientCert bool
+	}{
+		{
+			name: "verified with custom CA",
+			port: port,
+			tls:  &UpstreamTLS{CAFile: caFile},
+		},
+		{
+			name:    "unknown CA",
+			port:    port,
+			tls:     &UpstreamTLS{},
+			wantErr: true,
+		},
+		{
+			name: "insecure skip verify",
+			port: port,
+			tls:  &UpstreamTLS{InsecureSkipVerify: true},
+		},
+		{
+			name:    "server name mismatch",
+			port:    port,
+			tls:     &UpstreamTLS{CAFile: caFile, ServerName: "backend.internal"},
+			wantErr: true,
+		},
+		{
+			name:           "mutual TLS",
+			port:           mtlsPort,
+			tls:            &UpstreamTLS{CAFile: caFile, CertFile: clientCertFile, KeyFile: clientKeyFile},
+			wantClientCert: true,
+		},
+		{
+			name:    "mutual TLS without client certificate",
+			port:    mtlsPort,
+			tls:     &UpstreamTLS{CAFile: caFile},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := strconv.Atoi(tt.port)
+			if err != nil {
+				t.Fatalf("Failed to parse port: %v", err)
+			}
+			// Allow a single retry so that failures are reported quickly
+			transport := newTestTransport(t, &Config{
+				MaxConns:             1,
+				Targets:              []Target{{Port: uint(p), TLS: tt.tls}},
+				RetryBudgetMinPerSec: 0.1,
+			})
+
+			req, err := http.NewRequest("GET", "http://localhost/", nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			resp, err := transport.RoundTrip(req)
+			if tt.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RoundTrip failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != "secure" {
+				t.Errorf("Expected body %q, got %q", "secure", body)
+			}
+			if got := resp.Header.Get("X-Client-Cert"); tt.wantClientCert && got != "localhost" {
+				t.Errorf("Expected client certificate to be presented, got %q", got)
+			}
+		})
+	}
+}
+
+func TestRouterUpstreamTLSPerTarget(t *testing.T) {
+	dir := t.TempDir()
+	// Each backend has a certificate from its own CA
+	serve := func(name string) (port uint, caFile string) {
+		ca := newTestCA(t)
+		certPEM, keyPEM := ca.issue(t, x509.ExtKeyUsageServerAuth)
+		serverConfig, err := newServerTLSConfig(&Config{
+			TLSCertFile: writeFile(t, dir, name+"-cert.pem", certPEM),
+			TLSKeyFile:  writeFile(t, dir, name+"-key.pem", keyPEM),
+		})
+		if err != nil {
+			t.Fatalf("Failed to create TLS config: %v", err)
+		}
+		addr := serveTLS(t, serverConfig, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		_, p, _ := net.SplitHostPort(addr)
+		n, _ := strconv.Atoi(p)
+		return uint(n), writeFile(t, dir, name+"-ca.pem", ca.certPEM)
+	}
+	billing, billingCA := serve("billing")
+	search, searchCA := serve("search")
+	plain := newNamedServer(t, "plain")
+
+	routes, def, err := loadRoutes(writeRoutes(t, fmt.Sprintf(`{
+		"routes": [
+			{"name": "billing", "path_prefix": "/billing/", "upstreams": [{"address": "%d", "tls": {"ca": %q}}]},
+			{"name": "search", "path_prefix": "/search/", "upstreams": [{"address": "%d", "tls": {"ca": %q}}]},
+			{"name": "wrong-ca", "path_prefix": "/wrong/", "max_retries": -1, "upstreams": [{"address": "%d", "tls": {"ca": %q}}]}
+		],
+		"default": {"upstreams": ["%d"]}
+	}`, billing, billingCA, search, searchCA, search, billingCA, plain)))
+	if err != nil {
+		t.Fatalf("Failed to load routes: %v", err)
+	}
+	rt, err := newRouter(&Config{MaxConns: 1, Routes: routes, DefaultRoute: def})
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{path: "/billing/invoices", status: http.StatusOK, want: "billing"},
+		{path: "/search/items", status: http.StatusOK, want: "search"},
+		{path: "/wrong/items", status: http.StatusBadGateway},
+		{path: "/other", status: http.StatusOK, want: "plain /other"},
+	}
+	for _, tt := range tests {
+		res := httptest.NewRecorder()
+		rt.ServeHTTP(res, httptest.NewRequest("GET", "http://example.com"+tt.path, nil))
+		if res.Code != tt.status || (tt.want != "" && res.Body.String() != tt.want) {
+			t.Errorf("Expected %d %q for %s, got %d %q", tt.status, tt.want, tt.path, res.Code, res.Body.String())
+		}
+	}
+}
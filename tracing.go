@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceparentHeader carries the W3C trace context of a request
+const traceparentHeader = "Traceparent"
+
+const (
+	// traceQueueSize is the number of finished spans buffered for export.
+	// Spans ended while the queue is full are dropped.
+	traceQueueSize = 2048
+	// traceBatchSize is the maximum number of spans sent in one export
+	traceBatchSize = 512
+	// traceExportInterval is how often buffered spans are exported
+	traceExportInterval = 5 * time.Second
+	// traceExportTimeout is the timeout of a single export request
+	traceExportTimeout = 10 * time.Second
+)
+
+// Span kinds of OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// otlpStatusError is the OTLP status code of a failed span
+const otlpStatusError = 2
+
+// validateTraceEndpoint validates the base URL of the OTLP/HTTP collector
+func validateTraceEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("OTLP endpoint must be an http or https URL, got %q", endpoint)
+	}
+	return nil
+}
+
+// spanContext identifies a span within a trace, as carried by traceparent
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// parseTraceparent parses a W3C traceparent header value
+func parseTraceparent(s string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	version, err1 := hex.DecodeString(parts[0])
+	traceID, err2 := hex.DecodeString(parts[1])
+	spanID, err3 := hex.DecodeString(parts[2])
+	flags, err4 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || len(version) != 1 || len(traceID) != 16 || len(spanID) != 8 || len(flags) != 1 {
+		return sc, false
+	}
+	// Upper case hex is not allowed
+	if strings.ToLower(s) != s {
+		return sc, false
+	}
+	copy(sc.traceID[:], traceID)
+	copy(sc.spanID[:], spanID)
+	if sc.traceID == [16]byte{} || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+	sc.sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// traceparent returns the traceparent header value of the span context
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-" + flags
+}
+
+// tracer starts the server span of each proxied request and exports the
+// finished spans to an OTLP/HTTP collector as JSON.
+//
+// A nil *tracer disables tracing.
+type tracer struct {
+	serviceName string
+	sampleRatio float64
+	exportURL   string
+	client      *http.Client
+
+	spans chan *span
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// newTracer creates a tracer exporting to config.TraceEndpoint and starts its
+// exporter. It returns nil, meaning no tracing, when no endpoint is set.
+func newTracer(config *Config) *tracer {
+	if config.TraceEndpoint == "" {
+		return nil
+	}
+	t := &tracer{
+		serviceName: config.TraceServiceName,
+		sampleRatio: config.TraceSampleRatio,
+		exportURL:   strings.TrimSuffix(config.TraceEndpoint, "/") + "/v1/traces",
+		client:      &http.Client{Timeout: traceExportTimeout},
+		spans:       make(chan *span, traceQueueSize),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// startServer starts the server span of req, continuing the trace of the
+// client's traceparent if there is one
+func (t *tracer) startServer(req *http.Request) (context.Context, *span) {
+	if t == nil {
+		return req.Context(), nil
+	}
+	s := &span{tracer: t, name: req.Method, kind: spanKindServer, start: time.Now()}
+	if parent, ok := parseTraceparent(req.Header.Get(traceparentHeader)); ok {
+		s.sc.traceID, s.sc.sampled = parent.traceID, parent.sampled
+		s.parentID = parent.spanID
+	} else {
+		binary.BigEndian.PutUint64(s.sc.traceID[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(s.sc.traceID[8:], rand.Uint64()|1)
+		s.sc.sampled = rand.Float64() < t.sampleRatio
+	}
+	binary.BigEndian.PutUint64(s.sc.spanID[:], rand.Uint64()|1)
+	return withSpan(req.Context(), s), s
+}
+
+// shutdown exports the buffered spans and stops the exporter
+func (t *tracer) shutdown(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() { close(t.stop) })
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+	}
+}
+
+func (t *tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) >= traceBatchSize {
+				t.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = nil
+		case <-t.stop:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					for len(batch) > 0 {
+						n := min(len(batch), traceBatchSize)
+						t.export(batch[:n])
+						batch = batch[n:]
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// export sends spans to the collector
+func (t *tracer) export(spans []*span) {
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(t.request(spans))
+	if err != nil {
+		log.Printf("failed to export %d spans: %v", len(spans), err)
+		return
+	}
+	res, err := t.client.Post(t.exportURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("failed to export %d spans: %v", len(spans), err)
+		return
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		log.Printf("failed to export %d spans: collector answered %s", len(spans), res.Status)
+	}
+}
+
+// OTLP/HTTP JSON encoding of ExportTraceServiceRequest. IDs are hex and
+// 64 bit integers are strings.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            *otlpStatus     `json:"status,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func (t *tracer) request(spans []*span) otlpRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		out = append(out, s.otlp())
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{otlpAttr("service.name", t.serviceName)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "flow-limit-proxy"}, Spans: out}},
+	}}}
+}
+
+func otlpAttr(key string, value any) otlpAttribute {
+	var v otlpValue
+	switch x := value.(type) {
+	case string:
+		v.StringValue = &x
+	case int:
+		s := strconv.Itoa(x)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		v.IntValue = &s
+	case bool:
+		v.BoolValue = &x
+	case float64:
+		v.DoubleValue = &x
+	default:
+		s := fmt.Sprint(x)
+		v.StringValue = &s
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
+
+// span is a timed operation within a trace. Spans of unsampled traces are
+// only used to propagate the trace context and are not exported.
+//
+// A nil *span does nothing, so that code can be traced unconditionally.
+type span struct {
+	tracer   *tracer
+	name     string
+	kind     int
+	sc       spanContext
+	parentID [8]byte
+	start    time.Time
+
+	mu    sync.Mutex
+	attrs map[string]any
+	err   string
+	ended bool
+	end   time.Time
+}
+
+type spanKey struct{}
+
+// withSpan returns ctx carrying s as the current span
+func withSpan(ctx context.Context, s *span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// spanFromContext returns the current span of ctx, or nil
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// startSpan starts a child of the current span of ctx. Without a current
+// span, tracing is disabled and it returns nil.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := &span{tracer: parent.tracer, name: name, kind: kind, sc: parent.sc, parentID: parent.sc.spanID, start: time.Now()}
+	binary.BigEndian.PutUint64(s.sc.spanID[:], rand.Uint64()|1)
+	return withSpan(ctx, s), s
+}
+
+// setAttr sets an attribute of the span
+func (s *span) setAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = map[string]any{}
+	}
+	s.attrs[key] = value
+}
+
+// setError marks the span as failed with err
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// finish ends the span, marking it as failed if err is not nil, and queues it
+// for export. Only the first call has an effect.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.setError(err)
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	if !s.sc.sampled {
+		return
+	}
+	select {
+	case s.tracer.spans <- s:
+	default:
+	}
+}
+
+// injectTraceparent sets the traceparent of the current span of req on its
+// headers. The headers are copied first, since they may be shared with
+// other attempts.
+func injectTraceparent(req *http.Request) {
+	s := spanFromContext(req.Context())
+	if s == nil {
+		return
+	}
+	req.Header = req.Header.Clone()
+	req.Header.Set(traceparentHeader, s.sc.traceparent())
+}
+
+func (s *span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.sc.traceID[:]),
+		SpanID:            hex.EncodeToString(s.sc.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	keys := make([]string, 0, len(s.attrs))
+	for k := range s.attrs {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		out.Attributes = append(out.Attributes, otlpAttr(k, s.attrs[k]))
+	}
+	if s.err != "" {
+		out.Status = &otlpStatus{Code: otlpStatusError, Message: s.err}
+	}
+	return out
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCollector stands in for an OTLP/HTTP collector and keeps the spans it
+// receives
+type testCollector struct {
+	*httptest.Server
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func newTestCollector(t *testing.T) *testCollector {
+	t.Helper()
+	c := &testCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Expected JSON posted to /v1/traces, got %s %s", r.Header.Get("Content-Type"), r.URL.Path)
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Failed to decode export request: %v", err)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			if name := rs.Resource.Attributes[0]; name.Key != "service.name" || *name.Value.StringValue != "test-proxy" {
+				t.Errorf("Expected service.name test-proxy, got %+v", name)
+			}
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// byName returns the received spans with name
+func (c *testCollector) byName(name string) []otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []otlpSpan
+	for _, s := range c.spans {
+		if s.Name == name {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// attr returns the value of an attribute of s as a string
+func attr(s otlpSpan, key string) string {
+	for _, a := range s.Attributes {
+		if a.Key != key {
+			continue
+		}
+		switch {
+		case a.Value.StringValue != nil:
+			return *a.Value.StringValue
+		case a.Value.IntValue != nil:
+			return *a.Value.IntValue
+		}
+	}
+	return ""
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ok: true, sampled: true},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", ok: true, sampled: false},
+		{value: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", ok: true, sampled: true},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", ok: false},
+		{value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ok: false},
+		{value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", ok: false},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", ok: false},
+		{value: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", ok: false},
+		{value: "00-4bf92f3577b34da6-00f067aa0ba902b7-01", ok: false},
+		{value: "", ok: false},
+	}
+
+	for _, tt := range tests {
+		sc, ok := parseTraceparent(tt.value)
+		if ok != tt.ok || sc.sampled != tt.sampled {
+			t.Errorf("Expected %t %t for %q, got %t %t", tt.ok, tt.sampled, tt.value, ok, sc.sampled)
+		}
+		if ok && tt.value[:2] == "00" && sc.traceparent() != tt.value {
+			t.Errorf("Expected %q to round trip, got %q", tt.value, sc.traceparent())
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	collector := newTestCollector(t)
+
+	// The first attempt fails, so the request is retried once
+	var mu sync.Mutex
+	var calls int
+	var upstreamTraceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/items" {
+			return
+		}
+		calls++
+		first := calls == 1
+		upstreamTraceparent = r.Header.Get(traceparentHeader)
+		if first {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	config := &Config{
+		ToPort:           serverPort(t, server),
+		MaxConns:         1,
+		TraceEndpoint:    collector.URL,
+		TraceServiceName: "test-proxy",
+		TraceSampleRatio: 0,
+	}
+	proxy, err := newReverseProxy(config)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	tracer := newTracer(config)
+	handler := newRequestIDHandler(proxy, false, tracer, nil)
+
+	// The client's sampled trace is continued even though the ratio is 0
+	const clientTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "http://example.com/items", nil)
+	req.Header.Set(traceparentHeader, "00-"+clientTrace+"-00f067aa0ba902b7-01")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", res.Code)
+	}
+
+	// Unsampled traces are not exported
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/other", nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tracer.shutdown(ctx)
+
+	servers := collector.byName("GET")
+	if len(servers) != 1 {
+		t.Fatalf("Expected 1 server span, got %d", len(servers))
+	}
+	root := servers[0]
+	if root.TraceID != clientTrace || root.ParentSpanID != "00f067aa0ba902b7" || root.Kind != spanKindServer {
+		t.Errorf("Expected the server span to continue the client's trace, got %+v", root)
+	}
+	if attr(root, "http.response.status_code") != "201" || attr(root, "url.path") != "/items" || attr(root, "flproxy.request_id") != res.Header().Get(requestIDHeader) {
+		t.Errorf("Expected request attributes on the server span, got %+v", root.Attributes)
+	}
+
+	waits := collector.byName("queue wait")
+	if len(waits) != 1 || waits[0].ParentSpanID != root.SpanID {
+		t.Errorf("Expected 1 queue wait span under the server span, got %+v", waits)
+	}
+
+	attempts := collector.byName("upstream attempt")
+	if len(attempts) != 2 {
+		t.Fatalf("Expected 2 attempt spans, got %d", len(attempts))
+	}
+	for i, a := range attempts {
+		if a.ParentSpanID != root.SpanID || a.TraceID != clientTrace || a.Kind != spanKindClient {
+			t.Errorf("Expected attempt %d under the server span, got %+v", i, a)
+		}
+		if attr(a, "flproxy.retry") != []string{"0", "1"}[i] {
+			t.Errorf("Expected retry number %d, got %q", i, attr(a, "flproxy.retry"))
+		}
+	}
+	if attempts[0].Status == nil || attempts[0].Status.Code != otlpStatusError || attempts[0].Status.Message == "" {
+		t.Errorf("Expected the first attempt to fail with an error status, got %+v", attempts[0].Status)
+	}
+	if attempts[1].Status != nil || attr(attempts[1], "http.response.status_code") != "201" {
+		t.Errorf("Expected the second attempt to succeed, got %+v", attempts[1])
+	}
+
+	want := "00-" + clientTrace + "-" + attempts[1].SpanID + "-01"
+	if upstreamTraceparent != want {
+		t.Errorf("Expected the upstream to get traceparent %q, got %q", want, upstreamTraceparent)
+	}
+}
+
+func TestOTLPPayload(t *testing.T) {
+	tracer := &tracer{serviceName: "test-proxy"}
+	start := time.Unix(1700000000, 123456789)
+	sc, _ := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	root := &span{tracer: tracer, name: "GET", kind: spanKindServer, sc: sc, start: start, end: start.Add(time.Second)}
+	child := &span{tracer: tracer, name: "upstream attempt", kind: spanKindClient, sc: root.sc, parentID: root.sc.spanID, start: start, end: start.Add(5 * time.Millisecond)}
+	copy(child.sc.spanID[:], []byte{0x53, 0x99, 0x5c, 0x3f, 0x42, 0xcd, 0x8a, 0xd8})
+	child.setAttr("http.response.status_code", 502)
+	child.setAttr("flproxy.hedge", true)
+	child.setError(errors.New("connection reset"))
+
+	body, err := json.Marshal(tracer.request([]*span{root, child}))
+	if err != nil {
+		t.Fatalf("Failed to encode export request: %v", err)
+	}
+
+	// The OTLP JSON mapping: lowercase hex IDs, nanosecond timestamps and
+	// int64 values as strings, enums as integers
+	const want = `{"resourceSpans": [{
+		"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "test-proxy"}}]},
+		"scopeSpans": [{
+			"scope": {"name": "flow-limit-proxy"},
+			"spans": [
+				{
+					"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+					"spanId": "00f067aa0ba902b7",
+					"name": "GET",
+					"kind": 2,
+					"startTimeUnixNano": "1700000000123456789",
+					"endTimeUnixNano": "1700000001123456789"
+				},
+				{
+					"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+					"spanId": "53995c3f42cd8ad8",
+					"parentSpanId": "00f067aa0ba902b7",
+					"name": "upstream attempt",
+					"kind": 3,
+					"startTimeUnixNano": "1700000000123456789",
+					"endTimeUnixNano": "1700000000128456789",
+					"attributes": [
+						{"key": "flproxy.hedge", "value": {"boolValue": true}},
+						{"key": "http.response.status_code", "value": {"intValue": "502"}}
+					],
+					"status": {"code": 2, "message": "connection reset"}
+				}
+			]
+		}]
+	}]}`
+	var got, expected any
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("Failed to decode export request: %v", err)
+	}
+	if err := json.Unmarshal([]byte(want), &expected); err != nil {
+		t.Fatalf("Failed to decode the expected request: %v", err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected payload %s, got %s", want, body)
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(traceparentHeader)
+	}))
+	defer server.Close()
+
+	config := &Config{ToPort: serverPort(t, server), MaxConns: 1}
+	if newTracer(config) != nil {
+		t.Fatal("Expected no tracer without an endpoint")
+	}
+	proxy, err := newReverseProxy(config)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	// The client's traceparent passes through unchanged
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set(traceparentHeader, traceparent)
+	newRequestIDHandler(proxy, false, nil, nil).ServeHTTP(httptest.NewRecorder(), req)
+	if got != traceparent {
+		t.Errorf("Expected traceparent %q, got %q", traceparent, got)
+	}
+}
+
+func TestTracerExportFailure(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+	logs := captureLog(t)
+
+	tracer := newTracer(&Config{TraceEndpoint: collector.URL + "/", TraceSampleRatio: 1})
+	_, s := tracer.startServer(httptest.NewRequest("GET", "http://example.com/", nil))
+	s.finish(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tracer.shutdown(ctx)
+
+	if !strings.Contains(logs.String(), "failed to export 1 spans: collector answered 503") {
+		t.Errorf("Expected the export failure to be logged, got %q", logs.String())
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+// unixPrefix marks a unix domain socket in a port mapping, e.g. "unix:/run/app.sock"
+const unixPrefix = "unix:"
+
+// listenUnix listens on the unix domain socket at path. A socket file left
+// behind by a previous process is replaced, but one that still accepts
+// connections is not.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// newUnixTransport returns a copy of base that connects to the unix domain
+// socket at path regardless of the request's host. The dial timeout of base
+// still applies.
+func newUnixTransport(base *http.Transport, path string) *http.Transport {
+	dial := base.DialContext
+	transport := base.Clone()
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dial(ctx, "unix", path)
+	}
+	return transport
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// newUnixServer serves handler on a unix domain socket and returns its path
+func newUnixServer(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "app.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", path, err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = ln
+	server.Start()
+	t.Cleanup(server.Close)
+	return path
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flproxy.sock")
+
+	ln, err := listenUnix(path)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	// A socket that still accepts connections is not replaced
+	if _, err := listenUnix(path); err == nil {
+		t.Error("Expected error for a socket in use")
+	}
+
+	// A stale socket file is replaced
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = listenUnix(path)
+	if err != nil {
+		t.Fatalf("Failed to replace stale socket: %v", err)
+	}
+	ln.Close()
+}
+
+func TestCustomTransportUnixSocket(t *testing.T) {
+	path := newUnixServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("unix " + r.URL.Path))
+	}))
+
+	transport := newTestTransport(t, &Config{MaxConns: 1, Targets: []Target{{Socket: path}}})
+
+	req, err := http.NewRequest("GET", "http://localhost/hello", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "unix /hello" {
+		t.Errorf("Expected body %q, got %q", "unix /hello", body)
+	}
+}
+
+func TestCustomTransportUnixSocketRetry(t *testing.T) {
+	// The first socket doesn't exist, so the retry goes to the second one
+	missing := filepath.Join(t.TempDir(), "missing.sock")
+	path := newUnixServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	transport := newTestTransport(t, &Config{
+		MaxConns:   1,
+		Targets:    []Target{{Socket: missing}, {Socket: path}},
+		LBStrategy: lbRoundRobin,
+	})
+
+	req, err := http.NewRequest("GET", "http://localhost/", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestReverseProxyOnUnixSocket(t *testing.T) {
+	target := newUnixServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxied"))
+	}))
+
+	config := &Config{MaxConns: 1, ListenSocket: filepath.Join(t.TempDir(), "flproxy.sock"), Targets: []Target{{Socket: target}}}
+	proxy, err := newReverseProxy(config)
+	if err != nil {
+		t.Fatalf("Failed to create reverse proxy: %v", err)
+	}
+	ln, err := listen(config)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := &http.Server{Handler: proxy}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	client := &http.Client{Transport: newUnixTransport(newBaseTransport(&Config{}), config.ListenSocket)}
+	resp, err := client.Get("http://flproxy/")
+	if err != nil {
+		t.Fatalf("Failed to make request through proxy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "proxied" {
+		t.Errorf("Expected body %q, got %q", "proxied", body)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// errUpgradeLimitExceeded is returned when the limit of upgraded connections
+// is reached. The error handler maps it to 503 Service Unavailable.
+var errUpgradeLimitExceeded = errors.New("upgraded connection limit exceeded")
+
+// isUpgrade reports whether req asks to switch protocols, e.g. to WebSocket
+func isUpgrade(req *http.Request) bool {
+	return req.Header.Get("Upgrade") != ""
+}
+
+// upgradeLimiter limits upgraded connections such as WebSockets. Unlike the
+// concurrency limit, which is released once response headers arrive, a slot
+// is held for the lifetime of the tunnel. Tunnels are closed when idle or
+// after their maximum lifetime.
+//
+// A nil *upgradeLimiter applies no limit and no timeouts.
+type upgradeLimiter struct {
+	sem         *semaphore.Weighted // nil means unlimited
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+}
+
+// newUpgradeLimiter creates an upgradeLimiter. It returns nil when neither a
+// limit nor timeouts are configured.
+func newUpgradeLimiter(config *Config) *upgradeLimiter {
+	if config.UpgradeLimit <= 0 && config.UpgradeIdleTimeout <= 0 && config.UpgradeMaxLifetime <= 0 {
+		return nil
+	}
+	l := &upgradeLimiter{
+		idleTimeout: config.UpgradeIdleTimeout,
+		maxLifetime: config.UpgradeMaxLifetime,
+	}
+	if config.UpgradeLimit > 0 {
+		l.sem = semaphore.NewWeighted(config.UpgradeLimit)
+	}
+	return l
+}
+
+// acquire takes a slot for an upgrade request. It fails immediately rather
+// than queueing when the limit is reached, since tunnels may stay open for
+// hours. The returned function releases the slot.
+func (l *upgradeLimiter) acquire(req *http.Request) (func(), error) {
+	if l == nil || l.sem == nil || !isUpgrade(req) {
+		return func() {}, nil
+	}
+	if !l.sem.TryAcquire(1) {
+		return nil, errUpgradeLimitExceeded
+	}
+	return func() { l.sem.Release(1) }, nil
+}
+
+// watch applies the idle and lifetime timeouts to the tunnel of a 101
+// Switching Protocols response
+func (l *upgradeLimiter) watch(res *http.Response) {
+	if l == nil || res.StatusCode != http.StatusSwitchingProtocols {
+		return
+	}
+	rwc, ok := res.Body.(io.ReadWriteCloser)
+	if !ok || (l.idleTimeout <= 0 && l.maxLifetime <= 0) {
+		return
+	}
+	t := &tunnel{ReadWriteCloser: rwc, idleTimeout: l.idleTimeout, requestID: requestIDFromContext(res.Request.Context())}
+	// The timers may fire before they are both set
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l.idleTimeout > 0 {
+		t.idle = time.AfterFunc(l.idleTimeout, func() { t.expire("idle") })
+	}
+	if l.maxLifetime > 0 {
+		t.lifetime = time.AfterFunc(l.maxLifetime, func() { t.expire("maximum lifetime reached") })
+	}
+	res.Body = t
+}
+
+// tunnel is the upstream side of an upgraded connection. The proxy reads what
+// the upstream sends and writes what the client sends through it, so both
+// directions count as activity.
+type tunnel struct {
+	io.ReadWriteCloser
+	idleTimeout time.Duration
+	requestID   string
+	idle        *time.Timer
+	lifetime    *time.Timer
+	mu          sync.Mutex // guards the timers and closed
+	closed      bool
+	once        sync.Once
+}
+
+func (t *tunnel) Read(p []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Read(p)
+	t.touch(n)
+	return n, err
+}
+
+func (t *tunnel) Write(p []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Write(p)
+	t.touch(n)
+	return n, err
+}
+
+func (t *tunnel) touch(n int) {
+	if n == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.idle != nil && !t.closed {
+		t.idle.Reset(t.idleTimeout)
+	}
+}
+
+// expire closes the tunnel, which makes the proxy close the client side too
+func (t *tunnel) expire(reason string) {
+	log.Printf("closing upgraded connection: %s (request_id:%s)", reason, t.requestID)
+	t.Close()
+}
+
+func (t *tunnel) Close() error {
+	var err error
+	t.once.Do(func() {
+		t.mu.Lock()
+		t.closed = true
+		if t.idle != nil {
+			t.idle.Stop()
+		}
+		if t.lifetime != nil {
+			t.lifetime.Stop()
+		}
+		t.mu.Unlock()
+		err = t.ReadWriteCloser.Close()
+	})
+	return err
+}
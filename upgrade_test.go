@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newEchoUpgradeServer switches to an "echo" protocol that writes back
+// everything it receives
+func newEchoUpgradeServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Failed to hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newUpgradeProxy serves a reverse proxy for config in front of upstream
+func newUpgradeProxy(t *testing.T, upstream *httptest.Server, config *Config) string {
+	t.Helper()
+	config.ToPort = serverPort(t, upstream)
+	config.MaxConns = 1
+	proxy, err := newReverseProxy(config)
+	if err != nil {
+		t.Fatalf("Failed to create reverse proxy: %v", err)
+	}
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String()
+}
+
+// openTunnel sends an upgrade request to addr and returns the connection and
+// the response status
+func openTunnel(t *testing.T, addr string) (net.Conn, *bufio.Reader, int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return conn, br, resp.StatusCode
+}
+
+// echo sends msg through the tunnel and reports whether it came back
+func echo(conn net.Conn, br *bufio.Reader, msg string) bool {
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return false
+	}
+	buf := make([]byte, len(msg))
+	_, err := io.ReadFull(br, buf)
+	return err == nil && string(buf) == msg
+}
+
+// waitClosed reports whether the tunnel is closed by the proxy within timeout
+func waitClosed(conn net.Conn, br *bufio.Reader, timeout time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := br.ReadByte()
+	return err == io.EOF
+}
+
+func TestUpgradeLimitHeldForTunnelLifetime(t *testing.T) {
+	addr := newUpgradeProxy(t, newEchoUpgradeServer(t), &Config{UpgradeLimit: 1})
+
+	conn, br, status := openTunnel(t, addr)
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status 101, got %d", status)
+	}
+	if !echo(conn, br, "hello") {
+		t.Fatal("Expected the tunnel to echo")
+	}
+
+	// The first tunnel still holds the only slot
+	if _, _, status := openTunnel(t, addr); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 while the tunnel is open, got %d", status)
+	}
+
+	// Plain requests are not limited by upgrades
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		t.Error("Expected plain request not to be limited")
+	}
+
+	conn.Close()
+	if !waitFor(t, 2*time.Second, func() bool {
+		_, _, status := openTunnel(t, addr)
+		return status == http.StatusSwitchingProtocols
+	}) {
+		t.Error("Expected the slot to be released when the tunnel closes")
+	}
+}
+
+func TestUpgradeIdleTimeout(t *testing.T) {
+	addr := newUpgradeProxy(t, newEchoUpgradeServer(t), &Config{UpgradeIdleTimeout: 200 * time.Millisecond})
+
+	conn, br, status := openTunnel(t, addr)
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status 101, got %d", status)
+	}
+
+	// Traffic keeps the tunnel open past the idle timeout
+	for i := 0; i < 5; i++ {
+		if !echo(conn, br, "ping") {
+			t.Fatalf("Expected the active tunnel to stay open, failed at %d", i)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if !waitClosed(conn, br, 2*time.Second) {
+		t.Error("Expected the idle tunnel to be closed")
+	}
+}
+
+func TestUpgradeMaxLifetime(t *testing.T) {
+	addr := newUpgradeProxy(t, newEchoUpgradeServer(t), &Config{UpgradeMaxLifetime: 300 * time.Millisecond})
+
+	conn, br, status := openTunnel(t, addr)
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status 101, got %d", status)
+	}
+
+	// The tunnel is closed even while active
+	start := time.Now()
+	for echo(conn, br, "ping") {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("Expected the tunnel to be closed after its maximum lifetime")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("Expected the tunnel to stay open until its maximum lifetime, closed after %v", elapsed)
+	}
+}
+
+func TestNewUpgradeLimiterDisabled(t *testing.T) {
+	if l := newUpgradeLimiter(&Config{}); l != nil {
+		t.Error("Expected nil limiter without a limit and timeouts")
+	}
+
+	// A nil limiter is safe to use
+	var l *upgradeLimiter
+	release, err := l.acquire(newTestRequest(t, http.Header{"Upgrade": {"websocket"}}))
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	release()
+}